@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"github.com/dgrijalva/jwt-go"
@@ -12,6 +13,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -26,6 +28,13 @@ const FETCH_URL = "https://panel.lontra.tech/api/v1/ads/active/" // Address from
 const EVENT_URL = "https://eventserver.lontra.tech/"             // Address to which ads are to be sent.
 const API_TEMPLATE = "/api/ads"                                  // URL that will be routed to the getNewAd handler.
 const PUBLISHER_ID_RECV_PARAM = "publisherID"                    // Name of the parameter in URL received from publisher that specifies publisher's id.
+const CONSENT_RECV_PARAM = "consent"                             // Simple consent signal from publisher: "1" when the viewer consented to tracking.
+const TCF_CONSENT_RECV_PARAM = "gdpr_consent"                    // IAB TCF v2 consent string; takes precedence over the simple signal.
+const VIEWER_ID_RECV_PARAM = "viewerID"                          // Publisher-side viewer ID, only kept when the viewer consented.
+const TCF_PURPOSE_ONE_BIT = 152                                  // Bit of consent to purpose 1 (store and access information on a device) in a TCF v2 core string.
+
+const QUALITY_URL = "https://reporter.lontra.tech/publishers/quality" // Address from which the quality of publishers is fetched.
+const QUALITY_FETCH_PERIOD = 600                                      // How many seconds to wait between fetching the quality of publishers.
 
 const PRINT_RESPONSE = true                                            // Whether to print allAds after it is fetched.
 const USER_TOKEN_SIZE = 30                                             // User token is a random token attached to the sent click and impression link.
@@ -40,25 +49,45 @@ type FetchedAd struct {
 	ImageSource  string `json:"ImagePath"`
 	Bid          int    `json:"BidValue"`
 	RedirectLink string `json:"RedirectLink"`
+	AdvertiserID int    `json:"AdvertiserID"`
 }
 
 /* This struct will be signed by AdServer and eventually sent to Event Server. */
 type EventInfo struct {
-	UserID      string
-	PublisherID string
-	AdID        string
-	AdURL       string
-	EventType   string
+	UserID       string
+	ResponseID   string // Shared by the click and impression links of one response.
+	PublisherID  string
+	AdID         string
+	AdvertiserID string
+	AdURL        string
+	EventType    string
+	Price        int64
+	ViewerID     string // Empty unless Consent is set.
+	Consent      bool
 
 	jwt.StandardClaims
 }
 
+/* Privacy signals of the viewer an ad is served to. */
+type Viewer struct {
+	ID      string
+	Consent bool
+}
+
 /* This information gets serialized to JSON and will be sent to Publisher. */
 type ResponseInfo struct {
 	Title          string `json:"Title"`
 	ImagePath      string `json:"ImagePath"`
 	ClickLink      string `json:"ClickLink"`
 	ImpressionLink string `json:"ImpressionLink"`
+	ViewableLink   string `json:"ViewableLink"`
+}
+
+/* Quality of the traffic of a publisher, as scored daily by Reporter. */
+type PublisherQuality struct {
+	PublisherID string  `json:"publisher_id"`
+	Score       float64 `json:"score"`  // From 0, worst, to 100.
+	Status      string  `json:"status"` // ok, review or excluded.
 }
 
 type DisableAdsRequest struct {
@@ -69,6 +98,9 @@ type DisableAdsRequest struct {
 
 var allFetchedAds []FetchedAd // A slice containing all ads.
 
+var publisherQuality = map[int]PublisherQuality{} // Quality of the scored publishers, by ID.
+var publisherQualityLock sync.RWMutex
+
 /* Functions of the Server */
 
 /*
@@ -153,6 +185,73 @@ func periodicallyFetchAds() {
 	}
 }
 
+/*
+Fetches the quality of the publishers from Reporter,
+replacing the qualities fetched before.
+*/
+func fetchQualityOnce() error {
+	resp, err := http.DefaultClient.Get(QUALITY_URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("reporter sent " + resp.Status)
+	}
+	var qualities []PublisherQuality
+	if err := json.NewDecoder(resp.Body).Decode(&qualities); err != nil {
+		return err
+	}
+
+	fetched := make(map[int]PublisherQuality, len(qualities))
+	for _, quality := range qualities {
+		if id, err := strconv.Atoi(quality.PublisherID); err == nil {
+			fetched[id] = quality
+		}
+	}
+	publisherQualityLock.Lock()
+	publisherQuality = fetched
+	publisherQualityLock.Unlock()
+	return nil
+}
+
+/*
+In an infinite loop, calls fetchQualityOnce every
+`QUALITY_FETCH_PERIOD` seconds. On error, the
+qualities fetched before are kept.
+*/
+func periodicallyFetchQuality() {
+	for {
+		if err := fetchQualityOnce(); err != nil {
+			log.Println("error while fetching publisher quality:", err)
+		}
+		time.Sleep(QUALITY_FETCH_PERIOD * time.Second)
+	}
+}
+
+/*
+Tells whether to serve an ad to a publisher. Excluded
+publishers get none, and those under review get ads
+in proportion to their score. Unscored publishers
+are always served.
+*/
+func servesPublisher(publisherId int) bool {
+	publisherQualityLock.RLock()
+	quality, ok := publisherQuality[publisherId]
+	publisherQualityLock.RUnlock()
+	if !ok {
+		return true
+	}
+	switch quality.Status {
+	case "excluded":
+		return false
+	case "review":
+		return rand.Float64()*100 < quality.Score
+	default:
+		return true
+	}
+}
+
 /*
 Selects best ads based on AdServer's policy.
 Current policy: to select ad with highest bid.
@@ -202,13 +301,20 @@ func generateRandomToken(size int) string {
 
 private key of AdServer.
 */
-func generateSignedEventInfo(action string, selectedAd FetchedAd, requestingPublisherId int) (string, error) {
+func generateSignedEventInfo(action string, selectedAd FetchedAd, requestingPublisherId int, responseId string, viewer Viewer) (string, error) {
 	var eventInfo EventInfo
+	eventInfo.ResponseID = responseId
 	eventInfo.AdID = strconv.Itoa(selectedAd.Id)
 	eventInfo.PublisherID = strconv.Itoa(requestingPublisherId)
 	eventInfo.UserID = generateRandomToken(USER_TOKEN_SIZE)
+	eventInfo.AdvertiserID = strconv.Itoa(selectedAd.AdvertiserID)
 	eventInfo.AdURL = selectedAd.RedirectLink
+	eventInfo.Price = int64(selectedAd.Bid)
 	eventInfo.EventType = action
+	eventInfo.Consent = viewer.Consent
+	if viewer.Consent {
+		eventInfo.ViewerID = viewer.ID
+	}
 	eventInfo.StandardClaims.IssuedAt = time.Now().Unix()
 
 	signedInfo, err := signEvent(&eventInfo)
@@ -223,17 +329,22 @@ func generateSignedEventInfo(action string, selectedAd FetchedAd, requestingPubl
 
 in it and returns it.
 */
-func makeResopnse(selectedAd FetchedAd, requestingPublisherId int) (ResponseInfo, error) {
+func makeResopnse(selectedAd FetchedAd, requestingPublisherId int, viewer Viewer) (ResponseInfo, error) {
 	var response ResponseInfo
 	var err error
 
 	response.Title = selectedAd.Title
 	response.ImagePath = selectedAd.ImageSource
-	response.ClickLink, err = generateSignedEventInfo("click", selectedAd, requestingPublisherId)
+	responseId := generateRandomToken(USER_TOKEN_SIZE)
+	response.ClickLink, err = generateSignedEventInfo("click", selectedAd, requestingPublisherId, responseId, viewer)
 	if err != nil {
 		return response, err
 	}
-	response.ImpressionLink, err = generateSignedEventInfo("impression", selectedAd, requestingPublisherId)
+	response.ImpressionLink, err = generateSignedEventInfo("impression", selectedAd, requestingPublisherId, responseId, viewer)
+	if err != nil {
+		return response, err
+	}
+	response.ViewableLink, err = generateSignedEventInfo("viewable", selectedAd, requestingPublisherId, responseId, viewer)
 	if err != nil {
 		return response, err
 	}
@@ -255,15 +366,56 @@ func signEvent(event *EventInfo) (string, error) {
 	return signedTokenString, nil
 }
 
+/*
+	Tells whether a TCF v2 consent string grants
+
+purpose 1, storing and accessing information on the
+viewer's device. Malformed strings grant nothing.
+*/
+func tcfPurposeOneConsent(tcString string) bool {
+	core := strings.TrimRight(strings.SplitN(tcString, ".", 2)[0], "=")
+	data, err := base64.RawURLEncoding.DecodeString(core)
+	if err != nil || len(data)*8 <= TCF_PURPOSE_ONE_BIT {
+		return false
+	}
+	if data[0]>>2 != 2 { // Version, the first 6 bits.
+		return false
+	}
+	return data[TCF_PURPOSE_ONE_BIT/8]&(0x80>>(TCF_PURPOSE_ONE_BIT%8)) != 0
+}
+
+/*
+	Reads the privacy signals sent by the publisher.
+
+Without any signal, the viewer is assumed not to consent.
+*/
+func viewerFromRequest(c *gin.Context) Viewer {
+	var viewer Viewer
+	if tcString := c.Query(TCF_CONSENT_RECV_PARAM); tcString != "" {
+		viewer.Consent = tcfPurposeOneConsent(tcString)
+	} else {
+		consent := c.Query(CONSENT_RECV_PARAM)
+		viewer.Consent = consent == "1" || consent == "true"
+	}
+	if viewer.Consent {
+		viewer.ID = c.Query(VIEWER_ID_RECV_PARAM)
+	}
+	return viewer
+}
+
 /*
 	Handels GET requests from publishers requesting
 
 for a new ad.
 */
 func getNewAd(c *gin.Context) {
-	selectedAd := selectAd()
 	publisherId, _ := strconv.Atoi(c.Query(PUBLISHER_ID_RECV_PARAM))
-	response, err := makeResopnse(selectedAd, publisherId)
+	if !servesPublisher(publisherId) {
+		c.JSON(http.StatusOK, nil) // The publisher shows that no ad is available.
+		return
+	}
+	selectedAd := selectAd()
+	response, err := makeResopnse(selectedAd, publisherId, viewerFromRequest(c))
 
 	if err != nil {
 		c.AbortWithStatus(http.StatusInternalServerError)
@@ -306,6 +458,7 @@ func main() {
 	/* Run the two main workers: ad-fetcher
 	   and query-responser. */
 	go periodicallyFetchAds()
+	go periodicallyFetchQuality()
 	router := gin.Default()
 	p := ginprometheus.NewPrometheus("adserver")
 	p.Use(router)
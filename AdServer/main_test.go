@@ -2,6 +2,7 @@ package main
 
 import (
 	"dummies/http"
+	"encoding/base64"
 	"fmt"
 	"testing"
 	"time"
@@ -115,3 +116,42 @@ func TestRandomInt(t *testing.T) {
 		}
 	}
 }
+
+/* Checks that purpose 1 consent is read from TCF v2 strings. */
+func TestTCFConsent(t *testing.T) {
+	core := make([]byte, 30)
+	core[0] = 2 << 2 // Version 2.
+	if tcfPurposeOneConsent(base64.RawURLEncoding.EncodeToString(core)) {
+		t.Errorf("Expected no consent without purpose 1")
+	}
+
+	core[TCF_PURPOSE_ONE_BIT/8] |= 0x80 >> (TCF_PURPOSE_ONE_BIT % 8)
+	if !tcfPurposeOneConsent(base64.RawURLEncoding.EncodeToString(core) + ".segment") {
+		t.Errorf("Expected consent with purpose 1")
+	}
+
+	core[0] = 1 << 2 // Version 1 strings are not supported.
+	if tcfPurposeOneConsent(base64.RawURLEncoding.EncodeToString(core)) {
+		t.Errorf("Expected no consent from a version 1 string")
+	}
+	if tcfPurposeOneConsent("not base64!") {
+		t.Errorf("Expected no consent from a malformed string")
+	}
+}
+
+/* Checks that excluded publishers get no ads, while unscored and good ones do. */
+func TestServesPublisher(t *testing.T) {
+	publisherQuality = map[int]PublisherQuality{
+		1: {PublisherID: "1", Score: 95, Status: "ok"},
+		2: {PublisherID: "2", Score: 0, Status: "review"},
+		3: {PublisherID: "3", Score: 100, Status: "review"},
+		4: {PublisherID: "4", Score: 20, Status: "excluded"},
+	}
+	defer func() { publisherQuality = map[int]PublisherQuality{} }()
+
+	for id, expected := range map[int]bool{1: true, 2: false, 3: true, 4: false, 5: true} {
+		if servesPublisher(id) != expected {
+			t.Errorf("Expected servesPublisher(%d) to be %t", id, expected)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+/*
+Package eventschema holds the versioned event schema shared by the
+EventServer, which produces events, and the Reporter, which consumes
+them. Events are encoded in the Protobuf wire format described by
+event.proto.
+*/
+package eventschema
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// SCHEMA_VERSION is the version of event.proto this package encodes.
+const SCHEMA_VERSION = 7
+
+// VERSION_HEADER is the Kafka header carrying the schema version of a
+// message. Messages without it predate this package and hold ad-hoc JSON.
+const VERSION_HEADER = "schema-version"
+
+/* Types of events. */
+const (
+	TYPE_IMPRESSION = "impression"
+	TYPE_CLICK      = "click"
+	TYPE_VIEWABLE   = "viewable"  // MRC viewable: 50% of the ad's pixels in view for 1 continuous second.
+	TYPE_VIEW_TIME  = "view_time" // In-view time of a viewable ad beyond what its viewable event reported.
+	TYPE_CONVERSION = "conversion"
+)
+
+/* Field numbers, as declared in event.proto. */
+const (
+	fieldEventID       protowire.Number = 1
+	fieldType          protowire.Number = 2
+	fieldAdID          protowire.Number = 3
+	fieldAdvertiserID  protowire.Number = 4
+	fieldPublisherID   protowire.Number = 5
+	fieldPrice         protowire.Number = 6
+	fieldTimestamp     protowire.Number = 7
+	fieldClientIPHash  protowire.Number = 8
+	fieldUserAgent     protowire.Number = 9
+	fieldSchemaVersion protowire.Number = 10
+	fieldFraudScore    protowire.Number = 11
+	fieldNotBillable   protowire.Number = 12
+	fieldFraudReasons  protowire.Number = 13
+	fieldResponseID    protowire.Number = 14
+	fieldOrphanClick   protowire.Number = 15
+	fieldInViewMs      protowire.Number = 16
+	fieldClickID       protowire.Number = 17
+	fieldConversionID  protowire.Number = 18
+	fieldValue         protowire.Number = 19
+	fieldConsent       protowire.Number = 20
+	fieldViewerHash    protowire.Number = 21
+)
+
+// Event is a single ad event, as it travels between services.
+type Event struct {
+	EventID       string `json:"event_id"`
+	Type          string `json:"type"`
+	AdID          string `json:"ad_id"`
+	AdvertiserID  string `json:"advertiser_id"`
+	PublisherID   string `json:"publisher_id"`
+	Price         int64  `json:"price"`
+	Timestamp     int64  `json:"timestamp"`
+	ClientIPHash  string `json:"client_ip_hash"`
+	UserAgent     string `json:"user_agent"`
+	SchemaVersion uint32 `json:"schema_version"`
+
+	/* Since version 2. */
+	FraudScore   uint32   `json:"fraud_score"`
+	NotBillable  bool     `json:"not_billable"`
+	FraudReasons []string `json:"fraud_reasons,omitempty"`
+
+	/* Since version 3. */
+	ResponseID  string `json:"response_id"`
+	OrphanClick bool   `json:"orphan_click"`
+
+	/* Since version 4. */
+	InViewMs int64 `json:"in_view_ms"`
+
+	/* Since version 5. */
+	ClickID      string `json:"click_id"`
+	ConversionID string `json:"conversion_id"`
+	Value        int64  `json:"value"`
+
+	/* Since version 6. */
+	Consent bool `json:"consent"`
+
+	/* Since version 7. */
+	ViewerHash string `json:"viewer_hash"`
+}
+
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	return appendVarint(b, num, protowire.EncodeBool(v))
+}
+
+/*
+Marshal encodes the event in the Protobuf wire format. Zero-valued
+fields are omitted, as in proto3. The schema version is always set
+to SCHEMA_VERSION.
+*/
+func Marshal(e *Event) []byte {
+	var b []byte
+	b = appendString(b, fieldEventID, e.EventID)
+	b = appendString(b, fieldType, e.Type)
+	b = appendString(b, fieldAdID, e.AdID)
+	b = appendString(b, fieldAdvertiserID, e.AdvertiserID)
+	b = appendString(b, fieldPublisherID, e.PublisherID)
+	b = appendVarint(b, fieldPrice, uint64(e.Price))
+	b = appendVarint(b, fieldTimestamp, uint64(e.Timestamp))
+	b = appendString(b, fieldClientIPHash, e.ClientIPHash)
+	b = appendString(b, fieldUserAgent, e.UserAgent)
+	b = appendVarint(b, fieldSchemaVersion, SCHEMA_VERSION)
+	b = appendVarint(b, fieldFraudScore, uint64(e.FraudScore))
+	b = appendBool(b, fieldNotBillable, e.NotBillable)
+	for _, reason := range e.FraudReasons {
+		b = protowire.AppendTag(b, fieldFraudReasons, protowire.BytesType)
+		b = protowire.AppendString(b, reason)
+	}
+	b = appendString(b, fieldResponseID, e.ResponseID)
+	b = appendBool(b, fieldOrphanClick, e.OrphanClick)
+	b = appendVarint(b, fieldInViewMs, uint64(e.InViewMs))
+	b = appendString(b, fieldClickID, e.ClickID)
+	b = appendString(b, fieldConversionID, e.ConversionID)
+	b = appendVarint(b, fieldValue, uint64(e.Value))
+	b = appendBool(b, fieldConsent, e.Consent)
+	b = appendString(b, fieldViewerHash, e.ViewerHash)
+	return b
+}
+
+/*
+Unmarshal decodes an event encoded by Marshal. Fields unknown to this
+version of the schema are skipped, so that events produced by a newer
+version can still be read.
+*/
+func Unmarshal(b []byte) (*Event, error) {
+	var e Event
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("invalid tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		switch {
+		case typ == protowire.BytesType && isStringField(num):
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid field %d: %v", num, protowire.ParseError(n))
+			}
+			setString(&e, num, v)
+			b = b[n:]
+		case typ == protowire.VarintType && isVarintField(num):
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid field %d: %v", num, protowire.ParseError(n))
+			}
+			setVarint(&e, num, v)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid field %d: %v", num, protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	if e.SchemaVersion == 0 {
+		return nil, errors.New("missing schema version")
+	}
+	return &e, nil
+}
+
+func isStringField(num protowire.Number) bool {
+	switch num {
+	case fieldEventID, fieldType, fieldAdID, fieldAdvertiserID, fieldPublisherID, fieldClientIPHash, fieldUserAgent,
+		fieldFraudReasons, fieldResponseID, fieldClickID, fieldConversionID, fieldViewerHash:
+		return true
+	}
+	return false
+}
+
+func isVarintField(num protowire.Number) bool {
+	switch num {
+	case fieldPrice, fieldTimestamp, fieldSchemaVersion, fieldFraudScore, fieldNotBillable,
+		fieldOrphanClick, fieldInViewMs, fieldValue, fieldConsent:
+		return true
+	}
+	return false
+}
+
+func setString(e *Event, num protowire.Number, v string) {
+	switch num {
+	case fieldEventID:
+		e.EventID = v
+	case fieldType:
+		e.Type = v
+	case fieldAdID:
+		e.AdID = v
+	case fieldAdvertiserID:
+		e.AdvertiserID = v
+	case fieldPublisherID:
+		e.PublisherID = v
+	case fieldClientIPHash:
+		e.ClientIPHash = v
+	case fieldUserAgent:
+		e.UserAgent = v
+	case fieldFraudReasons:
+		e.FraudReasons = append(e.FraudReasons, v)
+	case fieldResponseID:
+		e.ResponseID = v
+	case fieldClickID:
+		e.ClickID = v
+	case fieldConversionID:
+		e.ConversionID = v
+	case fieldViewerHash:
+		e.ViewerHash = v
+	}
+}
+
+func setVarint(e *Event, num protowire.Number, v uint64) {
+	switch num {
+	case fieldPrice:
+		e.Price = int64(v)
+	case fieldTimestamp:
+		e.Timestamp = int64(v)
+	case fieldSchemaVersion:
+		e.SchemaVersion = uint32(v)
+	case fieldFraudScore:
+		e.FraudScore = uint32(v)
+	case fieldNotBillable:
+		e.NotBillable = protowire.DecodeBool(v)
+	case fieldOrphanClick:
+		e.OrphanClick = protowire.DecodeBool(v)
+	case fieldInViewMs:
+		e.InViewMs = int64(v)
+	case fieldValue:
+		e.Value = int64(v)
+	case fieldConsent:
+		e.Consent = protowire.DecodeBool(v)
+	}
+}
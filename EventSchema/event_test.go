@@ -0,0 +1,70 @@
+package eventschema
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestRoundTrip(t *testing.T) {
+	event := Event{
+		EventID:      "0a1b2c",
+		Type:         TYPE_CLICK,
+		AdID:         "5",
+		AdvertiserID: "2",
+		PublisherID:  "4",
+		Price:        120,
+		Timestamp:    1721000000,
+		ClientIPHash: "deadbeef",
+		UserAgent:    "Mozilla/5.0",
+		FraudScore:   65,
+		NotBillable:  true,
+		FraudReasons: []string{"fast_click", "datacenter_ip"},
+		ResponseID:   "rsp",
+		OrphanClick:  true,
+		InViewMs:     1500,
+		ClickID:      "click",
+		ConversionID: "order-1",
+		Value:        4999,
+		Consent:      true,
+		ViewerHash:   "cafe",
+	}
+
+	decoded, err := Unmarshal(Marshal(&event))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	event.SchemaVersion = SCHEMA_VERSION
+	if !reflect.DeepEqual(*decoded, event) {
+		t.Errorf("Expected %+v, got %+v", event, *decoded)
+	}
+}
+
+/* Events written by a newer producer may carry fields this version does not know. */
+func TestUnknownFieldsAreSkipped(t *testing.T) {
+	event := Event{EventID: "x", AdID: "7"}
+	encoded := Marshal(&event)
+	encoded = protowire.AppendTag(encoded, 99, protowire.BytesType)
+	encoded = protowire.AppendString(encoded, "from the future")
+	encoded = protowire.AppendTag(encoded, 98, protowire.VarintType)
+	encoded = protowire.AppendVarint(encoded, 42)
+
+	decoded, err := Unmarshal(encoded)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if decoded.EventID != "x" || decoded.AdID != "7" {
+		t.Errorf("Known fields were not decoded: %+v", *decoded)
+	}
+}
+
+func TestMissingVersionIsRejected(t *testing.T) {
+	var encoded []byte
+	encoded = protowire.AppendTag(encoded, fieldAdID, protowire.BytesType)
+	encoded = protowire.AppendString(encoded, "7")
+
+	if _, err := Unmarshal(encoded); err == nil {
+		t.Errorf("Expected error, got nil")
+	}
+}
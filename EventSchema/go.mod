@@ -0,0 +1,5 @@
+module eventschema
+
+go 1.22.5
+
+require google.golang.org/protobuf v1.34.1
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const defaultAccessRulesFile = "access_rules.json"
+const defaultAccessRulesReload = 10 * time.Second
+
+/* Lists whose hits are counted in eventserver_access_rule_hits_total. */
+const (
+	ACCESS_LIST_IP         = "ip"
+	ACCESS_LIST_USER_AGENT = "user_agent"
+	ACCESS_LIST_EXCEPTION  = "exception"
+)
+
+/* User agents denied when no rules file exists yet. */
+var defaultDeniedUserAgents = []string{
+	"Python",                // Python scripts
+	"curl",                  // cURL
+	"Postman",               // Postman API client
+	"HttpClient",            // Generic HTTP client
+	"Java",                  // Java clients
+	"Go-http-client",        // Go's default HTTP client
+	"Wget",                  // Wget utility
+	"php",                   // PHP scripts
+	"Ruby",                  // Ruby scripts
+	"Node.js",               // Node.js scripts
+	"BinGet",                // BinGet utility
+	"libwww-perl",           // Perl library
+	"Microsoft URL Control", // Microsoft URL Control tool
+	"Peach",                 // Peach fuzzing tool
+	"pxyscand",              // Proxy scanner
+	"PycURL",                // Python binding to libcurl
+	"Python-urllib",         // Python urllib library
+}
+
+var accessRuleHits = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "eventserver_access_rule_hits_total",
+	Help: "Requests matched by an access rule, by list and rule.",
+}, []string{"list", "rule"})
+
+// PublisherException lets traffic of a publisher through rules that would otherwise deny it
+type PublisherException struct {
+	AllowIPs        []string `json:"allow_ips"`         // IPs or CIDR ranges.
+	AllowUserAgents []string `json:"allow_user_agents"` // Regular expressions.
+}
+
+// AccessRules is the content of the rules file, and of the admin API
+type AccessRules struct {
+	DenyIPs             []string                      `json:"deny_ips"`         // IPs or CIDR ranges.
+	DenyUserAgents      []string                      `json:"deny_user_agents"` // Regular expressions.
+	PublisherExceptions map[string]PublisherException `json:"publisher_exceptions"`
+}
+
+type ipRule struct {
+	source string
+	ipNet  *net.IPNet
+}
+
+type uaRule struct {
+	source  string
+	pattern *regexp.Regexp
+}
+
+type compiledException struct {
+	ips        []ipRule
+	userAgents []uaRule
+}
+
+type compiledRules struct {
+	denyIPs        []ipRule
+	denyUserAgents []uaRule
+	exceptions     map[string]compiledException
+}
+
+/*
+AccessList holds the IP and user agent deny lists. Rules are kept in a
+JSON file, which is reloaded when it changes on disk and rewritten when
+rules are changed through the admin API.
+*/
+type AccessList struct {
+	path    string
+	mu      sync.RWMutex
+	rules   AccessRules
+	matcher compiledRules
+	modTime time.Time
+}
+
+func defaultAccessRules() AccessRules {
+	rules := AccessRules{PublisherExceptions: map[string]PublisherException{}}
+	for _, ua := range defaultDeniedUserAgents {
+		rules.DenyUserAgents = append(rules.DenyUserAgents, regexp.QuoteMeta(ua))
+	}
+	return rules
+}
+
+/*
+Builds the access list from ACCESS_RULES_FILE. A missing file starts
+from the default user agent deny list; it is created on the first
+change made through the admin API.
+*/
+func NewAccessListFromConfig() *AccessList {
+	list := &AccessList{path: getEnv("ACCESS_RULES_FILE", defaultAccessRulesFile)}
+	if err := list.Reload(); err != nil {
+		log.Printf("could not load access rules from %s, using defaults: %v", list.path, err)
+		list.rules = defaultAccessRules()
+		list.matcher, _ = compileAccessRules(list.rules)
+	}
+	return list
+}
+
+func compileIPRules(sources []string) ([]ipRule, error) {
+	var rules []ipRule
+	for _, source := range sources {
+		cidr := strings.TrimSpace(source)
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP rule %q", source)
+		}
+		rules = append(rules, ipRule{source: source, ipNet: ipNet})
+	}
+	return rules, nil
+}
+
+func compileUARules(sources []string) ([]uaRule, error) {
+	var rules []uaRule
+	for _, source := range sources {
+		pattern, err := regexp.Compile(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user agent rule %q: %v", source, err)
+		}
+		rules = append(rules, uaRule{source: source, pattern: pattern})
+	}
+	return rules, nil
+}
+
+func compileAccessRules(rules AccessRules) (compiledRules, error) {
+	var compiled compiledRules
+	var err error
+	if compiled.denyIPs, err = compileIPRules(rules.DenyIPs); err != nil {
+		return compiled, err
+	}
+	if compiled.denyUserAgents, err = compileUARules(rules.DenyUserAgents); err != nil {
+		return compiled, err
+	}
+	compiled.exceptions = make(map[string]compiledException)
+	for publisherID, exception := range rules.PublisherExceptions {
+		var e compiledException
+		if e.ips, err = compileIPRules(exception.AllowIPs); err != nil {
+			return compiled, err
+		}
+		if e.userAgents, err = compileUARules(exception.AllowUserAgents); err != nil {
+			return compiled, err
+		}
+		compiled.exceptions[publisherID] = e
+	}
+	return compiled, nil
+}
+
+// Reload reads the rules file. Invalid files are rejected and the current rules kept.
+func (a *AccessList) Reload() error {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	var rules AccessRules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return err
+	}
+	compiled, err := compileAccessRules(rules)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rules = rules
+	a.matcher = compiled
+	a.modTime = info.ModTime()
+	return nil
+}
+
+// Watch reloads the rules file whenever it changes on disk. It blocks forever.
+func (a *AccessList) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		info, err := os.Stat(a.path)
+		if err != nil {
+			continue
+		}
+		a.mu.RLock()
+		changed := !info.ModTime().Equal(a.modTime)
+		a.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := a.Reload(); err != nil {
+			log.Printf("could not reload access rules from %s: %v", a.path, err)
+		} else {
+			log.Printf("Reloaded access rules from %s", a.path)
+		}
+	}
+}
+
+// Rules returns a copy of the current rules
+func (a *AccessList) Rules() AccessRules {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	data, _ := json.Marshal(a.rules)
+	var rules AccessRules
+	json.Unmarshal(data, &rules)
+	return rules
+}
+
+/*
+Replace validates new rules, writes them to the rules file and starts
+using them. The file is replaced atomically, so a concurrent reload
+never sees it half written.
+*/
+func (a *AccessList) Replace(rules AccessRules) error {
+	compiled, err := compileAccessRules(rules)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	tmpPath := a.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, a.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(a.path); err == nil {
+		a.modTime = info.ModTime()
+	}
+	a.rules = rules
+	a.matcher = compiled
+	return nil
+}
+
+/*
+DeniedUserAgent returns the rule denying userAgent, or "" if it is
+allowed. publisherID may be empty when the request carries no event.
+*/
+func (a *AccessList) DeniedUserAgent(userAgent, publisherID string) string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, rule := range a.matcher.denyUserAgents {
+		if !rule.pattern.MatchString(userAgent) {
+			continue
+		}
+		for _, allowed := range a.matcher.exceptions[publisherID].userAgents {
+			if allowed.pattern.MatchString(userAgent) {
+				accessRuleHits.WithLabelValues(ACCESS_LIST_EXCEPTION, ACCESS_LIST_EXCEPTION).Inc()
+				return ""
+			}
+		}
+		accessRuleHits.WithLabelValues(ACCESS_LIST_USER_AGENT, rule.source).Inc()
+		return rule.source
+	}
+	return ""
+}
+
+// DeniedIP returns the rule denying clientIP, or "" if it is allowed
+func (a *AccessList) DeniedIP(clientIP, publisherID string) string {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return ""
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, rule := range a.matcher.denyIPs {
+		if !rule.ipNet.Contains(ip) {
+			continue
+		}
+		for _, allowed := range a.matcher.exceptions[publisherID].ips {
+			if allowed.ipNet.Contains(ip) {
+				accessRuleHits.WithLabelValues(ACCESS_LIST_EXCEPTION, ACCESS_LIST_EXCEPTION).Inc()
+				return ""
+			}
+		}
+		accessRuleHits.WithLabelValues(ACCESS_LIST_IP, rule.source).Inc()
+		return rule.source
+	}
+	return ""
+}
+
+/* Admin API */
+
+/*
+AdminAuth only lets through requests bearing ADMIN_TOKEN. Without a
+token configured, the admin API is closed.
+*/
+func AdminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		given := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
+
+type accessRuleRequest struct {
+	Rule string `json:"rule" binding:"required"`
+}
+
+func (a *AccessList) getRules(c *gin.Context) {
+	c.JSON(http.StatusOK, a.Rules())
+}
+
+func (a *AccessList) putRules(c *gin.Context) {
+	var rules AccessRules
+	if err := c.ShouldBindJSON(&rules); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	a.update(c, func(current *AccessRules) error {
+		*current = rules
+		return nil
+	})
+}
+
+// update applies change to a copy of the current rules and saves the result
+func (a *AccessList) update(c *gin.Context, change func(rules *AccessRules) error) {
+	rules := a.Rules()
+	if err := change(&rules); err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err := a.Replace(rules); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rules)
+}
+
+/* Handlers adding and removing a single rule of the deny list selected by field. */
+
+func (a *AccessList) addRule(field func(rules *AccessRules) *[]string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request accessRuleRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		a.update(c, func(rules *AccessRules) error {
+			list := field(rules)
+			for _, rule := range *list {
+				if rule == request.Rule {
+					return nil
+				}
+			}
+			*list = append(*list, request.Rule)
+			return nil
+		})
+	}
+}
+
+func (a *AccessList) removeRule(field func(rules *AccessRules) *[]string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rule := c.Query("rule")
+		a.update(c, func(rules *AccessRules) error {
+			list := field(rules)
+			for i := range *list {
+				if (*list)[i] == rule {
+					*list = append((*list)[:i], (*list)[i+1:]...)
+					return nil
+				}
+			}
+			return errors.New("no such rule")
+		})
+	}
+}
+
+func (a *AccessList) putException(c *gin.Context) {
+	var exception PublisherException
+	if err := c.ShouldBindJSON(&exception); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	a.update(c, func(rules *AccessRules) error {
+		if rules.PublisherExceptions == nil {
+			rules.PublisherExceptions = map[string]PublisherException{}
+		}
+		rules.PublisherExceptions[c.Param("publisher_id")] = exception
+		return nil
+	})
+}
+
+func (a *AccessList) deleteException(c *gin.Context) {
+	a.update(c, func(rules *AccessRules) error {
+		if _, ok := rules.PublisherExceptions[c.Param("publisher_id")]; !ok {
+			return errors.New("no such exception")
+		}
+		delete(rules.PublisherExceptions, c.Param("publisher_id"))
+		return nil
+	})
+}
+
+// SetupAdminRoutes registers the access list management API under group
+func (a *AccessList) SetupAdminRoutes(group *gin.RouterGroup) {
+	denyIPs := func(rules *AccessRules) *[]string { return &rules.DenyIPs }
+	denyUserAgents := func(rules *AccessRules) *[]string { return &rules.DenyUserAgents }
+
+	group.GET("/access", a.getRules)
+	group.PUT("/access", a.putRules)
+	group.POST("/access/ips", a.addRule(denyIPs))
+	group.DELETE("/access/ips", a.removeRule(denyIPs))
+	group.POST("/access/user-agents", a.addRule(denyUserAgents))
+	group.DELETE("/access/user-agents", a.removeRule(denyUserAgents))
+	group.PUT("/access/exceptions/:publisher_id", a.putException)
+	group.DELETE("/access/exceptions/:publisher_id", a.deleteException)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessListDefaults(t *testing.T) {
+	t.Setenv("ACCESS_RULES_FILE", filepath.Join(t.TempDir(), "missing.json"))
+	access := NewAccessListFromConfig()
+
+	assert.Equal(t, "curl", access.DeniedUserAgent("curl/8.0", ""))
+	assert.Equal(t, "", access.DeniedUserAgent("Mozilla/5.0", ""))
+	assert.Equal(t, "", access.DeniedIP("203.0.113.7", ""))
+}
+
+func TestAccessListRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access_rules.json")
+	t.Setenv("ACCESS_RULES_FILE", path)
+	access := NewAccessListFromConfig()
+
+	err := access.Replace(AccessRules{
+		DenyIPs:        []string{"203.0.113.0/24", "2001:db8::1"},
+		DenyUserAgents: []string{"(?i)scrapy"},
+		PublisherExceptions: map[string]PublisherException{
+			"7": {AllowIPs: []string{"203.0.113.7"}, AllowUserAgents: []string{"Scrapy/2"}},
+		},
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, "203.0.113.0/24", access.DeniedIP("203.0.113.7", "4"))
+	assert.Equal(t, "", access.DeniedIP("203.0.113.7", "7"))
+	assert.Equal(t, "203.0.113.0/24", access.DeniedIP("203.0.113.8", "7"))
+	assert.Equal(t, "2001:db8::1", access.DeniedIP("2001:db8::1", ""))
+	assert.Equal(t, "(?i)scrapy", access.DeniedUserAgent("scrapy/1", "7"))
+	assert.Equal(t, "", access.DeniedUserAgent("Scrapy/2.11", "7"))
+
+	// Invalid rules are refused and the current ones kept.
+	assert.NotNil(t, access.Replace(AccessRules{DenyIPs: []string{"not-an-ip"}}))
+	assert.Equal(t, "203.0.113.0/24", access.DeniedIP("203.0.113.9", ""))
+
+	// Edits of the file are picked up by a reload.
+	assert.Nil(t, os.WriteFile(path, []byte(`{"deny_ips": ["198.51.100.0/24"]}`), 0644))
+	assert.Nil(t, access.Reload())
+	assert.Equal(t, "", access.DeniedIP("203.0.113.9", ""))
+	assert.Equal(t, "198.51.100.0/24", access.DeniedIP("198.51.100.1", ""))
+}
+
+func TestAccessAdminAPI(t *testing.T) {
+	t.Setenv("ACCESS_RULES_FILE", filepath.Join(t.TempDir(), "access_rules.json"))
+	t.Setenv("ADMIN_TOKEN", "secret")
+	server := NewEventServer(NewFakeSink(), FakeCaptchaVerifier{})
+	router := server.SetupRouter()
+
+	send := func(method, path, token, body string) int {
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("User-Agent", "curl/8.0")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, send("POST", "/admin/access/ips", "wrong", `{"rule": "192.0.2.0/24"}`))
+	assert.Equal(t, http.StatusBadRequest, send("POST", "/admin/access/ips", "secret", `{"rule": "192.0.2.0/33"}`))
+	assert.Equal(t, http.StatusOK, send("POST", "/admin/access/ips", "secret", `{"rule": "192.0.2.0/24"}`))
+	assert.Equal(t, "192.0.2.0/24", server.access.DeniedIP("192.0.2.1", ""))
+
+	// Clicks from a denied IP are refused.
+	clickEvent := Event{UserID: "denied-token", AdID: "5", PublisherID: "7", EventType: "click", AdURL: "http://yahoo.com"}
+	clickEvent.IssuedAt = time.Now().Unix()
+	signedClickLink, err := signEvent(&clickEvent)
+	assert.Nil(t, err)
+	req, _ := http.NewRequest("GET", "/click/"+signedClickLink, nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	req.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	assert.Equal(t, http.StatusOK, send("DELETE", "/admin/access/ips?rule=192.0.2.0/24", "secret", ""))
+	assert.Equal(t, http.StatusNotFound, send("DELETE", "/admin/access/ips?rule=192.0.2.0/24", "secret", ""))
+	assert.Equal(t, "", server.access.DeniedIP("192.0.2.1", ""))
+}
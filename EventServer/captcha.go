@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* Names accepted in the CAPTCHA_PROVIDER environment variable. */
+const (
+	CAPTCHA_RECAPTCHA = "recaptcha"
+	CAPTCHA_HCAPTCHA  = "hcaptcha"
+	CAPTCHA_TURNSTILE = "turnstile"
+	CAPTCHA_POW       = "pow"
+	CAPTCHA_FAKE      = "fake"
+)
+
+const captchaVerifyTimeout = 5 * time.Second
+const defaultPowDifficulty = 16 // Leading zero bits required in the proof-of-work hash.
+const powChallengeValidity = 5 * time.Minute
+const fakeCaptchaAnswer = "pass" // The only answer accepted by the fake provider.
+
+// CaptchaWidget tells captcha.html how to render a challenge
+type CaptchaWidget struct {
+	Provider    string
+	ScriptURL   string
+	WidgetClass string
+	SiteKey     string
+	Challenge   string // Proof-of-work only.
+	Difficulty  int    // Proof-of-work only.
+}
+
+// CaptchaVerifier renders captcha challenges and checks their solutions
+type CaptchaVerifier interface {
+	Widget() CaptchaWidget
+	Verify(c *gin.Context) bool
+}
+
+/*
+Builds the captcha verifier chosen by CAPTCHA_PROVIDER. The site key
+and secret of hosted providers come from CAPTCHA_SITE_KEY and
+CAPTCHA_SECRET, which they cannot run without.
+*/
+func NewCaptchaVerifierFromConfig() (CaptchaVerifier, error) {
+	provider := getEnv("CAPTCHA_PROVIDER", CAPTCHA_RECAPTCHA)
+	siteKey := getEnv("CAPTCHA_SITE_KEY", "")
+	secret := getEnv("CAPTCHA_SECRET", "")
+
+	switch provider {
+	case CAPTCHA_RECAPTCHA, CAPTCHA_HCAPTCHA, CAPTCHA_TURNSTILE:
+		if siteKey == "" || secret == "" {
+			return nil, fmt.Errorf("captcha provider %q requires CAPTCHA_SITE_KEY and CAPTCHA_SECRET", provider)
+		}
+	}
+
+	switch provider {
+	case CAPTCHA_RECAPTCHA:
+		return NewRecaptchaVerifier(siteKey, secret), nil
+	case CAPTCHA_HCAPTCHA:
+		return NewHCaptchaVerifier(siteKey, secret), nil
+	case CAPTCHA_TURNSTILE:
+		return NewTurnstileVerifier(siteKey, secret), nil
+	case CAPTCHA_POW:
+		return NewProofOfWorkVerifier([]byte(secret), getEnvInt("CAPTCHA_POW_DIFFICULTY", defaultPowDifficulty)), nil
+	case CAPTCHA_FAKE:
+		return FakeCaptchaVerifier{}, nil
+	default:
+		return nil, fmt.Errorf("unknown captcha provider %q", provider)
+	}
+}
+
+/* Hosted providers */
+
+/*
+SiteVerifyCaptcha checks solutions against a hosted provider.
+reCAPTCHA, hCaptcha and Turnstile share the same siteverify protocol
+and only differ in their endpoints and form field names.
+*/
+type SiteVerifyCaptcha struct {
+	widget        CaptchaWidget
+	responseField string
+	verifyURL     string
+	secret        string
+	client        *http.Client
+}
+
+type SiteVerifyResponse struct {
+	Success     bool     `json:"success"`
+	ChallengeTs string   `json:"challenge_ts"`
+	Hostname    string   `json:"hostname"`
+	ErrorCodes  []string `json:"error-codes"`
+}
+
+func NewRecaptchaVerifier(siteKey, secret string) *SiteVerifyCaptcha {
+	return &SiteVerifyCaptcha{
+		widget: CaptchaWidget{
+			Provider:    CAPTCHA_RECAPTCHA,
+			ScriptURL:   "https://www.google.com/recaptcha/api.js",
+			WidgetClass: "g-recaptcha",
+			SiteKey:     siteKey,
+		},
+		responseField: "g-recaptcha-response",
+		verifyURL:     "https://www.google.com/recaptcha/api/siteverify",
+		secret:        secret,
+		client:        &http.Client{Timeout: captchaVerifyTimeout},
+	}
+}
+
+func NewHCaptchaVerifier(siteKey, secret string) *SiteVerifyCaptcha {
+	return &SiteVerifyCaptcha{
+		widget: CaptchaWidget{
+			Provider:    CAPTCHA_HCAPTCHA,
+			ScriptURL:   "https://js.hcaptcha.com/1/api.js",
+			WidgetClass: "h-captcha",
+			SiteKey:     siteKey,
+		},
+		responseField: "h-captcha-response",
+		verifyURL:     "https://api.hcaptcha.com/siteverify",
+		secret:        secret,
+		client:        &http.Client{Timeout: captchaVerifyTimeout},
+	}
+}
+
+func NewTurnstileVerifier(siteKey, secret string) *SiteVerifyCaptcha {
+	return &SiteVerifyCaptcha{
+		widget: CaptchaWidget{
+			Provider:    CAPTCHA_TURNSTILE,
+			ScriptURL:   "https://challenges.cloudflare.com/turnstile/v0/api.js",
+			WidgetClass: "cf-turnstile",
+			SiteKey:     siteKey,
+		},
+		responseField: "cf-turnstile-response",
+		verifyURL:     "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+		secret:        secret,
+		client:        &http.Client{Timeout: captchaVerifyTimeout},
+	}
+}
+
+func (v *SiteVerifyCaptcha) Widget() CaptchaWidget {
+	return v.widget
+}
+
+func (v *SiteVerifyCaptcha) Verify(c *gin.Context) bool {
+	response := c.PostForm(v.responseField)
+	if response == "" {
+		return false
+	}
+
+	resp, err := v.client.PostForm(v.verifyURL, url.Values{
+		"secret":   {v.secret},
+		"response": {response},
+		"remoteip": {c.ClientIP()},
+	})
+	if err != nil {
+		log.Printf("Failed to verify %s: %v", v.widget.Provider, err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	var result SiteVerifyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		log.Printf("Failed to parse %s response: %v", v.widget.Provider, err)
+		return false
+	}
+	return result.Success
+}
+
+/* Self-hosted proof of work */
+
+/*
+ProofOfWorkVerifier asks the browser to find a nonce such that the
+SHA-256 of challenge+nonce starts with a number of zero bits. Challenges
+are signed, expire and may be used only once, so nothing needs to be
+stored until they are solved.
+*/
+type ProofOfWorkVerifier struct {
+	key        []byte
+	difficulty int
+	mu         sync.Mutex
+	used       map[string]time.Time // Solved challenges, until they expire.
+}
+
+/* A key is generated when none is given; challenges then only verify on this instance. */
+func NewProofOfWorkVerifier(key []byte, difficulty int) *ProofOfWorkVerifier {
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Printf("could not generate proof-of-work key: %v", err)
+		}
+	}
+	return &ProofOfWorkVerifier{key: key, difficulty: difficulty, used: make(map[string]time.Time)}
+}
+
+func (v *ProofOfWorkVerifier) sign(payload string) string {
+	mac := hmac.New(sha256.New, v.key)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewChallenge returns a signed challenge of the form expiry.random.signature
+func (v *ProofOfWorkVerifier) NewChallenge() string {
+	random := make([]byte, 12)
+	if _, err := rand.Read(random); err != nil {
+		log.Printf("could not generate proof-of-work challenge: %v", err)
+	}
+	expiry := strconv.FormatInt(time.Now().Add(powChallengeValidity).Unix(), 10)
+	payload := expiry + "." + base64.RawURLEncoding.EncodeToString(random)
+	return payload + "." + v.sign(payload)
+}
+
+func (v *ProofOfWorkVerifier) Widget() CaptchaWidget {
+	return CaptchaWidget{
+		Provider:   CAPTCHA_POW,
+		Challenge:  v.NewChallenge(),
+		Difficulty: v.difficulty,
+	}
+}
+
+func (v *ProofOfWorkVerifier) Verify(c *gin.Context) bool {
+	return v.check(c.PostForm("pow-challenge"), c.PostForm("pow-nonce"))
+}
+
+func (v *ProofOfWorkVerifier) check(challenge, nonce string) bool {
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 3 || nonce == "" {
+		return false
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(v.sign(payload)), []byte(parts[2])) {
+		return false
+	}
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	now := time.Now()
+	if err != nil || now.Unix() > expiry {
+		return false
+	}
+	if leadingZeroBits(sha256.Sum256([]byte(challenge+nonce))) < v.difficulty {
+		return false
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for used, expiresAt := range v.used {
+		if now.After(expiresAt) {
+			delete(v.used, used)
+		}
+	}
+	if _, ok := v.used[challenge]; ok {
+		return false
+	}
+	v.used[challenge] = time.Unix(expiry, 0)
+	return true
+}
+
+func leadingZeroBits(digest [sha256.Size]byte) int {
+	zeros := 0
+	for i := 0; i < len(digest); i += 8 {
+		word := binary.BigEndian.Uint64(digest[i : i+8])
+		zeros += bits.LeadingZeros64(word)
+		if word != 0 {
+			break
+		}
+	}
+	return zeros
+}
+
+/* Offline fake */
+
+// FakeCaptchaVerifier accepts the answer "pass". It is meant for tests and local runs.
+type FakeCaptchaVerifier struct{}
+
+func (FakeCaptchaVerifier) Widget() CaptchaWidget {
+	return CaptchaWidget{Provider: CAPTCHA_FAKE}
+}
+
+func (FakeCaptchaVerifier) Verify(c *gin.Context) bool {
+	return c.PostForm("captcha-response") == fakeCaptchaAnswer
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func postForm(router *gin.Engine, path string, form url.Values) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// TestFakeCaptchaFlow walks through the captcha page and its verification with the offline provider
+func TestFakeCaptchaFlow(t *testing.T) {
+	router := setupRouter()
+
+	var clickEvent = Event{
+		UserID:      "a-captcha-token",
+		AdID:        "5",
+		AdURL:       "http://yahoo.com",
+		PublisherID: "7",
+		EventType:   "click",
+	}
+	signedClickLink, err := signEvent(&clickEvent)
+	assert.Nil(t, err)
+
+	req, _ := http.NewRequest("GET", "/captcha?info="+signedClickLink, nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `name="captcha-response"`)
+
+	w = postForm(router, "/verify-captcha", url.Values{"info": {signedClickLink}, "captcha-response": {"fail"}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = postForm(router, "/verify-captcha", url.Values{"info": {signedClickLink}, "captcha-response": {fakeCaptchaAnswer}})
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assertRedirectsWithClickID(t, w, "http://yahoo.com")
+}
+
+// TestProofOfWork checks that solved challenges are accepted once, and tampered ones never
+func TestProofOfWork(t *testing.T) {
+	verifier := NewProofOfWorkVerifier(nil, 8)
+	challenge := verifier.NewChallenge()
+
+	nonce := 0
+	for leadingZeroBits(sha256.Sum256([]byte(challenge+strconv.Itoa(nonce)))) < 8 {
+		nonce++
+	}
+
+	assert.False(t, verifier.check(challenge, ""))
+	assert.False(t, verifier.check("1."+challenge[2:], strconv.Itoa(nonce)))
+	assert.True(t, verifier.check(challenge, strconv.Itoa(nonce)))
+	assert.False(t, verifier.check(challenge, strconv.Itoa(nonce)), "a challenge must not be accepted twice")
+}
+
+// TestSiteVerifyCaptcha checks verification against a hosted provider's siteverify endpoint
+func TestSiteVerifyCaptcha(t *testing.T) {
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		json.NewEncoder(w).Encode(SiteVerifyResponse{Success: r.Form.Get("secret") == "secret" && r.Form.Get("response") == "solved"})
+	}))
+	defer provider.Close()
+
+	verifier := NewTurnstileVerifier("site", "secret")
+	verifier.verifyURL = provider.URL
+	router := gin.New()
+	router.POST("/verify", func(c *gin.Context) {
+		if verifier.Verify(c) {
+			c.Status(http.StatusOK)
+		} else {
+			c.Status(http.StatusForbidden)
+		}
+	})
+
+	assert.Equal(t, http.StatusOK, postForm(router, "/verify", url.Values{"cf-turnstile-response": {"solved"}}).Code)
+	assert.Equal(t, http.StatusForbidden, postForm(router, "/verify", url.Values{"cf-turnstile-response": {"bogus"}}).Code)
+	assert.Equal(t, http.StatusForbidden, postForm(router, "/verify", url.Values{"g-recaptcha-response": {"solved"}}).Code)
+}
+
+func TestCaptchaVerifierFromConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider string
+		siteKey  string
+		secret   string
+		valid    bool
+	}{
+		{"recaptcha with keys", CAPTCHA_RECAPTCHA, "site", "secret", true},
+		{"recaptcha by default without keys", "", "", "", false},
+		{"hcaptcha without secret", CAPTCHA_HCAPTCHA, "site", "", false},
+		{"turnstile without site key", CAPTCHA_TURNSTILE, "", "secret", false},
+		{"proof of work without secret", CAPTCHA_POW, "", "", true},
+		{"fake", CAPTCHA_FAKE, "", "", true},
+		{"unknown provider", "other", "site", "secret", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.provider != "" {
+				t.Setenv("CAPTCHA_PROVIDER", tt.provider)
+			}
+			t.Setenv("CAPTCHA_SITE_KEY", tt.siteKey)
+			t.Setenv("CAPTCHA_SECRET", tt.secret)
+			verifier, err := NewCaptchaVerifierFromConfig()
+			if tt.valid {
+				assert.Nil(t, err)
+				assert.NotNil(t, verifier)
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+const defaultAttributionWindow = 7 * 24 * time.Hour
+const conversionEvictInterval = time.Minute // How often conversions whose click left the window are forgotten.
+const CLICK_ID_PARAM = "click_id"           // Query parameter carrying the click ID to the advertiser, and back.
+
+// A transparent 1x1 GIF, served by the conversion pixel.
+var transparentPixel = []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\x00\x00\x00!\xf9\x04\x01\x00\x00\x00\x00,\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02D\x01\x00;")
+
+var (
+	ErrUnknownClick        = errors.New("unknown click ID")
+	ErrOutsideWindow       = errors.New("conversion outside the attribution window")
+	ErrDuplicateConversion = errors.New("conversion already recorded")
+)
+
+/*
+ClickClaims are signed into the click ID handed to the advertiser, so
+that a conversion can be attributed to its click without keeping every
+click in memory for the whole attribution window.
+*/
+type ClickClaims struct {
+	ClickID      string
+	AdID         string
+	AdvertiserID string
+	PublisherID  string
+	ResponseID   string
+	jwt.StandardClaims
+}
+
+/*
+mintClickID assigns a click ID to a click happening now, and returns
+it signed for the advertiser. Events carry the bare ID, so that clicks
+and conversions can be joined downstream.
+*/
+func mintClickID(event *Event) (string, error) {
+	claims := ClickClaims{
+		ClickID:      newEventID(),
+		AdID:         event.AdID,
+		AdvertiserID: event.AdvertiserID,
+		PublisherID:  event.PublisherID,
+		ResponseID:   event.ResponseID,
+	}
+	claims.IssuedAt = time.Now().Unix()
+	event.ClickID = claims.ClickID
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, &claims).SignedString(JWT_ENCRYPTION_KEY)
+}
+
+// appendClickID adds the click ID to the query of the ad URL
+func appendClickID(adURL, clickID string) string {
+	if clickID == "" {
+		return adURL
+	}
+	parsed, err := url.Parse(adURL)
+	if err != nil {
+		return adURL
+	}
+	query := parsed.Query()
+	query.Set(CLICK_ID_PARAM, clickID)
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
+
+// ConversionTracker attributes conversions to clicks and rejects duplicates
+type ConversionTracker struct {
+	window time.Duration
+	mu     sync.Mutex
+	seen   map[string]time.Time // Recorded conversions, until their click leaves the window.
+}
+
+func NewConversionTracker(window time.Duration) *ConversionTracker {
+	return &ConversionTracker{window: window, seen: make(map[string]time.Time)}
+}
+
+/*
+Attribute checks a conversion reported for a click ID. A click ID
+converts at most once per conversion ID, and only within the
+attribution window after the click.
+*/
+func (t *ConversionTracker) Attribute(clickID, conversionID string, now time.Time) (*ClickClaims, error) {
+	var claims ClickClaims
+	parsedToken, err := jwt.ParseWithClaims(clickID, &claims, func(t *jwt.Token) (interface{}, error) {
+		return JWT_ENCRYPTION_KEY, nil
+	})
+	if err != nil || !parsedToken.Valid || claims.ClickID == "" {
+		return nil, ErrUnknownClick
+	}
+
+	expiresAt := time.Unix(claims.IssuedAt, 0).Add(t.window)
+	if now.After(expiresAt) {
+		return nil, ErrOutsideWindow
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := claims.ClickID + "/" + conversionID
+	if _, ok := t.seen[key]; ok {
+		return nil, ErrDuplicateConversion
+	}
+	t.seen[key] = expiresAt
+	return &claims, nil
+}
+
+// Evict forgets the conversions whose click left the attribution window
+func (t *ConversionTracker) Evict(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, until := range t.seen {
+		if now.After(until) {
+			delete(t.seen, key)
+		}
+	}
+}
+
+// EvictEvery runs Evict on every tick of the interval. It blocks forever.
+func (t *ConversionTracker) EvictEvery(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		t.Evict(now)
+	}
+}
+
+/*
+recordConversion attributes a conversion reported with the click_id,
+conversion_id and value parameters and sends it to the sink.
+*/
+func (s *EventServer) recordConversion(c *gin.Context) (int, error) {
+	value, err := strconv.ParseInt(c.DefaultQuery("value", c.DefaultPostForm("value", "0")), 10, 64)
+	if err != nil || value < 0 {
+		return http.StatusBadRequest, errors.New("invalid conversion value")
+	}
+	clickID := c.DefaultQuery(CLICK_ID_PARAM, c.PostForm(CLICK_ID_PARAM))
+	conversionID := c.DefaultQuery("conversion_id", c.PostForm("conversion_id"))
+
+	now := time.Now()
+	claims, err := s.conversions.Attribute(clickID, conversionID, now)
+	switch err {
+	case nil:
+	case ErrOutsideWindow:
+		return http.StatusGone, err
+	case ErrDuplicateConversion:
+		return http.StatusConflict, err
+	default:
+		return http.StatusBadRequest, err
+	}
+
+	event := Event{
+		ResponseID:   claims.ResponseID,
+		PublisherID:  claims.PublisherID,
+		AdID:         claims.AdID,
+		AdvertiserID: claims.AdvertiserID,
+		EventType:    "conversion",
+		ClickID:      claims.ClickID,
+		ConversionID: conversionID,
+		Value:        value,
+	}
+	event.IssuedAt = now.Unix()
+	s.conversionchan <- event
+	return http.StatusOK, nil
+}
+
+/*
+handleConversionPixel records a conversion from a pixel on the
+advertiser's page. The pixel is served whatever the outcome, so that
+broken images never show up on the advertiser's site.
+*/
+func (s *EventServer) handleConversionPixel(c *gin.Context) {
+	if _, err := s.recordConversion(c); err != nil {
+		log.Printf("Conversion pixel rejected: %v", err)
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "image/gif", transparentPixel)
+}
+
+// handleConversionPostback records a conversion reported server-to-server by the advertiser
+func (s *EventServer) handleConversionPostback(c *gin.Context) {
+	status, err := s.recordConversion(c)
+	if err != nil {
+		c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "Conversion processed"})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// assertRedirectsWithClickID checks that a click redirected to adURL with a click ID, and returns the click ID
+func assertRedirectsWithClickID(t *testing.T, w *httptest.ResponseRecorder, adURL string) string {
+	location, err := url.Parse(w.Header().Get("Location"))
+	assert.Nil(t, err)
+	clickID := location.Query().Get(CLICK_ID_PARAM)
+	assert.NotEmpty(t, clickID)
+	location.RawQuery = ""
+	assert.Equal(t, adURL, location.String())
+	return clickID
+}
+
+func TestAppendClickID(t *testing.T) {
+	assert.Equal(t, "http://yahoo.com?click_id=abc", appendClickID("http://yahoo.com", "abc"))
+	assert.Equal(t, "http://yahoo.com/p?click_id=abc&q=1", appendClickID("http://yahoo.com/p?q=1", "abc"))
+	assert.Equal(t, "http://yahoo.com", appendClickID("http://yahoo.com", ""))
+}
+
+func TestConversionTracker(t *testing.T) {
+	tracker := NewConversionTracker(time.Hour)
+	clickID, err := mintClickID(&Event{AdID: "5", AdvertiserID: "2", PublisherID: "7"})
+	assert.Nil(t, err)
+
+	now := time.Now()
+	claims, err := tracker.Attribute(clickID, "order-1", now)
+	assert.Nil(t, err)
+	assert.Equal(t, "5", claims.AdID)
+	assert.Equal(t, "2", claims.AdvertiserID)
+
+	_, err = tracker.Attribute(clickID, "order-1", now)
+	assert.Equal(t, ErrDuplicateConversion, err)
+	_, err = tracker.Attribute(clickID, "order-2", now)
+	assert.Nil(t, err)
+
+	_, err = tracker.Attribute(clickID, "order-3", now.Add(2*time.Hour))
+	assert.Equal(t, ErrOutsideWindow, err)
+	_, err = tracker.Attribute("not-a-click-id", "order-1", now)
+	assert.Equal(t, ErrUnknownClick, err)
+
+	// Conversions are only forgotten once their click left the window.
+	tracker.Evict(now)
+	assert.Len(t, tracker.seen, 2)
+	tracker.Evict(now.Add(2 * time.Hour))
+	assert.Len(t, tracker.seen, 0)
+}
+
+// TestConversionPostback follows a click through to its conversion
+func TestConversionPostback(t *testing.T) {
+	sink := NewFakeSink()
+	server := NewEventServer(sink, FakeCaptchaVerifier{})
+	router := server.SetupRouter()
+	go server.processEvents()
+
+	clickEvent := Event{UserID: "converting-token", AdID: "5", AdvertiserID: "2", PublisherID: "7", EventType: "click", AdURL: "http://yahoo.com"}
+	clickEvent.IssuedAt = time.Now().Add(-time.Minute).Unix()
+	signedClickLink, err := signEvent(&clickEvent)
+	assert.Nil(t, err)
+
+	req, _ := http.NewRequest("GET", "/click/"+signedClickLink, nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	clickID := assertRedirectsWithClickID(t, w, "http://yahoo.com")
+
+	postback := func(clickID, value string) int {
+		form := url.Values{CLICK_ID_PARAM: {clickID}, "conversion_id": {"order-1"}, "value": {value}}
+		req, _ := http.NewRequest("POST", "/conversion/postback?"+form.Encode(), nil)
+		req.Header.Set("User-Agent", "Java/17") // Advertiser servers are not browsers.
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusBadRequest, postback(clickID, "-1"))
+	assert.Equal(t, http.StatusBadRequest, postback("forged", "100"))
+	assert.Equal(t, http.StatusOK, postback(clickID, "2500"))
+	assert.Equal(t, http.StatusConflict, postback(clickID, "2500"))
+
+	assert.Eventually(t, func() bool { return len(sink.Events()) == 2 }, time.Second, 10*time.Millisecond)
+	var click, conversion = sink.Events()[0], sink.Events()[1]
+	if click.Type == "conversion" {
+		click, conversion = conversion, click
+	}
+	assert.Equal(t, "conversion", conversion.Type)
+	assert.Equal(t, click.ClickID, conversion.ClickID)
+	assert.Equal(t, "order-1", conversion.ConversionID)
+	assert.Equal(t, int64(2500), conversion.Value)
+	assert.Equal(t, "2", conversion.AdvertiserID)
+
+	// The pixel answers with an image even when the conversion is rejected.
+	req, _ = http.NewRequest("GET", "/conversion/pixel.gif?click_id=forged", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/gif", w.Header().Get("Content-Type"))
+}
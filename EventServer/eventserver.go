@@ -2,16 +2,22 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"eventschema"
 	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/segmentio/kafka-go"
-
 	"log"
 	"net/http"
-	"net/url"
-	"strings"
+	"strconv"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
@@ -20,33 +26,25 @@ import (
 
 // CONSTS
 var JWT_ENCRYPTION_KEY = []byte("Golangers:Pooria-Mohammad-Roya-Sina") // Encryption key used to sign responses.
-const (
-	recaptchaSecret = "6LfwfxsqAAAAAOjEjdTLn64TaPePPYRtIzTDVmDI"
-)
 const requestThreshold = 2
 const timeframe = 60 // in
 const kafkaBrokerAddress = "95.217.125.140:29092"
 const kafkaTopic = "test"
+const minViewableDuration = 1000           // MRC standard, in milliseconds of continuous view.
+const maxViewableDuration = 60 * 60 * 1000 // In-view durations are capped to an hour.
 
-var blacklistedUserAgents = []string{
-	"Python",                // Python scripts
-	"curl",                  // cURL
-	"Postman",               // Postman API client
-	"HttpClient",            // Generic HTTP client
-	"Java",                  // Java clients
-	"Go-http-client",        // Go's default HTTP client
-	"Wget",                  // Wget utility
-	"php",                   // PHP scripts
-	"Ruby",                  // Ruby scripts
-	"Node.js",               // Node.js scripts
-	"BinGet",                // BinGet utility
-	"libwww-perl",           // Perl library
-	"Microsoft URL Control", // Microsoft URL Control tool
-	"Peach",                 // Peach fuzzing tool
-	"pxyscand",              // Proxy scanner
-	"PycURL",                // Python binding to libcurl
-	"Python-urllib",         // Python urllib library
-}
+/* What to do with clicks whose impression was never seen, set by ORPHAN_CLICK_POLICY. */
+const (
+	ORPHAN_POLICY_FLAG   = "flag"   // Record the click, flagged and not billed.
+	ORPHAN_POLICY_REJECT = "reject" // Do not record the click at all.
+)
+
+/*
+Salt of the client IP and viewer hashes, required at startup: unsalted,
+the hash of an IPv4 address is reversed by trying all 2^32 of them. It
+must be the same on every instance, and kept secret.
+*/
+var ipHashSalt = getEnv("EVENT_IP_HASH_SALT", "")
 
 //MODELS
 
@@ -55,16 +53,29 @@ type RequestData struct {
 	LastRequestAt time.Time
 }
 
-var requestLog = make(map[string]RequestData)
-
 // Event represents an event with user, publisher, ad IDs and URL
 type Event struct {
-	UserID      string
-	PublisherID string
-	AdID        string
-	AdURL       string
-	EventType   string
-	Time        int64
+	UserID       string
+	ResponseID   string
+	PublisherID  string
+	AdID         string
+	AdvertiserID string
+	AdURL        string
+	EventType    string
+	Price        int64
+	ViewerID     string // Set by AdServer only when the viewer consented.
+	Consent      bool
+	Time         int64
+	ClientIP     string   `json:"-"` // Filled in by the handlers, never part of the token.
+	UserAgent    string   `json:"-"`
+	FraudScore   int      `json:"-"` // Filled in from the fraud assessment of the event.
+	FraudReasons []string `json:"-"`
+	NotBillable  bool     `json:"-"`
+	OrphanClick  bool     `json:"-"`
+	InViewMs     int64    `json:"-"` // Viewable events only, reported by the browser.
+	ClickID      string   `json:"-"` // Clicks and conversions only.
+	ConversionID string   `json:"-"` // Conversions only, reported by the advertiser.
+	Value        int64    `json:"-"`
 	jwt.StandardClaims
 }
 
@@ -72,39 +83,66 @@ type Event struct {
 type Value struct {
 	PublisherID string
 	AdID        string
+	ClickID     string // Clicks only.
+	ViewerID    string // For data-deletion requests.
+	InViewMs    int64  // Viewables only: the time in view reported so far.
 }
 
 // EventServer holds the channels for buffering events and maps for deduplication
 type EventServer struct {
 	impressions    map[string]Value
 	clicks         map[string]Value
+	viewables      map[string]Value
 	clickchan      chan Event
 	impressionchan chan Event
-	kafkaWriter    *kafka.Writer // Kafka writer
+	viewablechan   chan Event
+	conversionchan chan Event
+	sink           EventSink // Destination of processed events
+	fraud          *FraudEngine
+	captcha        CaptchaVerifier
+	orphanPolicy   string
+	conversions    *ConversionTracker
+	dedupMu        sync.Mutex // Guards impressions, clicks and viewables.
+	access         *AccessList
+	maxQueueDepth  int
+	draining       atomic.Bool   // Set once shutdown has begun.
+	stop           chan struct{} // Closed to make processEvents drain and return.
+	done           chan struct{} // Closed when processEvents has returned.
 }
 
 // NewEventServer creates a new EventServer with initialized maps and channel
-func NewEventServer() *EventServer {
-	writer := kafka.NewWriter(kafka.WriterConfig{
-		Brokers:  []string{kafkaBrokerAddress},
-		Topic:    kafkaTopic,
-		Balancer: &kafka.LeastBytes{},
-	})
-
+func NewEventServer(sink EventSink, captcha CaptchaVerifier) *EventServer {
 	return &EventServer{
 		impressions:    make(map[string]Value),
 		clicks:         make(map[string]Value),
+		viewables:      make(map[string]Value),
 		clickchan:      make(chan Event, 100), // Buffer size of 100
 		impressionchan: make(chan Event, 100), // Buffer size of 100
-		kafkaWriter:    writer,
+		viewablechan:   make(chan Event, 100), // Buffer size of 100
+		conversionchan: make(chan Event, 100), // Buffer size of 100
+		sink:           sink,
+		fraud:          NewFraudEngineFromConfig(),
+		captcha:        captcha,
+		orphanPolicy:   getEnv("ORPHAN_CLICK_POLICY", ORPHAN_POLICY_FLAG),
+		conversions:    NewConversionTracker(getEnvDuration("CONVERSION_ATTRIBUTION_WINDOW", defaultAttributionWindow)),
+		access:         NewAccessListFromConfig(),
+		maxQueueDepth:  getEnvInt("READY_MAX_QUEUE_DEPTH", defaultMaxQueueDepth),
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
 	}
 }
 
-type RecaptchaResponse struct {
-	Success     bool     `json:"success"`
-	ChallengeTs string   `json:"challenge_ts"`
-	Hostname    string   `json:"hostname"`
-	ErrorCodes  []string `json:"error-codes"`
+/*
+Flags a click whose impression was never seen, which is never billed.
+Returns false if the click should not be recorded at all.
+*/
+func (s *EventServer) checkOrphanClick(event *Event, signals FraudSignals) bool {
+	if signals.ImpressionSeen {
+		return true
+	}
+	event.OrphanClick = true
+	event.NotBillable = true
+	return s.orphanPolicy != ORPHAN_POLICY_REJECT
 }
 
 //CONTROLLERS
@@ -124,10 +162,10 @@ func CORSMiddleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
-func UserAgentBlacklist() gin.HandlerFunc {
+func UserAgentBlacklist(access *AccessList) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userAgent := c.GetHeader("User-Agent")
-		if isBlacklisted(userAgent) {
+		if access.DeniedUserAgent(userAgent, requestPublisherID(c)) != "" {
 			c.JSON(http.StatusForbidden, gin.H{"message": "Blocked: Disallowed User-Agent"})
 			c.Abort()
 		} else {
@@ -136,13 +174,30 @@ func UserAgentBlacklist() gin.HandlerFunc {
 	}
 }
 
-func isBlacklisted(userAgent string) bool {
-	for _, ua := range blacklistedUserAgents {
-		if strings.Contains(userAgent, ua) {
-			return true
-		}
+/*
+requestPublisherID returns the publisher of the event token carried by
+the request, for publisher exceptions to the access rules. Requests
+without a valid token have no publisher.
+*/
+func requestPublisherID(c *gin.Context) string {
+	eventInfoToken := c.Param("info")
+	if eventInfoToken == "" {
+		eventInfoToken = c.Query("info")
 	}
-	return false
+	if eventInfoToken == "" && c.Request.Method == http.MethodPost {
+		eventInfoToken = c.PostForm("info")
+	}
+	if eventInfoToken == "" {
+		return ""
+	}
+	var event Event
+	parsedToken, err := jwt.ParseWithClaims(eventInfoToken, &event, func(t *jwt.Token) (interface{}, error) {
+		return JWT_ENCRYPTION_KEY, nil
+	})
+	if err != nil || !parsedToken.Valid {
+		return ""
+	}
+	return event.PublisherID
 }
 
 // handleImpression handles the impression events
@@ -154,14 +209,25 @@ func (s *EventServer) handleImpression(c *gin.Context) {
 	})
 	if err != nil || !parsedToken.Valid {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid impression token"})
+		return
 	}
 
-	if _, ok := s.impressions[event.UserID]; !ok {
-		value := Value{
+	s.fraud.RecordImpression(c.ClientIP(), &event)
+	s.fraud.Assess(s.fraud.Signals(c, &event, false, true)).apply(&event)
+
+	s.dedupMu.Lock()
+	_, seen := s.impressions[event.UserID]
+	if !seen {
+		s.impressions[event.UserID] = Value{
 			AdID:        event.AdID,
 			PublisherID: event.PublisherID,
+			ViewerID:    event.ViewerID,
 		}
-		s.impressions[event.UserID] = value
+	}
+	s.dedupMu.Unlock()
+	if !seen {
+		event.ClientIP = c.ClientIP()
+		event.UserAgent = c.GetHeader("User-Agent")
 		s.impressionchan <- event
 
 		// if err := s.callAPI(event); err != nil {
@@ -172,39 +238,93 @@ func (s *EventServer) handleImpression(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"status": "Impression processed"})
 }
 
-func (s *EventServer) captchaPage(c *gin.Context) {
-	eventInfoToken := c.Query("info")
-	c.HTML(http.StatusOK, "captcha.html", gin.H{
-		"eventInfoToken": eventInfoToken,
+/*
+handleViewable handles viewable events. The browser reports them as soon
+as the ad has been at least half in view for a continuous second, with
+the in-view duration so far in milliseconds as the duration query
+parameter. Once the viewable is recorded, the browser reports the time in
+view after it with extra=1, which becomes a view_time event. The time in
+view of an impression, viewable and extra reports together, is capped to
+maxViewableDuration: reports past the cap are clipped, then dropped.
+Reports may arrive as a GET or as a POST sent by navigator.sendBeacon.
+*/
+func (s *EventServer) handleViewable(c *gin.Context) {
+	eventInfoToken := c.Param("info")
+	var event Event
+	parsedToken, err := jwt.ParseWithClaims(eventInfoToken, &event, func(t *jwt.Token) (interface{}, error) {
+		return JWT_ENCRYPTION_KEY, nil
 	})
-}
-func validateCaptcha(c *gin.Context) bool {
-	recaptchaResponse := c.PostForm("g-recaptcha-response")
-	if recaptchaResponse == "" {
-		return false
+	if err != nil || !parsedToken.Valid || event.EventType != "viewable" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid viewable token"})
+		return
 	}
 
-	resp, err := http.PostForm("https://www.google.com/recaptcha/api/siteverify",
-		url.Values{"secret": {recaptchaSecret}, "response": {recaptchaResponse}})
-	if err != nil {
-		log.Printf("Failed to verify reCAPTCHA: %v", err)
-		return false
+	extra := c.Query("extra") == "1"
+	duration, err := strconv.ParseInt(c.Query("duration"), 10, 64)
+	if err != nil || duration <= 0 || (!extra && duration < minViewableDuration) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ad was not viewable"})
+		return
 	}
-	defer resp.Body.Close()
+	if duration > maxViewableDuration {
+		duration = maxViewableDuration
+	}
+	event.InViewMs = duration
+
+	s.fraud.Assess(s.fraud.Signals(c, &event, false, true)).apply(&event)
 
-	var result RecaptchaResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		log.Printf("Failed to parse reCAPTCHA response: %v", err)
-		return false
+	s.dedupMu.Lock()
+	viewable, seen := s.viewables[event.UserID]
+	if extra {
+		if !seen {
+			s.dedupMu.Unlock()
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ad was not reported viewable"})
+			return
+		}
+		// Replayed or forged reports cannot add more than the cap.
+		event.InViewMs = min(duration, maxViewableDuration-viewable.InViewMs)
+		viewable.InViewMs += event.InViewMs
+		s.viewables[event.UserID] = viewable
+		s.dedupMu.Unlock()
+		if event.InViewMs <= 0 {
+			c.JSON(http.StatusOK, gin.H{"status": "View time already counted"})
+			return
+		}
+		event.EventType = eventschema.TYPE_VIEW_TIME
+		event.ClientIP = c.ClientIP()
+		event.UserAgent = c.GetHeader("User-Agent")
+		s.viewablechan <- event
+		c.JSON(http.StatusOK, gin.H{"status": "View time processed"})
+		return
+	}
+	if !seen {
+		s.viewables[event.UserID] = Value{
+			AdID:        event.AdID,
+			PublisherID: event.PublisherID,
+			ViewerID:    event.ViewerID,
+			InViewMs:    duration,
+		}
+	}
+	s.dedupMu.Unlock()
+	if !seen {
+		event.ClientIP = c.ClientIP()
+		event.UserAgent = c.GetHeader("User-Agent")
+		s.viewablechan <- event
 	}
 
-	return result.Success
+	c.JSON(http.StatusOK, gin.H{"status": "Viewable processed"})
 }
 
+func (s *EventServer) captchaPage(c *gin.Context) {
+	eventInfoToken := c.Query("info")
+	c.HTML(http.StatusOK, "captcha.html", gin.H{
+		"eventInfoToken": eventInfoToken,
+		"captcha":        s.captcha.Widget(),
+	})
+}
 func (s *EventServer) verifyCaptcha(c *gin.Context) {
 	eventInfoToken := c.PostForm("info")
 
-	if !validateCaptcha(c) {
+	if !s.captcha.Verify(c) {
 		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "CAPTCHA validation failed"})
 		return
 	}
@@ -217,20 +337,25 @@ func (s *EventServer) verifyCaptcha(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid click token"})
 		return
 	}
-	if _, ok := s.clicks[event.UserID]; !ok {
-		value := Value{
-			AdID:        event.AdID,
-			PublisherID: event.PublisherID,
-		}
-		s.clicks[event.UserID] = value
-		s.clickchan <- event
+	if err := checkRedirectURL(event.AdURL); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-		// if err := s.callAPI(event); err != nil {
-		// 	log.Printf("Failed to call API for impression event: %v\n", err)
-		// }
+	// The captcha was solved, so the click is no longer challenged; it may still go unbilled.
+	signals := s.fraud.Signals(c, &event, true, false)
+	assessment := s.fraud.Assess(signals)
+	if assessment.Decision == DECISION_CHALLENGE {
+		assessment.Decision = DECISION_ACCEPT
+	}
+	assessment.apply(&event)
+	if !s.checkOrphanClick(&event, signals) {
+		c.Redirect(http.StatusSeeOther, expandRedirectURL(&event, ""))
+		return
 	}
-	c.Redirect(http.StatusSeeOther, event.AdURL)
 
+	clickID := s.recordClick(c, event)
+	c.Redirect(http.StatusSeeOther, expandRedirectURL(&event, clickID))
 }
 
 // handleClick handles the click events
@@ -243,63 +368,64 @@ func (s *EventServer) handleClick(c *gin.Context) {
 	})
 	if err != nil || !parsedToken.Valid {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid click token"})
+		return
 	}
-
-	if claims, ok := parsedToken.Claims.(*Event); ok {
-		issuedAt := claims.IssuedAt
-		currentTime := time.Now().Unix()
-		secondsElapsed := currentTime - issuedAt
-
-		const tokenValidityThreshold = 4
-		if secondsElapsed < tokenValidityThreshold {
-			c.Redirect(http.StatusSeeOther, event.AdURL)
-			return
-		}
-	} else {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid claims"})
+	if err := checkRedirectURL(event.AdURL); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	clientIP := c.ClientIP()
-	userAgent := c.GetHeader("User-Agent")
-	key := clientIP + "_" + userAgent + "_" + event.PublisherID
-
-	currentTime := time.Now()
-	requestData, exists := requestLog[key]
-	if exists {
-		if currentTime.Sub(requestData.LastRequestAt).Seconds() <= timeframe {
-			requestData.Count++
-		} else {
-			requestData.Count = 1
-		}
-		requestData.LastRequestAt = currentTime
-	} else {
-		requestData = RequestData{
-			Count:         1,
-			LastRequestAt: currentTime,
-		}
+	if s.access.DeniedIP(c.ClientIP(), event.PublisherID) != "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "Blocked: Disallowed IP"})
+		return
 	}
-	requestLog[key] = requestData
-	if requestData.Count > requestThreshold {
+
+	signals := s.fraud.Signals(c, &event, true, true)
+	assessment := s.fraud.Assess(signals)
+	if assessment.Decision == DECISION_CHALLENGE {
 		c.Redirect(http.StatusSeeOther, "/captcha?info="+eventInfoToken)
 		return
 	}
+	assessment.apply(&event)
+	if !s.checkOrphanClick(&event, signals) {
+		c.Redirect(http.StatusSeeOther, expandRedirectURL(&event, ""))
+		return
+	}
 
-	if _, ok := s.clicks[event.UserID]; !ok {
-		value := Value{
-			AdID:        event.AdID,
-			PublisherID: event.PublisherID,
-		}
-		s.clicks[event.UserID] = value
-		s.clickchan <- event
+	clickID := s.recordClick(c, event)
 
-		// if err := s.callAPI(event); err != nil {
-		// 	log.Printf("Failed to call API for impression event: %v\n", err)
-		// }
+	// Redirect to the ad URL
+	c.Redirect(http.StatusSeeOther, expandRedirectURL(&event, clickID))
+}
+
+/*
+recordClick sends a click to the sink, unless it was already recorded,
+and returns the click ID minted for it. Advertisers report conversions
+with this click ID.
+*/
+func (s *EventServer) recordClick(c *gin.Context, event Event) string {
+	s.dedupMu.Lock()
+	if value, ok := s.clicks[event.UserID]; ok {
+		s.dedupMu.Unlock()
+		return value.ClickID
 	}
 
-	// Redirect to the ad URL
-	c.Redirect(http.StatusSeeOther, event.AdURL)
+	clickID, err := mintClickID(&event)
+	if err != nil {
+		log.Printf("could not mint click ID: %v", err)
+	}
+	s.clicks[event.UserID] = Value{
+		AdID:        event.AdID,
+		PublisherID: event.PublisherID,
+		ClickID:     clickID,
+		ViewerID:    event.ViewerID,
+	}
+	s.dedupMu.Unlock()
+
+	event.ClientIP = c.ClientIP()
+	event.UserAgent = c.GetHeader("User-Agent")
+	s.clickchan <- event
+	return clickID
 }
 
 // // callInternalAPI simulates calling an internal API to handle the click
@@ -330,38 +456,82 @@ func (s *EventServer) handleClick(c *gin.Context) {
 // 	return nil
 // }
 
-// processEvents processes events and sends them to Kafka
+// processEvents processes events and sends them to the sink, until Drain is called
 func (s *EventServer) processEvents() {
+	defer close(s.done)
 	for {
 		select {
+		case <-s.stop:
+			s.drainQueues()
+			return
 		case event := <-s.impressionchan:
-			s.sendToKafka(event, "impression")
+			s.sendToSink(event, "impression")
 		case event := <-s.clickchan:
-			s.sendToKafka(event, "click")
+			s.sendToSink(event, "click")
+		case event := <-s.viewablechan:
+			s.sendToSink(event, event.EventType) // Viewable or view time.
+		case event := <-s.conversionchan:
+			s.sendToSink(event, "conversion")
 		}
 	}
 }
 
-// sendToKafka sends an event to Kafka
-func (s *EventServer) sendToKafka(event Event, eventType string) {
+// sendToSink sends an event to the configured sink
+func (s *EventServer) sendToSink(event Event, eventType string) {
 	event.Time = event.StandardClaims.IssuedAt
-	eventData, err := json.Marshal(event)
+
+	err := s.sink.Send(context.Background(), toSchemaEvent(event, eventType))
 	if err != nil {
-		log.Printf("could not marshal event: %v", err)
-		return
+		log.Printf("could not send %s event to sink: %v", eventType, err)
+	} else {
+		log.Printf("Sent %s event to sink: %s", eventType, event.AdID)
 	}
+}
 
-	msg := kafka.Message{
-		Key:   []byte(event.AdID),
-		Value: eventData,
+// toSchemaEvent converts an accepted event to the shared wire schema
+func toSchemaEvent(event Event, eventType string) eventschema.Event {
+	schemaEvent := eventschema.Event{
+		EventID:      newEventID(),
+		Type:         eventType,
+		AdID:         event.AdID,
+		AdvertiserID: event.AdvertiserID,
+		PublisherID:  event.PublisherID,
+		Price:        event.Price,
+		Timestamp:    event.Time,
+		ClientIPHash: anonymizeIP(event.ClientIP),
+		UserAgent:    event.UserAgent,
+		FraudScore:   uint32(event.FraudScore),
+		NotBillable:  event.NotBillable,
+		FraudReasons: event.FraudReasons,
+		ResponseID:   event.ResponseID,
+		OrphanClick:  event.OrphanClick,
+		InViewMs:     event.InViewMs,
+		ClickID:      event.ClickID,
+		ConversionID: event.ConversionID,
+		Value:        event.Value,
+		Consent:      event.Consent,
+		ViewerHash:   hashViewerID(event.ViewerID),
 	}
+	applyConsent(&schemaEvent)
+	return schemaEvent
+}
 
-	err = s.kafkaWriter.WriteMessages(context.Background(), msg)
-	if err != nil {
-		log.Printf("could not send event to Kafka: %v", err)
-	} else {
-		log.Printf("Sent %s event to Kafka: %s", eventType, event.AdID)
+// newEventID returns a random 128-bit hex encoded identifier
+func newEventID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Printf("could not generate event ID: %v", err)
 	}
+	return hex.EncodeToString(id)
+}
+
+// hashClientIP returns the salted SHA-256 of an IP, so raw IPs never leave the server
+func hashClientIP(ip string) string {
+	if ip == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(ipHashSalt + ip))
+	return hex.EncodeToString(sum[:])
 }
 
 // SetupRouter sets up the routes for the EventServer
@@ -370,28 +540,84 @@ func (s *EventServer) SetupRouter() *gin.Engine {
 	router := gin.Default()
 	p := ginprometheus.NewPrometheus("eventserver")
 	p.Use(router)
-	router.Use(UserAgentBlacklist())
 	router.Use(CORSMiddleware())
 
 	router.LoadHTMLFiles("captcha.html")
 
-	router.GET("/captcha", s.captchaPage)
-	router.POST("/verify-captcha", s.verifyCaptcha)
-	router.GET("/impression/:info", s.handleImpression)
-	router.GET("/click/:info", s.handleClick)
+	// Probed by the load balancer and the orchestrator, whatever their User-Agent.
+	router.GET("/healthz", s.handleHealthz)
+	router.GET("/readyz", s.handleReadyz)
+
+	// Routes reached by browsers, where non-browser User-Agents are refused.
+	tracking := router.Group("", UserAgentBlacklist(s.access))
+	tracking.GET("/captcha", s.captchaPage)
+	tracking.POST("/verify-captcha", s.verifyCaptcha)
+	tracking.GET("/impression/:info", s.handleImpression)
+	tracking.GET("/click/:info", s.handleClick)
+	tracking.GET("/viewable/:info", s.handleViewable)
+	tracking.POST("/viewable/:info", s.handleViewable)
+	tracking.GET("/conversion/pixel.gif", s.handleConversionPixel)
+
+	// Postbacks come from the servers of advertisers, with the User-Agent of their HTTP client.
+	router.POST("/conversion/postback", s.handleConversionPostback)
+	router.GET("/conversion/postback", s.handleConversionPostback)
+
+	// Operators call the admin API with curl and scripts; the token guards it.
+	admin := router.Group("/admin", AdminAuth(getEnv("ADMIN_TOKEN", "")))
+	s.access.SetupAdminRoutes(admin)
+	admin.DELETE("/viewers/:viewer_id", s.handleForgetViewer)
 
 	return router
 }
 
 func main() {
-	server := NewEventServer()
+	sink, err := NewSinkFromConfig()
+	if err != nil {
+		log.Fatalf("Failed to set up event sink: %v", err)
+	}
+
+	captcha, err := NewCaptchaVerifierFromConfig()
+	if err != nil {
+		log.Fatalf("Failed to set up captcha: %v", err)
+	}
+
+	if ipHashSalt == "" {
+		log.Fatalf("EVENT_IP_HASH_SALT is required to anonymize client IPs")
+	}
+
+	server := NewEventServer(sink, captcha)
 	router := server.SetupRouter()
 
 	// Start processing events
 	go server.processEvents()
-
-	err := router.Run(":8081")
-	if err != nil {
-		fmt.Printf("Failed to start server: %v\n", err)
+	go server.access.Watch(getEnvDuration("ACCESS_RULES_RELOAD_INTERVAL", defaultAccessRulesReload))
+	go server.conversions.EvictEvery(conversionEvictInterval)
+	go server.fraud.EvictEvery(fraudEvictInterval)
+
+	httpServer := &http.Server{Addr: ":8081", Handler: router}
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("Failed to start server: %v\n", err)
+			os.Exit(1)
+		}
+	}()
+
+	// On SIGTERM, stop accepting requests, then send every queued event before exiting.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	<-signals
+	log.Printf("Shutting down")
+	server.draining.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), getEnvDuration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout))
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Printf("could not stop HTTP server: %v", err)
+	}
+	if err := server.Drain(ctx); err != nil {
+		log.Printf("could not drain events: %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		log.Printf("could not flush event sink: %v", err)
 	}
 }
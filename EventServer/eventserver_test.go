@@ -3,7 +3,9 @@ package main
 import (
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -11,7 +13,7 @@ import (
 )
 
 func setupRouter() *gin.Engine {
-	server := NewEventServer()
+	server := NewEventServer(NewFakeSink(), FakeCaptchaVerifier{})
 	return server.SetupRouter()
 }
 
@@ -70,7 +72,7 @@ func TestHandleClick(t *testing.T) {
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, http.StatusSeeOther, w.Code)
-	assert.Equal(t, "http://yahoo.com", w.Header().Get("Location"))
+	assertRedirectsWithClickID(t, w, "http://yahoo.com")
 }
 
 
@@ -87,4 +89,171 @@ func TestHandleClick(t *testing.T) {
 		return "", err
 	}
 	return signedTokenString, nil
-}
\ No newline at end of file
+}
+// TestEventsReachSink checks that accepted events are delivered to the sink in the shared schema
+func TestEventsReachSink(t *testing.T) {
+	sink := NewFakeSink()
+	server := NewEventServer(sink, FakeCaptchaVerifier{})
+	router := server.SetupRouter()
+	go server.processEvents()
+
+	var impressionEvent = Event{
+		UserID:       "yet-another-random-token",
+		AdID:         "5",
+		AdvertiserID: "2",
+		AdURL:        "http://yahoo.com",
+		PublisherID:  "4",
+		EventType:    "impression",
+		Price:        12,
+		Consent:      true,
+	}
+	impressionEvent.IssuedAt = time.Now().Unix()
+	signedImpressionLink, err := signEvent(&impressionEvent)
+	assert.Nil(t, err)
+	req, _ := http.NewRequest("GET", "/impression/"+signedImpressionLink, nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	req.RemoteAddr = "10.0.0.1:1234"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Eventually(t, func() bool { return len(sink.Events()) == 1 }, time.Second, 10*time.Millisecond)
+	event := sink.Events()[0]
+	assert.NotEmpty(t, event.EventID)
+	assert.Equal(t, "impression", event.Type)
+	assert.Equal(t, "2", event.AdvertiserID)
+	assert.Equal(t, int64(12), event.Price)
+	assert.Equal(t, impressionEvent.IssuedAt, event.Timestamp)
+	assert.Equal(t, "Mozilla/5.0", event.UserAgent)
+	assert.NotEmpty(t, event.ClientIPHash)
+}
+
+// TestOrphanClicks checks that clicks are correlated with the impression of the same response
+func TestOrphanClicks(t *testing.T) {
+	sink := NewFakeSink()
+	server := NewEventServer(sink, FakeCaptchaVerifier{})
+	router := server.SetupRouter()
+	go server.processEvents()
+
+	send := func(event Event) *httptest.ResponseRecorder {
+		event.IssuedAt = time.Now().Add(-time.Minute).Unix()
+		signedLink, err := signEvent(&event)
+		assert.Nil(t, err)
+		req, _ := http.NewRequest("GET", "/"+event.EventType+"/"+signedLink, nil)
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	impression := Event{UserID: "impression-token", ResponseID: "response-1", AdID: "5", PublisherID: "4", EventType: "impression"}
+	click := Event{UserID: "click-token", ResponseID: "response-1", AdID: "5", PublisherID: "4", EventType: "click", AdURL: "http://yahoo.com"}
+	orphan := Event{UserID: "orphan-token", ResponseID: "response-2", AdID: "5", PublisherID: "4", EventType: "click", AdURL: "http://yahoo.com"}
+
+	assert.Equal(t, http.StatusOK, send(impression).Code)
+	assert.Equal(t, http.StatusSeeOther, send(click).Code)
+	assert.Equal(t, http.StatusSeeOther, send(orphan).Code)
+
+	assert.Eventually(t, func() bool { return len(sink.Events()) == 3 }, time.Second, 10*time.Millisecond)
+	for _, event := range sink.Events() {
+		switch event.ResponseID {
+		case "response-1":
+			assert.False(t, event.OrphanClick)
+		case "response-2":
+			assert.True(t, event.OrphanClick)
+			assert.True(t, event.NotBillable)
+		}
+	}
+
+	// With the reject policy, orphan clicks still redirect but are not recorded.
+	server.orphanPolicy = ORPHAN_POLICY_REJECT
+	rejected := Event{UserID: "rejected-token", ResponseID: "response-3", AdID: "5", PublisherID: "4", EventType: "click", AdURL: "http://yahoo.com"}
+	w := send(rejected)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "http://yahoo.com", w.Header().Get("Location"))
+	assert.Never(t, func() bool { return len(sink.Events()) > 3 }, 100*time.Millisecond, 10*time.Millisecond)
+}
+
+// TestHandleViewable tests the handleViewable handler
+func TestHandleViewable(t *testing.T) {
+	sink := NewFakeSink()
+	server := NewEventServer(sink, FakeCaptchaVerifier{})
+	router := server.SetupRouter()
+	go server.processEvents()
+
+	var viewableEvent = Event{
+		UserID:      "a-viewable-token",
+		ResponseID:  "viewable-response",
+		AdID:        "5",
+		PublisherID: "4",
+		EventType:   "viewable",
+	}
+	signedViewableLink, err := signEvent(&viewableEvent)
+	assert.Nil(t, err)
+
+	// An impression token is not a viewable token.
+	var impressionEvent = viewableEvent
+	impressionEvent.EventType = "impression"
+	signedImpressionLink, err := signEvent(&impressionEvent)
+	assert.Nil(t, err)
+	req, _ := http.NewRequest("GET", "/viewable/"+signedImpressionLink+"?duration=1500", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Less than a second in view is not viewable.
+	req, _ = http.NewRequest("GET", "/viewable/"+signedViewableLink+"?duration=400", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Beacons are deduplicated.
+	for i := 0; i < 2; i++ {
+		req, _ = http.NewRequest("POST", "/viewable/"+signedViewableLink+"?duration=2500", nil)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	assert.Eventually(t, func() bool { return len(sink.Events()) == 1 }, time.Second, 10*time.Millisecond)
+	event := sink.Events()[0]
+	assert.Equal(t, "viewable", event.Type)
+	assert.Equal(t, int64(2500), event.InViewMs)
+	assert.Equal(t, "viewable-response", event.ResponseID)
+
+	// The time in view after the viewable is reported separately, and only for a viewable ad.
+	otherViewable := viewableEvent
+	otherViewable.UserID = "another-viewable-token"
+	signedOtherLink, err := signEvent(&otherViewable)
+	assert.Nil(t, err)
+	tests := []struct {
+		link string
+		code int
+	}{
+		{signedOtherLink + "?duration=400&extra=1", http.StatusBadRequest},
+		{signedViewableLink + "?duration=0&extra=1", http.StatusBadRequest},
+		{signedViewableLink + "?duration=400&extra=1", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, _ = http.NewRequest("POST", "/viewable/"+tt.link, nil)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, tt.code, w.Code, tt.link)
+	}
+	assert.Eventually(t, func() bool { return len(sink.Events()) == 2 }, time.Second, 10*time.Millisecond)
+	event = sink.Events()[1]
+	assert.Equal(t, "view_time", event.Type)
+	assert.Equal(t, int64(400), event.InViewMs)
+
+	// Extra reports are clipped to the cap on the time in view of the impression, then dropped.
+	for i := 0; i < 2; i++ {
+		req, _ = http.NewRequest("POST", "/viewable/"+signedViewableLink+"?extra=1&duration="+strconv.Itoa(maxViewableDuration), nil)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	assert.Eventually(t, func() bool { return len(sink.Events()) == 3 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(maxViewableDuration-2500-400), sink.Events()[2].InViewMs)
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, sink.Events(), 3)
+}
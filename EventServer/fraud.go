@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* Outcomes of the fraud assessment of an event. */
+const (
+	DECISION_ACCEPT    = "accept"    // Record and bill the event.
+	DECISION_CHALLENGE = "challenge" // Ask the client to solve a captcha first.
+	DECISION_NO_BILL   = "no_bill"   // Record the event, but do not bill it.
+)
+
+/* Default configuration of the fraud engine, overridable through the environment. */
+const defaultChallengeThreshold = 50
+const defaultNoBillThreshold = 80
+const defaultMinTimeToClick = 4 * time.Second
+const defaultDatacenterRangesFile = "datacenter_ranges.txt"
+
+const maxFraudScore = 100
+const ipVelocityThreshold = 10 // Clicks from one IP, regardless of user agent, per timeframe.
+const impressionMemory = time.Hour
+const fraudEvictInterval = time.Minute // How often expired request counts and impressions are forgotten.
+
+/* Weights of the fraud rules. The score of an event is the sum of the weights of the rules it triggers. */
+const (
+	weightFastClick       = 80
+	weightNoImpression    = 20
+	weightVisitorVelocity = 50
+	weightIPVelocity      = 30
+	weightDatacenterIP    = 40
+	weightHeadlessAgent   = 50
+	weightNoLanguage      = 15
+)
+
+/* Substrings of user agents announcing an automated browser. */
+var headlessUserAgentHints = []string{
+	"HeadlessChrome",
+	"PhantomJS",
+	"Puppeteer",
+	"Playwright",
+	"Selenium",
+	"webdriver",
+}
+
+// FraudSignals are the observations about a single event that the fraud rules look at
+type FraudSignals struct {
+	IsClick         bool
+	ImpressionSeen  bool
+	TimeToClick     time.Duration // Since the impression, or since the ad was served if there was none.
+	VisitorVelocity int           // Clicks of this IP and user agent on this publisher within the timeframe.
+	IPVelocity      int           // Clicks of this IP within the timeframe.
+	DatacenterIP    bool
+	HeadlessHints   []string
+	NoLanguage      bool
+}
+
+// FraudRule adds its weight to the score of every event it applies to
+type FraudRule struct {
+	Name    string
+	Weight  int
+	Applies func(signals FraudSignals, config FraudConfig) bool
+}
+
+var fraudRules = []FraudRule{
+	{"fast_click", weightFastClick, func(s FraudSignals, c FraudConfig) bool {
+		return s.IsClick && s.TimeToClick < c.MinTimeToClick
+	}},
+	{"no_impression", weightNoImpression, func(s FraudSignals, c FraudConfig) bool {
+		return s.IsClick && !s.ImpressionSeen
+	}},
+	{"visitor_velocity", weightVisitorVelocity, func(s FraudSignals, c FraudConfig) bool {
+		return s.VisitorVelocity > requestThreshold
+	}},
+	{"ip_velocity", weightIPVelocity, func(s FraudSignals, c FraudConfig) bool {
+		return s.IPVelocity > ipVelocityThreshold
+	}},
+	{"datacenter_ip", weightDatacenterIP, func(s FraudSignals, c FraudConfig) bool {
+		return s.DatacenterIP
+	}},
+	{"headless_agent", weightHeadlessAgent, func(s FraudSignals, c FraudConfig) bool {
+		return len(s.HeadlessHints) > 0
+	}},
+	{"no_language", weightNoLanguage, func(s FraudSignals, c FraudConfig) bool {
+		return s.NoLanguage
+	}},
+}
+
+// FraudConfig holds the tunable parameters of the fraud engine
+type FraudConfig struct {
+	ChallengeThreshold int
+	NoBillThreshold    int
+	MinTimeToClick     time.Duration
+}
+
+// FraudAssessment is the verdict of the fraud engine on an event
+type FraudAssessment struct {
+	Score    int
+	Reasons  []string
+	Decision string
+}
+
+// FraudEngine gathers fraud signals about events and scores them
+type FraudEngine struct {
+	config          FraudConfig
+	datacenterNets  []*net.IPNet
+	mu              sync.Mutex
+	requestLog      map[string]RequestData
+	impressionTimes map[string]time.Time
+}
+
+func NewFraudEngine(config FraudConfig, datacenterNets []*net.IPNet) *FraudEngine {
+	return &FraudEngine{
+		config:          config,
+		datacenterNets:  datacenterNets,
+		requestLog:      make(map[string]RequestData),
+		impressionTimes: make(map[string]time.Time),
+	}
+}
+
+/*
+Builds a fraud engine from the environment. FRAUD_CHALLENGE_THRESHOLD
+and FRAUD_NO_BILL_THRESHOLD are scores out of 100, FRAUD_MIN_TIME_TO_CLICK
+is a Go duration and FRAUD_DATACENTER_RANGES_FILE points at a file of
+CIDR ranges, one per line.
+*/
+func NewFraudEngineFromConfig() *FraudEngine {
+	config := FraudConfig{
+		ChallengeThreshold: getEnvInt("FRAUD_CHALLENGE_THRESHOLD", defaultChallengeThreshold),
+		NoBillThreshold:    getEnvInt("FRAUD_NO_BILL_THRESHOLD", defaultNoBillThreshold),
+		MinTimeToClick:     getEnvDuration("FRAUD_MIN_TIME_TO_CLICK", defaultMinTimeToClick),
+	}
+
+	rangesFile := getEnv("FRAUD_DATACENTER_RANGES_FILE", defaultDatacenterRangesFile)
+	datacenterNets, err := loadCIDRFile(rangesFile)
+	if err != nil {
+		log.Printf("could not load datacenter ranges from %s: %v", rangesFile, err)
+	}
+	return NewFraudEngine(config, datacenterNets)
+}
+
+// getEnvInt is getEnv for integer values
+func getEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(getEnv(key, strconv.Itoa(fallback)))
+	if err != nil {
+		log.Printf("invalid %s, using %d", key, fallback)
+		return fallback
+	}
+	return value
+}
+
+// getEnvDuration is getEnv for Go durations such as "4s" or "168h"
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	duration, err := time.ParseDuration(getEnv(key, fallback.String()))
+	if err != nil {
+		log.Printf("invalid %s, using %v", key, fallback)
+		return fallback
+	}
+	return duration
+}
+
+// loadCIDRFile reads CIDR ranges, one per line. Blank lines and lines starting with # are skipped.
+func loadCIDRFile(path string) ([]*net.IPNet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var nets []*net.IPNet
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(line)
+		if err != nil {
+			log.Printf("skipping invalid range %q in %s", line, path)
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, scanner.Err()
+}
+
+/*
+impressionKey correlates an impression with the clicks following it.
+Both links of an ad response carry the same response ID; tokens issued
+before response IDs existed fall back to the client IP, ad and publisher.
+*/
+func impressionKey(clientIP string, event *Event) string {
+	if event.ResponseID != "" {
+		return event.ResponseID
+	}
+	return hashClientIP(clientIP) + "_" + event.AdID + "_" + event.PublisherID
+}
+
+// RecordImpression remembers when an impression was seen, for the time-to-click signal
+func (f *FraudEngine) RecordImpression(clientIP string, event *Event) {
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.impressionTimes[impressionKey(clientIP, event)] = now
+}
+
+// Evict forgets the request counts older than the timeframe and the impressions older than impressionMemory
+func (f *FraudEngine) Evict(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, requestData := range f.requestLog {
+		if now.Sub(requestData.LastRequestAt).Seconds() > timeframe {
+			delete(f.requestLog, key)
+		}
+	}
+	for key, seenAt := range f.impressionTimes {
+		if now.Sub(seenAt) > impressionMemory {
+			delete(f.impressionTimes, key)
+		}
+	}
+}
+
+// EvictEvery runs Evict on every tick of the interval. It blocks forever.
+func (f *FraudEngine) EvictEvery(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		f.Evict(now)
+	}
+}
+
+// hit counts a request under key within the timeframe and returns the new count
+func (f *FraudEngine) hit(key string, now time.Time) int {
+	requestData, exists := f.requestLog[key]
+	if exists && now.Sub(requestData.LastRequestAt).Seconds() <= timeframe {
+		requestData.Count++
+	} else {
+		requestData.Count = 1
+	}
+	requestData.LastRequestAt = now
+	f.requestLog[key] = requestData
+	return requestData.Count
+}
+
+// count returns the number of requests under key within the timeframe, without counting a new one
+func (f *FraudEngine) count(key string, now time.Time) int {
+	requestData, exists := f.requestLog[key]
+	if !exists || now.Sub(requestData.LastRequestAt).Seconds() > timeframe {
+		return 0
+	}
+	return requestData.Count
+}
+
+/*
+Collects the fraud signals of an event. For clicks, record decides
+whether the click counts towards the velocity of its visitor; a click
+re-submitted after solving a captcha should not be counted twice.
+*/
+func (f *FraudEngine) Signals(c *gin.Context, event *Event, isClick bool, record bool) FraudSignals {
+	clientIP := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+	now := time.Now()
+
+	signals := FraudSignals{
+		IsClick:       isClick,
+		DatacenterIP:  f.isDatacenterIP(clientIP),
+		HeadlessHints: headlessHints(userAgent),
+		NoLanguage:    c.GetHeader("Accept-Language") == "",
+	}
+	if !isClick {
+		return signals
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	impressionAt, seen := f.impressionTimes[impressionKey(clientIP, event)]
+	signals.ImpressionSeen = seen
+	if seen {
+		signals.TimeToClick = now.Sub(impressionAt)
+	} else {
+		signals.TimeToClick = now.Sub(time.Unix(event.IssuedAt, 0))
+	}
+
+	// Rate limits are keyed by hashed IPs, so that raw IPs are not kept around.
+	ipKey := hashClientIP(clientIP)
+	visitorKey := ipKey + "_" + userAgent + "_" + event.PublisherID
+	if record {
+		signals.VisitorVelocity = f.hit(visitorKey, now)
+		signals.IPVelocity = f.hit(ipKey, now)
+	} else {
+		signals.VisitorVelocity = f.count(visitorKey, now)
+		signals.IPVelocity = f.count(ipKey, now)
+	}
+	return signals
+}
+
+func (f *FraudEngine) isDatacenterIP(clientIP string) bool {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range f.datacenterNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func headlessHints(userAgent string) []string {
+	var hints []string
+	if userAgent == "" {
+		hints = append(hints, "missing")
+	}
+	for _, hint := range headlessUserAgentHints {
+		if strings.Contains(userAgent, hint) {
+			hints = append(hints, hint)
+		}
+	}
+	return hints
+}
+
+// Assess scores the signals of an event and decides what to do with it
+func (f *FraudEngine) Assess(signals FraudSignals) FraudAssessment {
+	var assessment FraudAssessment
+	for _, rule := range fraudRules {
+		if rule.Applies(signals, f.config) {
+			assessment.Score += rule.Weight
+			assessment.Reasons = append(assessment.Reasons, rule.Name)
+		}
+	}
+	if assessment.Score > maxFraudScore {
+		assessment.Score = maxFraudScore
+	}
+	sort.Strings(assessment.Reasons)
+
+	switch {
+	case assessment.Score >= f.config.NoBillThreshold:
+		assessment.Decision = DECISION_NO_BILL
+	case assessment.Score >= f.config.ChallengeThreshold && signals.IsClick:
+		assessment.Decision = DECISION_CHALLENGE
+	default:
+		assessment.Decision = DECISION_ACCEPT
+	}
+	return assessment
+}
+
+// apply records the outcome of an assessment on the event
+func (assessment FraudAssessment) apply(event *Event) {
+	event.FraudScore = assessment.Score
+	event.FraudReasons = assessment.Reasons
+	event.NotBillable = assessment.Decision == DECISION_NO_BILL
+}
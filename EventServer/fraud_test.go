@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func testFraudConfig() FraudConfig {
+	return FraudConfig{
+		ChallengeThreshold: defaultChallengeThreshold,
+		NoBillThreshold:    defaultNoBillThreshold,
+		MinTimeToClick:     defaultMinTimeToClick,
+	}
+}
+
+// TestFraudAssess checks the decisions taken for combinations of signals
+func TestFraudAssess(t *testing.T) {
+	engine := NewFraudEngine(testFraudConfig(), nil)
+
+	clean := FraudSignals{IsClick: true, ImpressionSeen: true, TimeToClick: time.Minute}
+	assessment := engine.Assess(clean)
+	assert.Equal(t, 0, assessment.Score)
+	assert.Equal(t, DECISION_ACCEPT, assessment.Decision)
+
+	repeated := clean
+	repeated.VisitorVelocity = requestThreshold + 1
+	assessment = engine.Assess(repeated)
+	assert.Equal(t, DECISION_CHALLENGE, assessment.Decision)
+	assert.Equal(t, []string{"visitor_velocity"}, assessment.Reasons)
+
+	bot := FraudSignals{IsClick: true, TimeToClick: time.Second, DatacenterIP: true, HeadlessHints: []string{"HeadlessChrome"}}
+	assessment = engine.Assess(bot)
+	assert.Equal(t, maxFraudScore, assessment.Score)
+	assert.Equal(t, DECISION_NO_BILL, assessment.Decision)
+
+	// Impressions are never challenged.
+	impression := FraudSignals{HeadlessHints: []string{"PhantomJS"}}
+	assessment = engine.Assess(impression)
+	assert.Equal(t, DECISION_ACCEPT, assessment.Decision)
+	assert.Equal(t, weightHeadlessAgent, assessment.Score)
+}
+
+// TestFraudSignals checks the signals gathered from a click request
+func TestFraudSignals(t *testing.T) {
+	_, documentation, _ := net.ParseCIDR("192.0.2.0/24")
+	engine := NewFraudEngine(testFraudConfig(), []*net.IPNet{documentation})
+	event := Event{AdID: "5", PublisherID: "4"}
+	event.IssuedAt = time.Now().Add(-time.Minute).Unix()
+
+	newContext := func(remoteAddr string) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request, _ = http.NewRequest("GET", "/click/x", nil)
+		c.Request.RemoteAddr = remoteAddr
+		c.Request.Header.Set("User-Agent", "Mozilla/5.0 HeadlessChrome/120.0")
+		return c
+	}
+
+	signals := engine.Signals(newContext("192.0.2.10:1234"), &event, true, true)
+	assert.True(t, signals.DatacenterIP)
+	assert.True(t, signals.NoLanguage)
+	assert.False(t, signals.ImpressionSeen)
+	assert.Equal(t, []string{"HeadlessChrome"}, signals.HeadlessHints)
+	assert.Equal(t, 1, signals.VisitorVelocity)
+	assert.GreaterOrEqual(t, signals.TimeToClick, time.Minute)
+
+	engine.RecordImpression("10.0.0.1", &event)
+	signals = engine.Signals(newContext("10.0.0.1:1234"), &event, true, false)
+	assert.False(t, signals.DatacenterIP)
+	assert.True(t, signals.ImpressionSeen)
+	assert.Less(t, signals.TimeToClick, time.Second)
+	assert.Equal(t, 0, signals.VisitorVelocity)
+}
+
+// TestFraudEvict checks that expired request counts and impressions are forgotten
+func TestFraudEvict(t *testing.T) {
+	engine := NewFraudEngine(testFraudConfig(), nil)
+	now := time.Now()
+	engine.hit("recent", now)
+	engine.hit("stale", now.Add(-2*timeframe*time.Second))
+	engine.impressionTimes["recent"] = now
+	engine.impressionTimes["stale"] = now.Add(-2 * impressionMemory)
+
+	engine.Evict(now)
+	assert.Len(t, engine.requestLog, 1)
+	assert.Contains(t, engine.requestLog, "recent")
+	assert.Len(t, engine.impressionTimes, 1)
+	assert.Contains(t, engine.impressionTimes, "recent")
+}
+
+// TestFastClickIsNotBilled checks that a click right after the impression is accepted but not billed
+func TestFastClickIsNotBilled(t *testing.T) {
+	sink := NewFakeSink()
+	server := NewEventServer(sink, FakeCaptchaVerifier{})
+	router := server.SetupRouter()
+	go server.processEvents()
+
+	var clickEvent = Event{
+		UserID:      "a-fast-clicking-token",
+		AdID:        "5",
+		AdURL:       "http://yahoo.com",
+		PublisherID: "7",
+		EventType:   "click",
+	}
+	clickEvent.IssuedAt = time.Now().Unix()
+	signedClickLink, err := signEvent(&clickEvent)
+	assert.Nil(t, err)
+
+	req, _ := http.NewRequest("GET", "/click/"+signedClickLink, nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assertRedirectsWithClickID(t, w, "http://yahoo.com")
+
+	assert.Eventually(t, func() bool { return len(sink.Events()) == 1 }, time.Second, 10*time.Millisecond)
+	event := sink.Events()[0]
+	assert.True(t, event.NotBillable)
+	assert.Contains(t, event.FraudReasons, "fast_click")
+}
+
+// TestRepeatedClicksAreChallenged checks that a visitor clicking too often is sent to the captcha
+func TestRepeatedClicksAreChallenged(t *testing.T) {
+	router := setupRouter()
+
+	var clickEvent = Event{
+		UserID:      "a-repeating-token",
+		AdID:        "5",
+		AdURL:       "http://yahoo.com",
+		PublisherID: "7",
+		EventType:   "click",
+	}
+	signedClickLink, err := signEvent(&clickEvent)
+	assert.Nil(t, err)
+
+	var w *httptest.ResponseRecorder
+	for i := 0; i <= requestThreshold; i++ {
+		req, _ := http.NewRequest("GET", "/click/"+signedClickLink, nil)
+		req.Header.Set("Accept-Language", "en")
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+	}
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/captcha?info="+signedClickLink, w.Header().Get("Location"))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const sinkHealthTimeout = 2 * time.Second
+const defaultMaxQueueDepth = 80 // Events waiting in one channel before the server reports not ready.
+const defaultShutdownTimeout = 30 * time.Second
+
+// queueDepths returns the number of events waiting in each channel
+func (s *EventServer) queueDepths() map[string]int {
+	return map[string]int{
+		"impression": len(s.impressionchan),
+		"click":      len(s.clickchan),
+		"viewable":   len(s.viewablechan),
+		"conversion": len(s.conversionchan),
+	}
+}
+
+// handleHealthz tells whether the process is alive
+func (s *EventServer) handleHealthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+/*
+handleReadyz tells whether the server should receive traffic: it is
+not shutting down, its sink is reachable and its queues are not
+backing up.
+*/
+func (s *EventServer) handleReadyz(c *gin.Context) {
+	var problems []string
+	if s.draining.Load() {
+		problems = append(problems, "shutting down")
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), sinkHealthTimeout)
+	defer cancel()
+	if err := sinkHealthy(ctx, s.sink); err != nil {
+		problems = append(problems, "sink: "+err.Error())
+	}
+
+	depths := s.queueDepths()
+	for eventType, depth := range depths {
+		if depth > s.maxQueueDepth {
+			problems = append(problems, eventType+" queue is backing up")
+		}
+	}
+
+	if len(problems) > 0 {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "problems": problems, "queues": depths})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready", "queues": depths})
+}
+
+/*
+Drain stops processEvents once every event already queued has been
+sent to the sink. It must only be called after the HTTP server has
+stopped, so that no handler is still queuing events.
+*/
+func (s *EventServer) Drain(ctx context.Context) error {
+	s.draining.Store(true)
+	close(s.stop)
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return errors.New("timed out draining events")
+	}
+}
+
+// drainQueues sends the events left in the channels to the sink
+func (s *EventServer) drainQueues() {
+	for {
+		select {
+		case event := <-s.impressionchan:
+			s.sendToSink(event, "impression")
+		case event := <-s.clickchan:
+			s.sendToSink(event, "click")
+		case event := <-s.viewablechan:
+			s.sendToSink(event, event.EventType)
+		case event := <-s.conversionchan:
+			s.sendToSink(event, "conversion")
+		default:
+			return
+		}
+	}
+}
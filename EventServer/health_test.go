@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthAndReadiness(t *testing.T) {
+	sink := NewFakeSink()
+	server := NewEventServer(sink, FakeCaptchaVerifier{})
+	router := server.SetupRouter()
+
+	get := func(path string) int {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("User-Agent", "Go-http-client/1.1") // As sent by Traefik's health checks.
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, get("/healthz"))
+	assert.Equal(t, http.StatusOK, get("/readyz"))
+
+	// Probes are not filtered by the User-Agent deny list.
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	req.Header.Set("User-Agent", "curl/8.0")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	sink.SetHealth(errors.New("broker unreachable"))
+	assert.Equal(t, http.StatusServiceUnavailable, get("/readyz"))
+	assert.Equal(t, http.StatusOK, get("/healthz"))
+	sink.SetHealth(nil)
+
+	server.maxQueueDepth = 0
+	server.clickchan <- Event{AdID: "5"}
+	assert.Equal(t, http.StatusServiceUnavailable, get("/readyz"))
+}
+
+// TestDrainSendsQueuedEvents checks that events still queued at shutdown reach the sink
+func TestDrainSendsQueuedEvents(t *testing.T) {
+	sink := NewFakeSink()
+	server := NewEventServer(sink, FakeCaptchaVerifier{})
+	for i := 0; i < 10; i++ {
+		server.impressionchan <- Event{AdID: "5"}
+		server.clickchan <- Event{AdID: "5"}
+	}
+
+	go server.processEvents()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, server.Drain(ctx))
+	assert.Len(t, sink.Events(), 20)
+	assert.True(t, server.draining.Load())
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"eventschema"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* How client IPs are anonymized before leaving the process, set by EVENT_IP_ANONYMIZATION. */
+const (
+	IP_ANONYMIZATION_HASH     = "hash"     // Salted hash of the full IP.
+	IP_ANONYMIZATION_TRUNCATE = "truncate" // Salted hash of the IP truncated to its /24 or /48 network.
+)
+
+var ipAnonymization = getEnv("EVENT_IP_ANONYMIZATION", IP_ANONYMIZATION_HASH)
+
+// truncateIP zeroes the host part of an IP, keeping its /24 (IPv4) or /48 (IPv6) network
+func truncateIP(clientIP string) string {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// anonymizeIP returns what is sent downstream in place of the client IP
+func anonymizeIP(clientIP string) string {
+	if ipAnonymization == IP_ANONYMIZATION_TRUNCATE {
+		clientIP = truncateIP(clientIP)
+	}
+	return hashClientIP(clientIP)
+}
+
+/*
+hashViewerID returns what is sent downstream in place of the viewer ID:
+enough to count distinct viewers, not to tell who they are.
+*/
+func hashViewerID(viewerID string) string {
+	if viewerID == "" {
+		return ""
+	}
+	return hashClientIP("viewer:" + viewerID)
+}
+
+/*
+applyConsent drops the identifying fields of events of viewers who did
+not consent to tracking. Tokens issued before consent was propagated
+carry no consent, and are treated the same way.
+*/
+func applyConsent(event *eventschema.Event) {
+	if event.Consent {
+		return
+	}
+	event.ClientIPHash = ""
+	event.UserAgent = ""
+	event.ViewerHash = ""
+}
+
+/*
+ForgetViewer deletes every entry of a viewer from the dedup store and
+returns how many were deleted. Events already sent downstream are left
+to the sinks' own retention.
+*/
+func (s *EventServer) ForgetViewer(viewerID string) int {
+	if viewerID == "" {
+		return 0
+	}
+	s.dedupMu.Lock()
+	defer s.dedupMu.Unlock()
+
+	deleted := 0
+	for _, store := range []map[string]Value{s.impressions, s.clicks, s.viewables} {
+		for userID, value := range store {
+			if value.ViewerID == viewerID {
+				delete(store, userID)
+				deleted++
+			}
+		}
+	}
+	return deleted
+}
+
+// handleForgetViewer serves data-deletion requests
+func (s *EventServer) handleForgetViewer(c *gin.Context) {
+	deleted := s.ForgetViewer(c.Param("viewer_id"))
+	c.JSON(http.StatusOK, gin.H{"deleted": deleted})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTruncateIP(t *testing.T) {
+	assert.Equal(t, "203.0.113.0", truncateIP("203.0.113.77"))
+	assert.Equal(t, "2001:db8:1::", truncateIP("2001:db8:1:2::5"))
+	assert.Equal(t, "", truncateIP("not-an-ip"))
+}
+
+func TestEventsWithoutConsentAreRedacted(t *testing.T) {
+	event := Event{AdID: "5", ClientIP: "203.0.113.77", UserAgent: "Mozilla/5.0", ViewerID: "viewer"}
+	redacted := toSchemaEvent(event, "impression")
+	assert.False(t, redacted.Consent)
+	assert.Empty(t, redacted.ClientIPHash)
+	assert.Empty(t, redacted.UserAgent)
+	assert.Empty(t, redacted.ViewerHash)
+	assert.Equal(t, "5", redacted.AdID)
+
+	event.Consent = true
+	kept := toSchemaEvent(event, "impression")
+	assert.True(t, kept.Consent)
+	assert.Equal(t, hashClientIP("203.0.113.77"), kept.ClientIPHash)
+	assert.Equal(t, "Mozilla/5.0", kept.UserAgent)
+	assert.Equal(t, hashViewerID("viewer"), kept.ViewerHash)
+	assert.NotContains(t, kept.ViewerHash, "viewer")
+}
+
+// TestForgetViewer checks that a deletion request removes the viewer from the dedup store
+func TestForgetViewer(t *testing.T) {
+	t.Setenv("ACCESS_RULES_FILE", filepath.Join(t.TempDir(), "access_rules.json"))
+	t.Setenv("ADMIN_TOKEN", "secret")
+	server := NewEventServer(NewFakeSink(), FakeCaptchaVerifier{})
+	router := server.SetupRouter()
+	go server.processEvents()
+
+	for _, userID := range []string{"first-token", "second-token"} {
+		impressionEvent := Event{UserID: userID, AdID: "5", PublisherID: "4", EventType: "impression", ViewerID: "viewer-1", Consent: true}
+		impressionEvent.IssuedAt = time.Now().Unix()
+		signedImpressionLink, err := signEvent(&impressionEvent)
+		assert.Nil(t, err)
+		req, _ := http.NewRequest("GET", "/impression/"+signedImpressionLink, nil)
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	req, _ := http.NewRequest("DELETE", "/admin/viewers/viewer-1", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"deleted": 2}`, w.Body.String())
+	assert.Equal(t, 0, server.ForgetViewer("viewer-1"))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+var ErrUnsafeRedirect = errors.New("unsafe redirect URL")
+
+/*
+checkRedirectURL re-checks the ad URL of a click before redirecting to
+it. Panel validates redirect links when ads are created, but tokens
+outlive ads, so only plain http and https URLs are followed here.
+*/
+func checkRedirectURL(adURL string) error {
+	if strings.ContainsAny(adURL, "\\ \t\r\n") {
+		return ErrUnsafeRedirect
+	}
+	parsed, err := url.Parse(adURL)
+	if err != nil {
+		return ErrUnsafeRedirect
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return ErrUnsafeRedirect
+	}
+	if parsed.User != nil || parsed.Opaque != "" || parsed.Hostname() == "" {
+		return ErrUnsafeRedirect
+	}
+	return nil
+}
+
+/*
+expandRedirectURL fills in the click macros of the ad URL. Values are
+query-escaped, so they cannot change the shape of the URL. When the
+advertiser did not place {click_id}, the click ID is appended as the
+click_id query parameter.
+*/
+func expandRedirectURL(event *Event, clickID string) string {
+	adURL := event.AdURL
+	hasClickMacro := strings.Contains(adURL, "{click_id}")
+	adURL = strings.NewReplacer(
+		"{publisher_id}", url.QueryEscape(event.PublisherID),
+		"{ad_id}", url.QueryEscape(event.AdID),
+		"{click_id}", url.QueryEscape(clickID),
+	).Replace(adURL)
+	if hasClickMacro {
+		return adURL
+	}
+	return appendClickID(adURL, clickID)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckRedirectURL(t *testing.T) {
+	assert.Nil(t, checkRedirectURL("https://example.com/landing?pub={publisher_id}"))
+	for _, adURL := range []string{"javascript:alert(1)", "data:text/html,hi", "//evil.com", "https://user@evil.com", "https:///path", "https://evil.com\\@example.com"} {
+		assert.Equal(t, ErrUnsafeRedirect, checkRedirectURL(adURL), adURL)
+	}
+}
+
+func TestExpandRedirectURL(t *testing.T) {
+	event := Event{AdID: "5", PublisherID: "7&x=1", AdURL: "https://example.com/{ad_id}?pub={publisher_id}&c={click_id}"}
+	assert.Equal(t, "https://example.com/5?pub=7%26x%3D1&c=abc", expandRedirectURL(&event, "abc"))
+
+	event.AdURL = "https://example.com/?pub={publisher_id}"
+	assert.Equal(t, "https://example.com/?click_id=abc&pub=7%26x%3D1", expandRedirectURL(&event, "abc"))
+}
+
+// TestUnsafeClickIsNotRedirected checks that a click token carrying a javascript: URL is refused
+func TestUnsafeClickIsNotRedirected(t *testing.T) {
+	sink := NewFakeSink()
+	server := NewEventServer(sink, FakeCaptchaVerifier{})
+	router := server.SetupRouter()
+
+	clickEvent := Event{UserID: "unsafe-token", AdID: "5", PublisherID: "7", EventType: "click", AdURL: "javascript:alert(1)"}
+	signedClickLink, err := signEvent(&clickEvent)
+	assert.Nil(t, err)
+
+	req, _ := http.NewRequest("GET", "/click/"+signedClickLink, nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, w.Header().Get("Location"))
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"eventschema"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+)
+
+/* Names accepted in the EVENT_SINKS environment variable. */
+const (
+	SINK_KAFKA   = "kafka"
+	SINK_NATS    = "nats"
+	SINK_FILE    = "file"
+	SINK_WEBHOOK = "webhook"
+	SINK_FAKE    = "fake"
+)
+
+const defaultNatsSubject = "events"
+const defaultEventFilePath = "events.jsonl"
+const defaultEventFileMaxBytes = 100 << 20 // Rotate the events file after 100MB.
+const webhookTimeout = 5 * time.Second
+
+// EventSink is a destination to which accepted events are delivered.
+type EventSink interface {
+	Send(ctx context.Context, event eventschema.Event) error
+	Close() error
+}
+
+/*
+HealthChecker is implemented by sinks that can tell whether they are
+able to deliver events, for the readiness probe. Sinks that do not
+implement it are assumed healthy.
+*/
+type HealthChecker interface {
+	Healthy(ctx context.Context) error
+}
+
+// sinkHealthy checks a sink that may implement HealthChecker
+func sinkHealthy(ctx context.Context, sink EventSink) error {
+	if checker, ok := sink.(HealthChecker); ok {
+		return checker.Healthy(ctx)
+	}
+	return nil
+}
+
+/*
+Sinks carrying binary payloads (Kafka, NATS) use the Protobuf encoding
+of the event schema; text-based ones (file, webhook) use its JSON form.
+*/
+func encodeEventJSON(event eventschema.Event) ([]byte, error) {
+	event.SchemaVersion = eventschema.SCHEMA_VERSION
+	return json.Marshal(event)
+}
+
+// getEnv returns the value of an environment variable, or fallback if it is unset.
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+/*
+Builds the sink described by the environment. EVENT_SINKS is a
+comma separated list of sink names; when more than one is given,
+events are fanned out to all of them.
+*/
+func NewSinkFromConfig() (EventSink, error) {
+	names := strings.Split(getEnv("EVENT_SINKS", SINK_KAFKA), ",")
+
+	var sinks []EventSink
+	for _, name := range names {
+		sink, err := newSink(strings.TrimSpace(name))
+		if err != nil {
+			for _, opened := range sinks {
+				opened.Close()
+			}
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if len(sinks) == 1 {
+		return sinks[0], nil
+	}
+	return NewMultiSink(sinks...), nil
+}
+
+func newSink(name string) (EventSink, error) {
+	switch name {
+	case SINK_KAFKA:
+		return NewKafkaSink(getEnv("KAFKA_BROKER_ADDRESS", kafkaBrokerAddress), getEnv("KAFKA_TOPIC", kafkaTopic)), nil
+	case SINK_NATS:
+		return NewNATSSink(getEnv("NATS_URL", nats.DefaultURL), getEnv("NATS_SUBJECT", defaultNatsSubject))
+	case SINK_FILE:
+		maxBytes, err := strconv.ParseInt(getEnv("EVENT_FILE_MAX_BYTES", strconv.Itoa(defaultEventFileMaxBytes)), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EVENT_FILE_MAX_BYTES: %v", err)
+		}
+		return NewFileSink(getEnv("EVENT_FILE_PATH", defaultEventFilePath), maxBytes)
+	case SINK_WEBHOOK:
+		webhookURL := getEnv("EVENT_WEBHOOK_URL", "")
+		if webhookURL == "" {
+			return nil, errors.New("EVENT_WEBHOOK_URL must be set for the webhook sink")
+		}
+		return NewWebhookSink(webhookURL), nil
+	case SINK_FAKE:
+		return NewFakeSink(), nil
+	default:
+		return nil, fmt.Errorf("unknown event sink %q", name)
+	}
+}
+
+/* Kafka */
+
+// KafkaSink writes events to a Kafka topic, keyed by ad ID.
+type KafkaSink struct {
+	brokerAddress string
+	writer        *kafka.Writer
+}
+
+func NewKafkaSink(brokerAddress, topic string) *KafkaSink {
+	return &KafkaSink{
+		brokerAddress: brokerAddress,
+		writer: kafka.NewWriter(kafka.WriterConfig{
+			Brokers:  []string{brokerAddress},
+			Topic:    topic,
+			Balancer: &kafka.LeastBytes{},
+		}),
+	}
+}
+
+func (k *KafkaSink) Send(ctx context.Context, event eventschema.Event) error {
+	msg := kafka.Message{
+		Key:   []byte(event.AdID),
+		Value: eventschema.Marshal(&event),
+		Headers: []kafka.Header{
+			{Key: eventschema.VERSION_HEADER, Value: []byte(strconv.Itoa(eventschema.SCHEMA_VERSION))},
+		},
+	}
+	return k.writer.WriteMessages(ctx, msg)
+}
+
+// Close flushes the events still buffered by the writer.
+func (k *KafkaSink) Close() error {
+	return k.writer.Close()
+}
+
+func (k *KafkaSink) Healthy(ctx context.Context) error {
+	conn, err := kafka.DialContext(ctx, "tcp", k.brokerAddress)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+/* NATS */
+
+// NATSSink publishes events on a NATS subject.
+type NATSSink struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func NewNATSSink(natsURL, subject string) (*NATSSink, error) {
+	conn, err := nats.Connect(natsURL)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to NATS: %v", err)
+	}
+	return &NATSSink{conn: conn, subject: subject}, nil
+}
+
+func (n *NATSSink) Send(ctx context.Context, event eventschema.Event) error {
+	msg := nats.NewMsg(n.subject)
+	msg.Header.Set(eventschema.VERSION_HEADER, strconv.Itoa(eventschema.SCHEMA_VERSION))
+	msg.Data = eventschema.Marshal(&event)
+	return n.conn.PublishMsg(msg)
+}
+
+func (n *NATSSink) Close() error {
+	return n.conn.Drain()
+}
+
+func (n *NATSSink) Healthy(ctx context.Context) error {
+	if !n.conn.IsConnected() {
+		return fmt.Errorf("NATS connection is %v", n.conn.Status())
+	}
+	return nil
+}
+
+/* JSON-lines file */
+
+/*
+FileSink appends events as JSON lines to a file. Once the file grows
+beyond maxBytes it is renamed with a timestamp suffix and a fresh
+file is started in its place.
+*/
+type FileSink struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	file     *os.File
+	size     int64
+}
+
+func NewFileSink(path string, maxBytes int64) (*FileSink, error) {
+	sink := &FileSink{path: path, maxBytes: maxBytes}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (f *FileSink) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open events file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("could not stat events file: %v", err)
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *FileSink) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	rotatedPath := f.path + "." + time.Now().Format("20060102150405.000000000")
+	if err := os.Rename(f.path, rotatedPath); err != nil {
+		return fmt.Errorf("could not rotate events file: %v", err)
+	}
+	return f.open()
+}
+
+func (f *FileSink) Send(ctx context.Context, event eventschema.Event) error {
+	eventData, err := encodeEventJSON(event)
+	if err != nil {
+		return fmt.Errorf("could not marshal event: %v", err)
+	}
+	eventData = append(eventData, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.maxBytes > 0 && f.size > 0 && f.size+int64(len(eventData)) > f.maxBytes {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.Write(eventData)
+	f.size += int64(n)
+	return err
+}
+
+func (f *FileSink) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+/* HTTP webhook */
+
+// WebhookSink POSTs each event as JSON to a configured URL.
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{url: url, client: &http.Client{Timeout: webhookTimeout}}
+}
+
+func (w *WebhookSink) Send(ctx context.Context, event eventschema.Event) error {
+	eventData, err := encodeEventJSON(event)
+	if err != nil {
+		return fmt.Errorf("could not marshal event: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(eventData))
+	if err != nil {
+		return fmt.Errorf("could not build webhook request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook received non-2xx response: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (w *WebhookSink) Close() error {
+	return nil
+}
+
+/* In-process fake */
+
+// FakeSink keeps events in memory. It is meant for tests and local runs.
+type FakeSink struct {
+	mu     sync.Mutex
+	events []eventschema.Event
+	health error
+}
+
+func NewFakeSink() *FakeSink {
+	return &FakeSink{}
+}
+
+func (f *FakeSink) Send(ctx context.Context, event eventschema.Event) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, event)
+	return nil
+}
+
+// Events returns a copy of every event received so far.
+func (f *FakeSink) Events() []eventschema.Event {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]eventschema.Event(nil), f.events...)
+}
+
+// SetHealth sets the error returned by Healthy, nil meaning healthy.
+func (f *FakeSink) SetHealth(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.health = err
+}
+
+func (f *FakeSink) Healthy(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.health
+}
+
+func (f *FakeSink) Close() error {
+	return nil
+}
+
+/* Fan-out */
+
+// MultiSink delivers every event to all of its sinks.
+type MultiSink struct {
+	sinks []EventSink
+}
+
+func NewMultiSink(sinks ...EventSink) *MultiSink {
+	return &MultiSink{sinks: sinks}
+}
+
+func (m *MultiSink) Send(ctx context.Context, event eventschema.Event) error {
+	var errs []error
+	for _, sink := range m.sinks {
+		if err := sink.Send(ctx, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *MultiSink) Healthy(ctx context.Context) error {
+	var errs []error
+	for _, sink := range m.sinks {
+		if err := sinkHealthy(ctx, sink); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *MultiSink) Close() error {
+	var errs []error
+	for _, sink := range m.sinks {
+		if err := sink.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"eventschema"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestFileSinkRotation checks that the file sink writes JSON lines and rotates the file
+func TestFileSinkRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.jsonl")
+
+	sink, err := NewFileSink(path, 200)
+	assert.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, sink.Send(context.Background(), eventschema.Event{AdID: "5", PublisherID: "4", Type: "click"}))
+	}
+	assert.Nil(t, sink.Close())
+
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Greater(t, len(entries), 1)
+
+	file, err := os.Open(path)
+	assert.Nil(t, err)
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event eventschema.Event
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &event))
+		assert.Equal(t, "5", event.AdID)
+		assert.Equal(t, uint32(eventschema.SCHEMA_VERSION), event.SchemaVersion)
+	}
+}
+
+// TestWebhookSink checks that the webhook sink posts events and reports failures
+func TestWebhookSink(t *testing.T) {
+	var received eventschema.Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(server.URL)
+	assert.Nil(t, sink.Send(context.Background(), eventschema.Event{AdID: "9", Type: "impression"}))
+	assert.Equal(t, "9", received.AdID)
+
+	failingServer := httptest.NewServer(http.NotFoundHandler())
+	defer failingServer.Close()
+
+	failing := NewWebhookSink(failingServer.URL)
+	assert.NotNil(t, failing.Send(context.Background(), eventschema.Event{AdID: "9"}))
+}
+
+// TestMultiSinkFanOut checks that every sink of a multi sink receives the event
+func TestMultiSinkFanOut(t *testing.T) {
+	first, second := NewFakeSink(), NewFakeSink()
+	sink := NewMultiSink(first, second)
+
+	assert.Nil(t, sink.Send(context.Background(), eventschema.Event{AdID: "1"}))
+	assert.Len(t, first.Events(), 1)
+	assert.Len(t, second.Events(), 1)
+}
+
+// TestNewSinkFromConfig checks sink selection through EVENT_SINKS
+func TestNewSinkFromConfig(t *testing.T) {
+	t.Setenv("EVENT_SINKS", "fake")
+	sink, err := NewSinkFromConfig()
+	assert.Nil(t, err)
+	assert.IsType(t, &FakeSink{}, sink)
+
+	t.Setenv("EVENT_SINKS", "fake, file")
+	t.Setenv("EVENT_FILE_PATH", filepath.Join(t.TempDir(), "events.jsonl"))
+	sink, err = NewSinkFromConfig()
+	assert.Nil(t, err)
+	assert.IsType(t, &MultiSink{}, sink)
+	sink.Close()
+
+	t.Setenv("EVENT_SINKS", "carrier-pigeon")
+	_, err = NewSinkFromConfig()
+	assert.NotNil(t, err)
+}
@@ -3,6 +3,7 @@ package controllers
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"go-ad-panel/models"
@@ -20,6 +21,7 @@ type AdController struct {
 	Repo           repositories.AdRepository
 	RepoAdvertiser repositories.AdvertiserRepository
 	RepoPublisher  repositories.PublisherRepository
+	RepoLedger     repositories.LedgerRepository
 }
 
 type DisableAdsRequest struct {
@@ -86,7 +88,16 @@ func (ctrl AdController) CreateAd(c *gin.Context) {
 
 	title := c.PostForm("title")
 	bid, _ := strconv.Atoi(c.PostForm("bid"))
-	redirect_link := c.PostForm("redirect_link")
+	advertiser, err := ctrl.RepoAdvertiser.FindByID(uint(id))
+	if err != nil {
+		c.HTML(http.StatusNotFound, "advertiser.html", gin.H{"notfounderror": "Advertiser Not Found"})
+		return
+	}
+	redirect_link, err := NormalizeRedirectLink(c.PostForm("redirect_link"), advertiser.AllowedDomains)
+	if err != nil {
+		c.HTML(http.StatusBadRequest, "advertiser.html", gin.H{"notfounderror": "Invalid Redirect Link: " + err.Error()})
+		return
+	}
 
 	// Handle file upload
 	file, err := c.FormFile("image")
@@ -163,35 +174,80 @@ func (ctrl AdController) ToggleActivation(c *gin.Context) {
 type EventRequest struct {
 	EventType   string `json:"event_type" binding:"required"`
 	PublisherID string `json:"publisher_id" binding:"required"`
+	Time        int64  `json:"time"`
+	Price       int    `json:"price"` // Bid the ad was served at, which its clicks are billed.
+}
+
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// The entries booked for a click: the advertiser is debited its price, and the publisher credited as much.
+func ClickLedgerEntries(key string, ad models.Ad, publisherID int, price int) []models.LedgerEntry {
+	return []models.LedgerEntry{
+		{IdempotencyKey: key, AccountType: models.LedgerAdvertiser, AccountID: ad.AdvertiserID, AdID: int(ad.ID), Amount: -price},
+		{IdempotencyKey: key, AccountType: models.LedgerPublisher, AccountID: publisherID, AdID: int(ad.ID), Amount: price},
+	}
 }
 
+// Applies an event once per idempotency key: a click moves credit and is booked to the ledger, an impression is counted.
 func (ctrl AdController) HandleEventAtomic(c *gin.Context) {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
 		return
 	}
+	key := c.GetHeader(IdempotencyKeyHeader)
+	if key == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing " + IdempotencyKeyHeader + " header"})
+		return
+	}
+	var eventRequest EventRequest
+	if err := c.ShouldBindJSON(&eventRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	publisher_id, err := strconv.Atoi(eventRequest.PublisherID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid publisher ID"})
+		return
+	}
+	// Clicks are billed the bid they were served at, which the ad's current bid may no longer be.
+	if eventRequest.EventType == "click" && eventRequest.Price <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid price"})
+		return
+	}
 
 	ad, err := ctrl.Repo.FindByID(id)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
 		return
 	}
+	// A click is never billed more than the ad bids.
+	if eventRequest.EventType == "click" && eventRequest.Price > ad.BidValue {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid price"})
+		return
+	}
 	advertiser_id := ad.AdvertiserID
+	duplicate := false
 	err = ctrl.Repo.WithTransaction(func(tx *gorm.DB) error {
-		var eventRequest EventRequest
-		if err := c.ShouldBindJSON(&eventRequest); err != nil {
+		applied, err := ctrl.RepoLedger.RecordEventTx(tx, &models.BilledEvent{
+			IdempotencyKey: key,
+			AdID:           id,
+			PublisherID:    publisher_id,
+			EventType:      eventRequest.EventType,
+			EventTime:      eventRequest.Time,
+		})
+		if err != nil {
 			return err
 		}
+		if !applied {
+			duplicate = true
+			return nil
+		}
 
 		advertiser, err := ctrl.RepoAdvertiser.FindByIDTx(tx, int(uint(advertiser_id)))
 		if err != nil {
 			return err
 		}
-		publisher_id, err := strconv.Atoi(eventRequest.PublisherID)
-		if err != nil {
-			return err
-		}
 
 		publisher, err := ctrl.RepoPublisher.FindByIDTx(tx, publisher_id)
 		if err != nil {
@@ -200,13 +256,16 @@ func (ctrl AdController) HandleEventAtomic(c *gin.Context) {
 
 		switch eventRequest.EventType {
 		case "click":
-			if err := ctrl.RepoAdvertiser.DecreaseCredit(tx, &advertiser, ad.BidValue); err != nil {
+			if err := ctrl.RepoAdvertiser.DecreaseCredit(tx, &advertiser, eventRequest.Price); err != nil {
+				return err
+			}
+			if err := ctrl.RepoPublisher.IncreaseCredit(tx, &publisher, eventRequest.Price); err != nil {
 				return err
 			}
-			if err := ctrl.RepoPublisher.IncreaseCredit(tx, &publisher, ad.BidValue); err != nil {
+			if err := ctrl.Repo.IncrementClicksTx(tx, &ad, eventRequest.Price); err != nil {
 				return err
 			}
-			if err := ctrl.Repo.IncrementClicksTx(tx, &ad); err != nil {
+			if err := ctrl.RepoLedger.AddEntriesTx(tx, ClickLedgerEntries(key, ad, publisher_id, eventRequest.Price)); err != nil {
 				return err
 			}
 		case "impression":
@@ -222,20 +281,28 @@ func (ctrl AdController) HandleEventAtomic(c *gin.Context) {
 		return nil
 	})
 
-	if err := ctrl.BreakAd(advertiser_id); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Braking failed"})
-		return 
+	if errors.Is(err, repositories.ErrInsufficientCredit) {
+		// A 4xx tells the sender not to retry: the click stays unbilled.
+		c.JSON(http.StatusConflict, gin.H{"error": "Insufficient credit"})
+		return
 	}
-
-
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process event"})
 		fmt.Println(err.Error())
-	} else {
-		c.JSON(http.StatusOK, gin.H{"message": "Event successfully processed"})
+		return
+	}
+	if duplicate {
+		c.JSON(http.StatusOK, gin.H{"message": "Event already processed"})
+		return
 	}
-}
 
+	// The event is billed by now: a failed brake must not make the sender think otherwise.
+	// Ads left active are braked again on the next click of the advertiser.
+	if err := ctrl.BreakAd(advertiser_id); err != nil {
+		log.Printf("Failed to brake the ads of advertiser %d: %v\n", advertiser_id, err)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Event successfully processed"})
+}
 
 func (ctrl AdController) GetAd(c *gin.Context) {
 	adID, err := strconv.Atoi(c.Param("id"))
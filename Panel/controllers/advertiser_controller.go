@@ -6,6 +6,7 @@ import (
 	"go-ad-panel/repositories"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 // type AdvertiserController struct {
@@ -28,7 +29,11 @@ func (ctrl AdvertiserController) AdvertiserPanel(c *gin.Context) {
 		c.HTML(http.StatusNotFound, "advertiser.html", gin.H{"notfounderror": "Advertiser not found"})
 		return
 	}
-	c.HTML(http.StatusOK, "advertiser.html", gin.H{"advertiser": advertiser, "ads": ads})
+	c.HTML(http.StatusOK, "advertiser.html", gin.H{
+		"advertiser": advertiser,
+		"ads":        ads,
+		"liveToken":  LiveToken("advertiser_id", advertiser.ID, time.Now()),
+	})
 }
 
 // IS Okey
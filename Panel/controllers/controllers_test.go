@@ -7,6 +7,7 @@ import (
     "net/url"
     "strings"
     "testing"
+    "time"
     "bytes"
 
     "github.com/gin-gonic/gin"
@@ -117,6 +118,7 @@ func TestPublisherPanel(t *testing.T) {
         router.ServeHTTP(w, req)
         assert.Equal(t, http.StatusOK, w.Code)
         assert.Contains(t, w.Body.String(), "Test Publisher")
+        assert.Contains(t, w.Body.String(), `data-publisher-id="15"`)
     })
 
     t.Run("Invalid ID", func(t *testing.T) {
@@ -259,6 +261,25 @@ func TestPublisherWithdraw(t *testing.T) {
         assert.Equal(t, http.StatusOK, w.Code)
         assert.Contains(t, w.Body.String(), "Withdrawal Successful")
     })
+
+    t.Run("Payout Hold", func(t *testing.T) {
+        mockRepo := new(MockPublisherRepository)
+        ctrl := PublisherController{Repo: mockRepo}
+        router := gin.Default()
+        router.LoadHTMLFiles("../templates/publisher.html")
+        router.POST("/publishers/:id/withdraw", ctrl.PublisherWithdraw)
+        publisher := models.Publisher{Model: gorm.Model{ID: 1}, Credit: 100, PayoutHold: true}
+        mockRepo.On("FindByID", uint(1)).Return(publisher, nil)
+        w := httptest.NewRecorder()
+        form := url.Values{}
+        form.Set("amount", "50")
+        req, _ := http.NewRequest("POST", "/publishers/1/withdraw", strings.NewReader(form.Encode()))
+        req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+        router.ServeHTTP(w, req)
+        assert.Equal(t, http.StatusForbidden, w.Code)
+        assert.Contains(t, w.Body.String(), "Payouts are on hold")
+        mockRepo.AssertNotCalled(t, "Update", mock.Anything)
+    })
 }
 
 
@@ -326,6 +347,8 @@ func TestAdvertiserPanel(t *testing.T) {
 		assert.Contains(t, w.Body.String(), "Test Advertiser")
 		assert.Contains(t, w.Body.String(), "Ad 1")
 		assert.Contains(t, w.Body.String(), "Ad 2")
+		assert.Contains(t, w.Body.String(), `<tr data-ad-id="2">`)
+		assert.Contains(t, w.Body.String(), `data-advertiser-id="1"`)
 	})
 }
 
@@ -410,3 +433,184 @@ func TestChargeAdvertiser(t *testing.T) {
 
 // ---------------------------------------------------------------ChargeAdvertiser----------------------------------------------------------------
 
+func TestNormalizeRedirectLink(t *testing.T) {
+	valid := map[string]string{
+		"HTTP://Shop.Example.COM./a?b=c":               "http://shop.example.com/a?b=c",
+		"https://example.com:443/landing":              "https://example.com/landing",
+		"https://example.com:8443/landing":             "https://example.com:8443/landing",
+		"https://bücher.example/":                      "https://xn--bcher-kva.example/",
+		"https://example.com/{ad_id}?pub={publisher_id}&c={click_id}": "https://example.com/{ad_id}?pub={publisher_id}&c={click_id}",
+	}
+	for link, expected := range valid {
+		normalized, err := NormalizeRedirectLink(link, "")
+		assert.Nil(t, err, link)
+		assert.Equal(t, expected, normalized)
+	}
+
+	invalid := map[string]error{
+		"javascript:alert(1)":               ErrRedirectScheme,
+		"ftp://example.com":                 ErrRedirectScheme,
+		"//example.com":                     ErrRedirectScheme,
+		"https://user@evil.com":             ErrRedirectHost,
+		"https:///path":                     ErrRedirectHost,
+		"https://example.com/{campaign}":    ErrRedirectMacro,
+		"https://exa mple.com":              ErrRedirectHost,
+	}
+	for link, expected := range invalid {
+		_, err := NormalizeRedirectLink(link, "")
+		assert.Equal(t, expected, err, link)
+	}
+
+	_, err := NormalizeRedirectLink("https://shop.example.com", "example.com, example.org")
+	assert.Nil(t, err)
+	_, err = NormalizeRedirectLink("https://example.com.evil.com", "example.com")
+	assert.Equal(t, ErrRedirectNotAllow, err)
+}
+
+
+// ---------------------------------------------------------------NormalizeRedirectLink----------------------------------------------------------------
+
+func TestClickLedgerEntries(t *testing.T) {
+	ad := models.Ad{Model: gorm.Model{ID: 5}, BidValue: 150, AdvertiserID: 3} // Bid raised since the click was served at 120.
+	entries := ClickLedgerEntries("event-1", ad, 7, 120)
+
+	assert.Len(t, entries, 2)
+	total := 0
+	for _, entry := range entries {
+		assert.Equal(t, "event-1", entry.IdempotencyKey)
+		assert.Equal(t, 5, entry.AdID)
+		total += entry.Amount
+	}
+	assert.Equal(t, 0, total)
+	assert.Equal(t, models.LedgerAdvertiser, entries[0].AccountType)
+	assert.Equal(t, 3, entries[0].AccountID)
+	assert.Equal(t, -120, entries[0].Amount)
+	assert.Equal(t, models.LedgerPublisher, entries[1].AccountType)
+	assert.Equal(t, 7, entries[1].AccountID)
+}
+
+func TestHandleEventRequiresIdempotencyKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctrl := AdController{}
+	router := gin.Default()
+	router.POST("/api/v1/ads/:id/event", ctrl.HandleEventAtomic)
+
+	body := bytes.NewBufferString(`{"event_type": "click", "publisher_id": "7"}`)
+	req, _ := http.NewRequest(http.MethodPost, "/api/v1/ads/5/event", body)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), IdempotencyKeyHeader)
+}
+
+func TestHandleEventRequiresClickPrice(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctrl := AdController{}
+	router := gin.Default()
+	router.POST("/api/v1/ads/:id/event", ctrl.HandleEventAtomic)
+
+	body := bytes.NewBufferString(`{"event_type": "click", "publisher_id": "7"}`)
+	req, _ := http.NewRequest(http.MethodPost, "/api/v1/ads/5/event", body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(IdempotencyKeyHeader, "event-1")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Invalid price")
+}
+
+
+// ---------------------------------------------------------------HandleEventAtomic----------------------------------------------------------------
+
+func TestSetPublisherQuality(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	send := func(mockRepo *MockPublisherRepository, body string) *httptest.ResponseRecorder {
+		ctrl := PublisherController{Repo: mockRepo}
+		router := gin.Default()
+		router.PUT("/api/v1/publishers/:id/quality", ctrl.SetPublisherQuality)
+		req, _ := http.NewRequest(http.MethodPut, "/api/v1/publishers/7/quality", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Flagged Traffic Holds Payouts", func(t *testing.T) {
+		mockRepo := new(MockPublisherRepository)
+		mockRepo.On("FindByID", uint(7)).Return(models.Publisher{Model: gorm.Model{ID: 7}}, nil)
+		var saved models.Publisher
+		mockRepo.On("Update", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+			saved = *args.Get(0).(*models.Publisher)
+		})
+		w := send(mockRepo, `{"score": 55.5, "status": "review"}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, 55.5, saved.QualityScore)
+		assert.Equal(t, models.QualityReview, saved.QualityStatus)
+		assert.True(t, saved.PayoutHold)
+	})
+
+	t.Run("Good Score Keeps Hold Until Review", func(t *testing.T) {
+		mockRepo := new(MockPublisherRepository)
+		mockRepo.On("FindByID", uint(7)).Return(models.Publisher{Model: gorm.Model{ID: 7}, PayoutHold: true}, nil)
+		var saved models.Publisher
+		mockRepo.On("Update", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+			saved = *args.Get(0).(*models.Publisher)
+		})
+		w := send(mockRepo, `{"score": 98, "status": "ok"}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, models.QualityOK, saved.QualityStatus)
+		assert.True(t, saved.PayoutHold)
+	})
+
+	t.Run("Unknown Status", func(t *testing.T) {
+		mockRepo := new(MockPublisherRepository)
+		w := send(mockRepo, `{"score": 10, "status": "banned"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		mockRepo.AssertNotCalled(t, "Update", mock.Anything)
+	})
+}
+
+
+// ---------------------------------------------------------------SetPublisherQuality----------------------------------------------------------------
+
+func TestReleasePayoutHold(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mockRepo := new(MockPublisherRepository)
+	ctrl := PublisherController{Repo: mockRepo}
+	router := gin.Default()
+	router.POST("/api/v1/publishers/:id/payout-hold/release", ctrl.ReleasePayoutHold)
+	mockRepo.On("FindByID", uint(7)).Return(models.Publisher{Model: gorm.Model{ID: 7}, QualityStatus: models.QualityReview, PayoutHold: true}, nil)
+	var saved models.Publisher
+	mockRepo.On("Update", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		saved = *args.Get(0).(*models.Publisher)
+	})
+
+	req, _ := http.NewRequest(http.MethodPost, "/api/v1/publishers/7/payout-hold/release", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, saved.PayoutHold)
+	assert.Equal(t, models.QualityReview, saved.QualityStatus)
+}
+
+
+// ---------------------------------------------------------------ReleasePayoutHold----------------------------------------------------------------
+
+func TestLiveToken(t *testing.T) {
+	now := time.Unix(1714557600, 0)
+
+	t.Setenv("LIVE_TOKEN_SECRET", "")
+	assert.Equal(t, "", LiveToken("advertiser_id", 5, now))
+
+	t.Setenv("LIVE_TOKEN_SECRET", "secret")
+	token := LiveToken("advertiser_id", 5, now)
+	parts := strings.Split(token, ".")
+	assert.Len(t, parts, 4)
+	assert.Equal(t, []string{"advertiser_id", "5", fmt.Sprint(now.Add(LiveTokenValidity).Unix())}, parts[:3])
+	assert.NotEqual(t, token, LiveToken("advertiser_id", 6, now))
+}
@@ -0,0 +1,33 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	"go-ad-panel/repositories"
+	"net/http"
+	"strconv"
+)
+
+type LedgerController struct {
+	Repo repositories.LedgerRepository
+}
+
+// Sends the billed clicks of each ad for the clicks that happened in [from, to), given as Unix seconds.
+func (ctrl LedgerController) GetBilledClicks(c *gin.Context) {
+	from, err := strconv.ParseInt(c.Query("from"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from"})
+		return
+	}
+	to, err := strconv.ParseInt(c.Query("to"), 10, 64)
+	if err != nil || to <= from {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to"})
+		return
+	}
+
+	billed, err := ctrl.Repo.BilledClicksBetween(from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, billed)
+}
@@ -0,0 +1,26 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+)
+
+// How long the live counters of a page keep working after it was rendered.
+const LiveTokenValidity = 12 * time.Hour
+
+// LiveToken signs the reporter's live feed for one advertiser_id or publisher_id,
+// with the LIVE_TOKEN_SECRET the reporter shares. Without a secret, there is no token.
+func LiveToken(dimension string, id uint, now time.Time) string {
+	secret := os.Getenv("LIVE_TOKEN_SECRET")
+	if secret == "" {
+		return ""
+	}
+	payload := fmt.Sprintf("%s.%d.%d", dimension, id, now.Add(LiveTokenValidity).Unix())
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return payload + "." + hex.EncodeToString(mac.Sum(nil))
+}
@@ -7,6 +7,7 @@ import (
 	"go-ad-panel/repositories"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 // type PublisherController struct {
@@ -29,7 +30,10 @@ func (ctrl PublisherController) PublisherPanel(c *gin.Context) {
 		c.HTML(http.StatusNotFound, "publisher.html", gin.H{"notfounderror": "Publisher Not Found"})
 		return
 	}
-	c.HTML(http.StatusOK, "publisher.html", gin.H{"publisher": publisher})
+	c.HTML(http.StatusOK, "publisher.html", gin.H{
+		"publisher": publisher,
+		"liveToken": LiveToken("publisher_id", publisher.ID, time.Now()),
+	})
 }
 
 // IS Okey
@@ -45,6 +49,11 @@ func (ctrl PublisherController) PublisherWithdraw(c *gin.Context) {
 		return
 	}
 
+	if publisher.PayoutHold {
+		c.HTML(http.StatusForbidden, "publisher.html", gin.H{"publisher": publisher, "error": "Payouts are on hold pending a review of your traffic"})
+		return
+	}
+
 	amountStr := c.PostForm("amount")
 	amount, err := strconv.ParseFloat(amountStr, 64)
 	if err != nil || amount <= 0 {
@@ -94,7 +103,8 @@ func (ctrl PublisherController) UpdatePublisher(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
 		return
 	}
-	if _, err := ctrl.Repo.FindByID(uint(id)); err != nil {
+	current, err := ctrl.Repo.FindByID(uint(id))
+	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "publisher not found"})
 		return
 	}
@@ -104,6 +114,10 @@ func (ctrl PublisherController) UpdatePublisher(c *gin.Context) {
 		return
 	}
 	publisher.ID = uint(id)
+	// The quality and the hold are only changed by Reporter and by reviews.
+	publisher.QualityScore = current.QualityScore
+	publisher.QualityStatus = current.QualityStatus
+	publisher.PayoutHold = current.PayoutHold
 	if err := ctrl.Repo.Update(&publisher); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -135,3 +149,61 @@ func (ctrl PublisherController) GetAllPublishers(c *gin.Context) {
 	}
 	c.JSON(http.StatusOK, publishers)
 }
+
+type PublisherQualityRequest struct {
+	Score  float64 `json:"score"`
+	Status string  `json:"status" binding:"required,oneof=ok review excluded"`
+	Day    int64   `json:"day"` // Unix time at which the scored day starts.
+}
+
+// Records the quality score Reporter gave the traffic of a publisher. Payouts are held from the first
+// score that is not ok, until a review releases them.
+func (ctrl PublisherController) SetPublisherQuality(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var request PublisherQualityRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	publisher, err := ctrl.Repo.FindByID(uint(id))
+	if err != nil || publisher.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "publisher not found"})
+		return
+	}
+
+	publisher.QualityScore = request.Score
+	publisher.QualityStatus = request.Status
+	if request.Status != models.QualityOK {
+		publisher.PayoutHold = true
+	}
+	if err := ctrl.Repo.Update(&publisher); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, publisher)
+}
+
+// Releases the payouts of a publisher once its traffic was reviewed.
+func (ctrl PublisherController) ReleasePayoutHold(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	publisher, err := ctrl.Repo.FindByID(uint(id))
+	if err != nil || publisher.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "publisher not found"})
+		return
+	}
+
+	publisher.PayoutHold = false
+	if err := ctrl.Repo.Update(&publisher); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, publisher)
+}
@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Click macros the event server expands in redirect links.
+var redirectMacros = []string{"{publisher_id}", "{ad_id}", "{click_id}"}
+
+var (
+	ErrRedirectScheme   = errors.New("redirect link must use http or https")
+	ErrRedirectHost     = errors.New("redirect link must have a valid host")
+	ErrRedirectMacro    = errors.New("redirect link contains an unknown macro")
+	ErrRedirectNotAllow = errors.New("redirect link domain is not allowed for this advertiser")
+)
+
+/*
+NormalizeRedirectLink validates the redirect link of an ad and returns
+it in canonical form. Only http and https links with a plain host are
+accepted; the host is lowercased, converted to punycode and stripped of
+its default port. allowedDomains is the comma separated allow-list of
+the advertiser; when it is empty, any domain is accepted.
+*/
+func NormalizeRedirectLink(link string, allowedDomains string) (string, error) {
+	link = strings.TrimSpace(link)
+	if strings.ContainsAny(link, "\\ \t\r\n") {
+		return "", ErrRedirectHost
+	}
+	remaining := link
+	for _, macro := range redirectMacros {
+		remaining = strings.ReplaceAll(remaining, macro, "")
+	}
+	if strings.ContainsAny(remaining, "{}") {
+		return "", ErrRedirectMacro
+	}
+
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return "", ErrRedirectHost
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return "", ErrRedirectScheme
+	}
+	if parsed.User != nil || parsed.Opaque != "" {
+		return "", ErrRedirectHost
+	}
+
+	host, err := idna.Lookup.ToASCII(strings.TrimSuffix(strings.ToLower(parsed.Hostname()), "."))
+	if err != nil || host == "" {
+		return "", ErrRedirectHost
+	}
+	if !domainAllowed(host, allowedDomains) {
+		return "", ErrRedirectNotAllow
+	}
+
+	port := parsed.Port()
+	if (parsed.Scheme == "http" && port == "80") || (parsed.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	parsed.Host = host
+	if port != "" {
+		parsed.Host += ":" + port
+	}
+
+	// url.URL escapes the braces of macros in paths; put them back.
+	normalized := parsed.String()
+	for _, macro := range redirectMacros {
+		escaped := "%7B" + strings.Trim(macro, "{}") + "%7D"
+		normalized = strings.ReplaceAll(normalized, escaped, macro)
+	}
+	return normalized, nil
+}
+
+// domainAllowed reports whether host is one of the allowed domains, or a subdomain of one
+func domainAllowed(host string, allowedDomains string) bool {
+	if strings.TrimSpace(allowedDomains) == "" {
+		return true
+	}
+	for _, domain := range strings.Split(allowedDomains, ",") {
+		domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+		if domain != "" && (host == domain || strings.HasSuffix(host, "."+domain)) {
+			return true
+		}
+	}
+	return false
+}
@@ -14,7 +14,7 @@ func main() {
 	config.Connect()
 	config.Ping()
 
-	config.Migrate(&models.Publisher{}, &models.Advertiser{}, &models.Ad{})
+	config.Migrate(&models.Publisher{}, &models.Advertiser{}, &models.Ad{}, &models.BilledEvent{}, &models.LedgerEntry{})
 	router := routes.SetupRouter(config.DB)
 	router.Use(cors.Default())
 
@@ -6,5 +6,7 @@ type Advertiser struct {
 	gorm.Model
 	Name   string `gorm:"type:varchar(255)"`
 	Credit int    `gorm:"type:int"`
-	Ads    []Ad
+	// Comma separated domains the ads may redirect to; empty allows any domain.
+	AllowedDomains string `gorm:"type:varchar(1024)"`
+	Ads            []Ad
 }
@@ -0,0 +1,29 @@
+package models
+
+import "gorm.io/gorm"
+
+// Accounts a ledger entry can be booked on.
+const (
+	LedgerAdvertiser = "advertiser"
+	LedgerPublisher  = "publisher"
+)
+
+// An event applied by Panel, keyed by the idempotency key its sender gave it.
+type BilledEvent struct {
+	gorm.Model
+	IdempotencyKey string `gorm:"type:varchar(255);not null;uniqueIndex"`
+	AdID           int    `gorm:"type:int;not null;index"`
+	PublisherID    int    `gorm:"type:int;not null"`
+	EventType      string `gorm:"type:varchar(32);not null"`
+	EventTime      int64  `gorm:"not null;index"` // Unix time of the event itself.
+}
+
+// A movement of credit caused by a billed event. Debits are negative.
+type LedgerEntry struct {
+	gorm.Model
+	IdempotencyKey string `gorm:"type:varchar(255);not null;index"`
+	AccountType    string `gorm:"type:varchar(16);not null"`
+	AccountID      int    `gorm:"type:int;not null;index"`
+	AdID           int    `gorm:"type:int;not null"`
+	Amount         int    `gorm:"type:int;not null"`
+}
@@ -2,9 +2,19 @@ package models
 
 import "gorm.io/gorm"
 
+// Statuses of the traffic of a publisher, as scored by Reporter.
+const (
+	QualityOK       = "ok"
+	QualityReview   = "review"
+	QualityExcluded = "excluded"
+)
+
 type Publisher struct {
 	gorm.Model
-	Name    string `gorm:"type:varchar(255)"`
-	Website string `gorm:"type:varchar(255)"`
-	Credit  int    `gorm:"type:int"`
+	Name          string  `gorm:"type:varchar(255)"`
+	Website       string  `gorm:"type:varchar(255)"`
+	Credit        int     `gorm:"type:int"`
+	QualityScore  float64 `gorm:"type:float"`
+	QualityStatus string  `gorm:"type:varchar(32)"`
+	PayoutHold    bool    `gorm:"type:boolean;not null;default:false"` // Set when Reporter flags the traffic, cleared by a review.
 }
@@ -28,10 +28,10 @@ func (t AdRepository) IncrementImpressionsTx(tx *gorm.DB, ad *models.Ad) error {
 //	func (t AdRepository) IncrementClicksTx(tx *gorm.DB, ad *models.Ad) error {
 //		return tx.Model(ad).Update("Clicks", gorm.Expr("Clicks + ?", 1)).Error
 //	}
-func (t AdRepository) IncrementClicksTx(tx *gorm.DB, ad *models.Ad) error {
+func (t AdRepository) IncrementClicksTx(tx *gorm.DB, ad *models.Ad, price int) error {
 	return tx.Model(ad).Updates(map[string]interface{}{
 		"Clicks":        gorm.Expr("Clicks + ?", 1),
-		"EngagedCredit": gorm.Expr("engaged_credit + ?", ad.BidValue),
+		"EngagedCredit": gorm.Expr("engaged_credit + ?", price),
 	}).Error
 }
 
@@ -1,10 +1,14 @@
 package repositories
 
 import (
+	"errors"
 	"go-ad-panel/models"
 	"gorm.io/gorm"
 )
 
+// ErrInsufficientCredit is returned when a debit would leave an advertiser's credit negative.
+var ErrInsufficientCredit = errors.New("insufficient credit")
+
 // All functions is Okey
 
 type AdvertiserRepository struct {
@@ -61,7 +65,15 @@ func (t AdvertiserRepository) UpdateTx(tx *gorm.DB, advertiser *models.Advertise
 	return tx.Save(advertiser).Error
 }
 func (t AdvertiserRepository) DecreaseCredit(tx *gorm.DB, advertiser *models.Advertiser, bid int) error {
-	return tx.Model(advertiser).Update("Credit", gorm.Expr("Credit - ?", bid)).Error
+	// The balance is checked by the update itself, so that concurrent clicks cannot overdraw it.
+	result := tx.Model(advertiser).Where("credit >= ?", bid).Update("Credit", gorm.Expr("Credit - ?", bid))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInsufficientCredit
+	}
+	return nil
 }
 
 func (t AdvertiserRepository) GetAdvertiserCredit(id uint) (int, error) {
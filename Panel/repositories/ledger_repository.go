@@ -0,0 +1,41 @@
+package repositories
+
+import (
+	"go-ad-panel/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type LedgerRepository struct {
+	Db *gorm.DB
+}
+
+// Billed clicks of an ad, and what its advertiser was debited for them.
+type BilledClicks struct {
+	AdID   int   `json:"ad_id"`
+	Clicks int64 `json:"clicks"`
+	Debit  int64 `json:"debit"`
+}
+
+// Records an event, and tells whether it was new. An event already recorded under the same key is left as it is.
+func (t LedgerRepository) RecordEventTx(tx *gorm.DB, event *models.BilledEvent) (bool, error) {
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(event)
+	return result.RowsAffected == 1, result.Error
+}
+
+func (t LedgerRepository) AddEntriesTx(tx *gorm.DB, entries []models.LedgerEntry) error {
+	return tx.Create(&entries).Error
+}
+
+// Sums the billed clicks per ad, for the clicks that happened in [from, to).
+func (t LedgerRepository) BilledClicksBetween(from, to int64) ([]BilledClicks, error) {
+	var billed []BilledClicks
+	result := t.Db.Table("billed_events").
+		Select("billed_events.ad_id, COUNT(DISTINCT billed_events.id) AS clicks, -COALESCE(SUM(ledger_entries.amount), 0) AS debit").
+		Joins("LEFT JOIN ledger_entries ON ledger_entries.idempotency_key = billed_events.idempotency_key AND ledger_entries.account_type = ? AND ledger_entries.deleted_at IS NULL", models.LedgerAdvertiser).
+		Where("billed_events.event_type = ? AND billed_events.event_time >= ? AND billed_events.event_time < ? AND billed_events.deleted_at IS NULL", "click", from, to).
+		Group("billed_events.ad_id").
+		Order("billed_events.ad_id").
+		Scan(&billed)
+	return billed, result.Error
+}
@@ -1,6 +1,11 @@
 package routes
 
 import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+
 	"github.com/zsais/go-gin-prometheus"
 
 	"github.com/gin-gonic/gin"
@@ -25,6 +30,21 @@ func CORSMiddleware() gin.HandlerFunc {
 	}
 }
 
+/*
+AdminAuth only lets through requests bearing ADMIN_TOKEN. Without a
+token configured, the routes it guards are closed.
+*/
+func AdminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		given := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
+
 func SetupRouter(db *gorm.DB) *gin.Engine {
 	router := gin.Default()
 	p := ginprometheus.NewPrometheus("panel")
@@ -44,7 +64,9 @@ func SetupRouter(db *gorm.DB) *gin.Engine {
 
 	// Ad setup
 	adRepo := repositories.AdRepository{Db: db}
-	adController := controllers.AdController{Repo: adRepo, RepoAdvertiser: advertiserRepo, RepoPublisher: publisherRepo}
+	ledgerRepo := repositories.LedgerRepository{Db: db}
+	adController := controllers.AdController{Repo: adRepo, RepoAdvertiser: advertiserRepo, RepoPublisher: publisherRepo, RepoLedger: ledgerRepo}
+	ledgerController := controllers.LedgerController{Repo: ledgerRepo}
 
 	router.GET("/publishers/:id", publisherController.PublisherPanel)
 	router.GET("/advertisers/:id", advertiserController.AdvertiserPanel)
@@ -64,6 +86,9 @@ func SetupRouter(db *gorm.DB) *gin.Engine {
 			publishers.PUT("/:id", publisherController.UpdatePublisher)
 			publishers.DELETE("/:id", publisherController.DeletePublisher)
 			publishers.GET("", publisherController.GetAllPublishers)
+			// Set by the reporter and released by staff, never by the publisher itself.
+			publishers.PUT("/:id/quality", AdminAuth(os.Getenv("ADMIN_TOKEN")), publisherController.SetPublisherQuality)
+			publishers.POST("/:id/payout-hold/release", AdminAuth(os.Getenv("ADMIN_TOKEN")), publisherController.ReleasePayoutHold)
 		}
 
 		// Advertiser routes
@@ -79,7 +104,14 @@ func SetupRouter(db *gorm.DB) *gin.Engine {
 		ads := v1.Group("/ads")
 		{
 			ads.GET("/active", adController.GetAllActiveAds)
-			ads.POST("/:id/event", adController.HandleEventAtomic)
+			// Events are billed, so only the reporter may post them.
+			ads.POST("/:id/event", AdminAuth(os.Getenv("ADMIN_TOKEN")), adController.HandleEventAtomic)
+		}
+
+		// Ledger routes, read by the reporter only
+		ledger := v1.Group("/ledger", AdminAuth(os.Getenv("ADMIN_TOKEN")))
+		{
+			ledger.GET("/clicks", ledgerController.GetBilledClicks)
 		}
 	}
 
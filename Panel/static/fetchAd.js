@@ -1,12 +1,50 @@
 (function () {
   const publisherID = document.currentScript.getAttribute('id');
+  const consentAttribute = document.currentScript.getAttribute('data-consent');
   const adContainer = document.getElementById('adBox');
   if (!adContainer) {
     console.error('Ad container element not found.');
     return;
   }
-  function fetchAd() {
-    fetch(`https://adserver.lontra.tech/api/ads?publisherID=${publisherID}`)
+  // Consent comes from the page's TCF CMP when there is one, else from the data-consent attribute.
+  function getConsent(callback) {
+    if (typeof window.__tcfapi === 'function') {
+      window.__tcfapi('getTCData', 2, (tcData, success) => {
+        if (success && tcData && tcData.tcString) {
+          const purposes = (tcData.purpose && tcData.purpose.consents) || {};
+          callback({ tcString: tcData.tcString, granted: !!purposes[1] });
+        } else {
+          callback({ granted: false });
+        }
+      });
+      return;
+    }
+    callback({ granted: consentAttribute === '1' || consentAttribute === 'true' });
+  }
+  // A first-party viewer ID, only ever created once the viewer consented.
+  function getViewerID() {
+    try {
+      let viewerID = localStorage.getItem('adViewerID');
+      if (!viewerID) {
+        viewerID = crypto.randomUUID();
+        localStorage.setItem('adViewerID', viewerID);
+      }
+      return viewerID;
+    } catch (error) {
+      return '';
+    }
+  }
+  function fetchAd(consent) {
+    const params = new URLSearchParams({ publisherID: publisherID });
+    if (consent.tcString) {
+      params.set('gdpr_consent', consent.tcString);
+    } else {
+      params.set('consent', consent.granted ? '1' : '0');
+    }
+    if (consent.granted) {
+      params.set('viewerID', getViewerID());
+    }
+    fetch(`https://adserver.lontra.tech/api/ads?${params}`)
       .then(response => response.json())
       .then(data => {
         if (data) {
@@ -24,6 +62,9 @@
             }
           }, { threshold: 1.0 });
           observer.observe(adContainer);
+          if (ad.ViewableLink) {
+            trackViewability(ad.ViewableLink);
+          }
         } else {
           adContainer.innerHTML = '<div class="ad-content">No ad available</div>';
         }
@@ -33,6 +74,82 @@
         adContainer.innerHTML = '<div class="ad-content">Error loading ad</div>';
       });
   }
+  // MRC viewability: at least 50% of the ad's pixels in view for 1 continuous second.
+  // The viewable event is sent as soon as that second is reached; the time in view after it
+  // is sent as extra reports when the page is hidden or left.
+  function trackViewability(viewableLink) {
+    const MIN_VISIBLE_RATIO = 0.5;
+    const MIN_VIEW_MS = 1000;
+    let inViewSince = null;
+    let inViewMs = 0;
+    let reportedMs = 0;
+    let viewable = false;
+    let viewableTimer = null;
+
+    function send(url) {
+      if (!navigator.sendBeacon || !navigator.sendBeacon(url)) {
+        fetch(url, { method: 'POST', keepalive: true });
+      }
+    }
+    function currentInViewMs() {
+      return inViewMs + (inViewSince === null ? 0 : performance.now() - inViewSince);
+    }
+    function reportViewable() {
+      viewableTimer = null;
+      if (viewable || inViewSince === null) {
+        return;
+      }
+      viewable = true;
+      reportedMs = Math.round(currentInViewMs());
+      send(`${viewableLink}?duration=${reportedMs}`);
+    }
+    function leaveView() {
+      clearTimeout(viewableTimer);
+      viewableTimer = null;
+      if (inViewSince === null) {
+        return;
+      }
+      inViewMs += performance.now() - inViewSince;
+      inViewSince = null;
+    }
+    function enterView() {
+      if (inViewSince === null && document.visibilityState === 'visible') {
+        inViewSince = performance.now();
+        if (!viewable) {
+          viewableTimer = setTimeout(reportViewable, MIN_VIEW_MS);
+        }
+      }
+    }
+    function reportExtra() {
+      leaveView();
+      const extraMs = Math.round(inViewMs) - reportedMs;
+      if (!viewable || extraMs <= 0) {
+        return;
+      }
+      reportedMs += extraMs;
+      send(`${viewableLink}?duration=${extraMs}&extra=1`);
+    }
+
+    let visibleRatio = 0;
+    const viewObserver = new IntersectionObserver((entries) => {
+      visibleRatio = entries[0].intersectionRatio;
+      if (visibleRatio >= MIN_VISIBLE_RATIO) {
+        enterView();
+      } else {
+        leaveView();
+      }
+    }, { threshold: [0, MIN_VISIBLE_RATIO, 1.0] });
+    viewObserver.observe(adContainer);
+
+    document.addEventListener('visibilitychange', () => {
+      if (document.visibilityState === 'hidden') {
+        reportExtra();
+      } else if (visibleRatio >= MIN_VISIBLE_RATIO) {
+        enterView();
+      }
+    });
+    window.addEventListener('pagehide', reportExtra);
+  }
   function placeAd() {
     const paragraphs = document.getElementsByTagName('p');
     if (paragraphs.length > 0) {
@@ -42,6 +159,6 @@
       document.body.appendChild(adContainer);
     }
   }
-  fetchAd();
+  getConsent(fetchAd);
   placeAd();
 })();
\ No newline at end of file
@@ -0,0 +1,102 @@
+(function () {
+  const script = document.currentScript;
+  const reporter = script.getAttribute('data-reporter') || 'https://reporter.lontra.tech';
+  const advertiserID = script.getAttribute('data-advertiser-id');
+  const publisherID = script.getAttribute('data-publisher-id');
+  // Signed by Panel for this page's advertiser or publisher, since EventSource cannot send headers.
+  const liveToken = script.getAttribute('data-live-token') || '';
+  const WINDOW = 60;
+  const loadedAt = Math.floor(Date.now() / 1000);
+  // Ticks are per second; a reconnection sends the last minute again, which is skipped.
+  let lastTime = 0;
+
+  function calculateCTR(clicks, impressions) {
+    if (impressions === 0) {
+      return '0 %';
+    }
+    return ((clicks / impressions) * 100).toFixed(2) + ' %';
+  }
+  function setStatus(text) {
+    const status = document.getElementById('liveStatus');
+    if (status) {
+      status.textContent = text;
+    }
+  }
+
+  // The advertiser page counts each ad's events since it was rendered into its row.
+  function addToAdRows(tick) {
+    if (tick.time < loadedAt) {
+      return;
+    }
+    tick.counts.forEach((count) => {
+      const row = document.querySelector('#adTable tr[data-ad-id="' + count.ad_id + '"]');
+      if (!row) {
+        return;
+      }
+      const impressions = row.querySelector('.impressions');
+      const clicks = row.querySelector('.clicks');
+      impressions.textContent = parseInt(impressions.textContent, 10) + count.impressions;
+      clicks.textContent = parseInt(clicks.textContent, 10) + count.clicks;
+      row.querySelector('.ctr').textContent = calculateCTR(
+        parseInt(clicks.textContent, 10),
+        parseInt(impressions.textContent, 10)
+      );
+    });
+  }
+
+  // The publisher page shows the last minute, and the events since it was opened.
+  const lastMinute = [];
+  const sinceOpened = { impressions: 0, clicks: 0 };
+  function addToPublisherTraffic(tick) {
+    const total = { time: tick.time, impressions: 0, clicks: 0 };
+    tick.counts.forEach((count) => {
+      total.impressions += count.impressions;
+      total.clicks += count.clicks;
+    });
+    lastMinute.push(total);
+    while (lastMinute.length > 0 && lastMinute[0].time <= tick.time - WINDOW) {
+      lastMinute.shift();
+    }
+    if (tick.time >= loadedAt) {
+      sinceOpened.impressions += total.impressions;
+      sinceOpened.clicks += total.clicks;
+    }
+    const minute = lastMinute.reduce(
+      (sum, second) => ({ impressions: sum.impressions + second.impressions, clicks: sum.clicks + second.clicks }),
+      { impressions: 0, clicks: 0 }
+    );
+    document.getElementById('liveMinuteImpressions').textContent = minute.impressions;
+    document.getElementById('liveMinuteClicks').textContent = minute.clicks;
+    document.getElementById('liveOpenedImpressions').textContent = sinceOpened.impressions;
+    document.getElementById('liveOpenedClicks').textContent = sinceOpened.clicks;
+  }
+
+  let params, onTick;
+  if (advertiserID) {
+    params = new URLSearchParams({ advertiser_id: advertiserID, token: liveToken });
+    onTick = addToAdRows;
+  } else if (publisherID) {
+    params = new URLSearchParams({ publisher_id: publisherID, token: liveToken });
+    onTick = addToPublisherTraffic;
+  } else {
+    console.error('data-advertiser-id or data-publisher-id is required.');
+    return;
+  }
+  if (typeof EventSource !== 'function') {
+    setStatus('unavailable');
+    return;
+  }
+
+  const source = new EventSource(reporter + '/live?' + params.toString());
+  source.onopen = () => setStatus('live');
+  // The browser gives up on refused connections, an expired token for instance.
+  source.onerror = () => setStatus(source.readyState === EventSource.CLOSED ? 'unavailable' : 'reconnecting');
+  source.addEventListener('counts', (event) => {
+    const tick = JSON.parse(event.data);
+    if (tick.time <= lastTime) {
+      return;
+    }
+    lastTime = tick.time;
+    onTick(tick);
+  });
+})();
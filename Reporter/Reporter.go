@@ -1,12 +1,13 @@
 package main
 
 import (
-	"bytes"
-	"context"
 	"encoding/json"
+	"eventschema"
 	"fmt"
 	"log"
-	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/robfig/cron"
 	"github.com/segmentio/kafka-go"
@@ -19,52 +20,39 @@ var db *gorm.DB
 const BROKER_ADDRESS = "95.217.125.140:29092"
 const TOPIC = "test"
 const GROUP_ID = "reporter_group"
+const DEAD_LETTER_TOPIC = "test-dead-letter"
 
-type Event struct {
-	gorm.Model
-	EventType string `json:"EventType" gorm:"column:event_type"`
-	AdID      string `json:"AdID" gorm:"column:ad_id"`
-	//	AdvertiserID string    `json:"advertiser_id" gorm:"column:advertiser_id"`
-	PublisherID string `json:"PublisherID" gorm:"column:publisher_id"`
-	//	Credit       int       `json:"Credit" gorm:"column:credit"`
-	Time int64 `json:"Time" gorm:"column:time"`
-}
+/*
+A message whose event cannot be stored after this many attempts is
+dead-lettered, unless the store is out of reach, which is waited out.
+*/
+const MAX_PROCESS_ATTEMPTS = 5
+const PROCESS_RETRY_BACKOFF = time.Second
+const PROCESS_MAX_BACKOFF = time.Minute
 
-type AggregatedData struct {
+/* JSON tags describe the legacy, pre-schema format of events. */
+type Event struct {
 	gorm.Model
-	AdID        string `gorm:"column:ad_id"`
-	Clicks      string `gorm:"column:clicks"`
-	Impressions string `gorm:"column:impressions"`
-	//	Credit      string       `gorm:"column:credit"`
-	Time int64 `gorm:"column:time"`
-}
-
-// callInternalAPI simulates calling an internal API to handle the click
-func callAPI(event Event) error {
-	url := fmt.Sprintf("https://panel.lontra.tech/api/v1/ads/%s/event", event.AdID)
-	payload := map[string]interface{}{
-		"publisher_id": event.PublisherID,
-		"event_type":   event.EventType,
-	}
-	body, _ := json.Marshal(payload)
-
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(body))
-	if err != nil {
-		return fmt.Errorf("failed to marshal payload: %v", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("request failed: %v", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("received non-200 response: %d", resp.StatusCode)
-	}
-	fmt.Println("stat was 200")
-	return nil
+	EventID      string `json:"-" gorm:"column:event_id;uniqueIndex:idx_events_event_id_unique,where:event_id <> ''"`
+	EventType    string `json:"EventType" gorm:"column:event_type"`
+	AdID         string `json:"AdID" gorm:"column:ad_id"`
+	AdvertiserID string `json:"AdvertiserID" gorm:"column:advertiser_id"`
+	PublisherID  string `json:"PublisherID" gorm:"column:publisher_id"`
+	Price        int64  `json:"Price" gorm:"column:price"`
+	Time         int64  `json:"Time" gorm:"column:time"`
+	ClientIPHash string `json:"-" gorm:"column:client_ip_hash;index"`
+	UserAgent    string `json:"-" gorm:"column:user_agent"`
+	FraudScore   uint32 `json:"-" gorm:"column:fraud_score"`
+	NotBillable  bool   `json:"-" gorm:"column:not_billable"`
+	FraudReasons string `json:"-" gorm:"column:fraud_reasons"` // Comma separated.
+	ResponseID   string `json:"-" gorm:"column:response_id"`
+	OrphanClick  bool   `json:"-" gorm:"column:orphan_click"`
+	InViewMs     int64  `json:"-" gorm:"column:in_view_ms"`
+	ClickID      string `json:"-" gorm:"column:click_id;index"`
+	ConversionID string `json:"-" gorm:"column:conversion_id"`
+	Value        int64  `json:"-" gorm:"column:value"` // Conversion value reported by the advertiser.
+	Consent      bool   `json:"-" gorm:"column:consent"`
+	ViewerHash   string `json:"-" gorm:"column:viewer_hash;index"` // Empty without consent.
 }
 
 func setupKafkaReader() *kafka.Reader {
@@ -78,108 +66,158 @@ func setupKafkaReader() *kafka.Reader {
 	})
 }
 
-func consumeEvents(reader *kafka.Reader) {
-	defer reader.Close()
-
-	for {
-		fmt.Println("Reading a new message ...")
-		msg, err := reader.ReadMessage(context.Background())
-		fmt.Printf("New message is read: %v\n", msg)
-		if err != nil {
-			log.Printf("could not read message: %v", err)
-			continue
+/*
+Decodes a Kafka message into an Event. Messages carrying a schema
+version header are encoded with the shared event schema; those without
+it were produced before the schema existed and hold plain JSON.
+*/
+func decodeEvent(msg kafka.Message) (*Event, error) {
+	if !hasHeader(msg, eventschema.VERSION_HEADER) {
+		event := &Event{}
+		if err := json.Unmarshal(msg.Value, event); err != nil {
+			return nil, err
 		}
-		processEvent(msg.Value)
+		return event, nil
 	}
-}
 
-func processEvent(eventData []byte) {
-	// Unmarshal the event data
-	event := &Event{}
-	if err := json.Unmarshal(eventData, event); err != nil {
-		log.Printf("could not unmarshal event: %v", err)
-		return
-	}
-
-	//Added api call here instead of eventserver
-	if err := callAPI(*event); err != nil {
-		log.Printf("Failed to call API for an event: %v\n", err)
+	schemaEvent, err := eventschema.Unmarshal(msg.Value)
+	if err != nil {
+		return nil, err
 	}
+	return fromSchemaEvent(schemaEvent), nil
+}
 
-	if err := insertEventIntoDB(event); err != nil {
-		log.Printf("could not insert event into DB: %v", err)
-		return
+// fromSchemaEvent converts an event of the shared schema to the stored Event
+func fromSchemaEvent(schemaEvent *eventschema.Event) *Event {
+	return &Event{
+		EventID:      schemaEvent.EventID,
+		EventType:    schemaEvent.Type,
+		AdID:         schemaEvent.AdID,
+		AdvertiserID: schemaEvent.AdvertiserID,
+		PublisherID:  schemaEvent.PublisherID,
+		Price:        schemaEvent.Price,
+		Time:         schemaEvent.Timestamp,
+		ClientIPHash: schemaEvent.ClientIPHash,
+		UserAgent:    schemaEvent.UserAgent,
+		FraudScore:   schemaEvent.FraudScore,
+		NotBillable:  schemaEvent.NotBillable,
+		FraudReasons: strings.Join(schemaEvent.FraudReasons, ","),
+		ResponseID:   schemaEvent.ResponseID,
+		OrphanClick:  schemaEvent.OrphanClick,
+		InViewMs:     schemaEvent.InViewMs,
+		ClickID:      schemaEvent.ClickID,
+		ConversionID: schemaEvent.ConversionID,
+		Value:        schemaEvent.Value,
+		Consent:      schemaEvent.Consent,
+		ViewerHash:   schemaEvent.ViewerHash,
 	}
-
-	// Log successful insertion
-	log.Printf("Inserted event into DB: %v, AdID: %v, EventType: %v", event.Time, event.AdID, event.EventType)
-
 }
 
-func insertEventIntoDB(event *Event) error {
-
-	// GORM: Insert the event into the database
-	result := db.Create(event)
-	return result.Error
-
+// toSchemaEvent converts a stored Event back to the shared schema
+func toSchemaEvent(event *Event) *eventschema.Event {
+	var fraudReasons []string
+	if event.FraudReasons != "" {
+		fraudReasons = strings.Split(event.FraudReasons, ",")
+	}
+	return &eventschema.Event{
+		EventID:       event.EventID,
+		Type:          event.EventType,
+		AdID:          event.AdID,
+		AdvertiserID:  event.AdvertiserID,
+		PublisherID:   event.PublisherID,
+		Price:         event.Price,
+		Timestamp:     event.Time,
+		ClientIPHash:  event.ClientIPHash,
+		UserAgent:     event.UserAgent,
+		SchemaVersion: eventschema.SCHEMA_VERSION,
+		FraudScore:    event.FraudScore,
+		NotBillable:   event.NotBillable,
+		FraudReasons:  fraudReasons,
+		ResponseID:    event.ResponseID,
+		OrphanClick:   event.OrphanClick,
+		InViewMs:      event.InViewMs,
+		ClickID:       event.ClickID,
+		ConversionID:  event.ConversionID,
+		Value:         event.Value,
+		Consent:       event.Consent,
+		ViewerHash:    event.ViewerHash,
+	}
 }
 
-func aggregateData() {
-	var results []struct {
-		AdID        string
-		Clicks      string
-		Impressions string
-		//	Credit      string
-		Time int64
-	}
-	// Query to aggregate data using GORM
-	db.Table("events").
-		Select("ad_id, " +
-			"SUM(CASE WHEN event_type = 'click' THEN 1 ELSE 0 END) as clicks, " +
-			"SUM(CASE WHEN event_type = 'impression' THEN 1 ELSE 0 END) as impressions, " +
-			"SUM(credit) as credit, " +
-			"DATE_TRUNC('hour', time) as time").
-		Group("ad_id, DATE_TRUNC('hour', time)").
-		Order("time").
-		Scan(&results)
-
-	// Insert aggregated data into the new table
-	for _, result := range results {
-		aggregatedData := AggregatedData{
-			AdID:        result.AdID,
-			Clicks:      result.Clicks,
-			Impressions: result.Impressions,
-			//	Credit:      result.Credit,
-			Time: result.Time,
+func hasHeader(msg kafka.Message, key string) bool {
+	for _, header := range msg.Headers {
+		if header.Key == key {
+			return true
 		}
-		db.Create(&aggregatedData)
 	}
+	return false
+}
+
+// messageEventID identifies the events of legacy messages, which carry no event ID, by their offset
+func messageEventID(msg kafka.Message) string {
+	return fmt.Sprintf("%s/%d/%d", msg.Topic, msg.Partition, msg.Offset)
 }
 
 func main() {
-	// GORM: Initialize the database connection
-	var err error
-	CreateDBIfNotExists()
+	command, args := "consume", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	run, ok := commands[command]
+	if !ok {
+		fmt.Fprint(os.Stderr, USAGE)
+		os.Exit(2)
+	}
 
-	db, err = ConnectToDB()
+	// GORM: Initialize the event store
+	var err error
+	store, err = openEventStore()
 	if err != nil {
 		log.Fatalf("failed to connect database: %v", err)
 	}
+	db = store.DB()
+
 	// GORM: Auto Migrate the schema
-	err = db.AutoMigrate(&Event{})
+	err = store.Migrate()
 
 	if err != nil {
 		log.Fatalf("failed to auto migrate: %v", err)
 	}
-	err = db.AutoMigrate(&AggregatedData{})
 
-	if err != nil {
-		log.Fatalf("failed to auto migrate: %v", err)
+	if err := run(args); err != nil {
+		log.Fatalf("%s failed: %v", command, err)
+	}
+}
+
+// runConsume consumes events and serves the API, until the process is stopped
+func runConsume(args []string) error {
+	if err := scheduleReports(); err != nil {
+		return fmt.Errorf("failed to schedule reports: %v", err)
 	}
 
 	// Set up and start the cron job
 	c := cron.New()
-	err = c.AddFunc("@hourly", aggregateData)
+	err := c.AddFunc(ROLLUP_SCHEDULE, rollupEvents)
+	if err != nil {
+		log.Fatalf("failed to add cron job: %v", err)
+	}
+	err = c.AddFunc(RETENTION_SCHEDULE, applyRetention)
+	if err != nil {
+		log.Fatalf("failed to add cron job: %v", err)
+	}
+	err = c.AddFunc(RECONCILE_SCHEDULE, reconcileBilling)
+	if err != nil {
+		log.Fatalf("failed to add cron job: %v", err)
+	}
+	err = c.AddFunc(ANOMALY_SCHEDULE, checkAnomalies)
+	if err != nil {
+		log.Fatalf("failed to add cron job: %v", err)
+	}
+	err = c.AddFunc(REACH_COMPACTION_SCHEDULE, compactReachSketches)
+	if err != nil {
+		log.Fatalf("failed to add cron job: %v", err)
+	}
+	err = c.AddFunc(QUALITY_SCHEDULE, scoreYesterday)
 	if err != nil {
 		log.Fatalf("failed to add cron job: %v", err)
 	}
@@ -188,6 +226,12 @@ func main() {
 	// Set up Kafka reader
 	reader := setupKafkaReader()
 	fmt.Println("Setup successfully!")
-	consumeEvents(reader)
-	//setupAndRunAPIRouter()
+	live = newLiveFeed()
+	go live.run()
+	go setupAndRunAPIRouter()
+	deadLetters := setupDeadLetterWriter()
+	defer deadLetters.Close()
+	go consumeBilling(setupBillingReader(), deadLetters)
+	consumeEvents(reader, deadLetters)
+	return nil
 }
@@ -1,138 +1,179 @@
 package main
 
 import (
+	"crypto/subtle"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const REPORTER_PORT = 9999
 const MEAN_CTR_API = "/mean_ctr"
 const AD_PUBLISHER_API = "/ad_publisher"
+const ORPHAN_CLICKS_API = "/orphan_clicks"
+const CONVERSIONS_API = "/conversions"
+const METRICS_API = "/metrics"
+const DEFAULT_ORPHAN_WINDOW = 24 * time.Hour // Time range of the orphan click report, unless ?hours= is given.
 
-type AdvertiserPublisherEventCount struct {
-	advertiser_id	string
-	publisher_id	string
-	event_type		string
-	total			int
-}
-
-type AdPublisherEventCount struct {
-	ad_id			string
-	publisher_id	string
-	event_type		string
-	total			int
-}
-
-// A struct reflecting the collaboration of an ad with a publisher.
-type AdPublisherCollaboration struct {
-	AdID        int
-	PublisherID int
-}
-
-type AdvertiserPublisherCollaboration struct {
-	AdvertiserID int
-	PublisherID  int
-}
-
+const DEFAULT_STATISTICS_WINDOW = time.Hour // Time range of the mean CTR and ad publisher reports, unless ?hours= is given.
 
-// Stores the statistics of a collaboration. Namely, impression count, click count and ctr.
+// Stores the statistics of a collaboration of an advertiser, or one of its ads, with a publisher.
+// Namely, impression count, click count, ctr and the share of impressions that were viewable.
 type Statistics struct {
-	Impressions int
-	Clicks      int
-	CTR         float64
+	AdvertiserID string `gorm:"column:advertiser_id" json:",omitempty"`
+	AdID         string `gorm:"column:ad_id" json:",omitempty"`
+	PublisherID  string `gorm:"column:publisher_id"`
+	Impressions  int    `gorm:"column:impressions"`
+	Clicks       int    `gorm:"column:clicks"`
+	Viewables    int    `gorm:"column:viewables"`
+	CTR          float64
+	ViewableRate float64
 }
 
-// Maps advertiser-publisher collaborations to their emprical success statistics.
-var advertiserEvaluation map[AdvertiserPublisherCollaboration]Statistics
-
-// Maps ad-publisher collaborations to ther emprical success statistics.
-var adEvaluation map[AdPublisherCollaboration]Statistics
+// statisticsWindow returns the time range requested with ?hours=
+func statisticsWindow(c *gin.Context) time.Duration {
+	if hours, err := strconv.Atoi(c.Query("hours")); err == nil && hours > 0 {
+		return time.Duration(hours) * time.Hour
+	}
+	return DEFAULT_STATISTICS_WINDOW
+}
 
-/* Sends the mean ctr of each advertiser's ads, per publisher. */
-func sendAdvertisersMeanCTR(c *gin.Context) {
-	var timeCondition = "time > now() - INTERVAL '1 hour'"
-	var eventCounts []AdvertiserPublisherEventCount
-	db.Table("events").Select("advertiser_id, publisher_id, event_type, count(1) AS total").Where(timeCondition).Group("advertiser_id, publisher_id, event_type").Scan(&eventCounts)
-
-	var collaboration AdvertiserPublisherCollaboration
-	for _, eventCount := range eventCounts {
-		var statistics Statistics
-		collaboration.AdvertiserID, _ = strconv.Atoi(eventCount.advertiser_id)
-		collaboration.PublisherID,  _ = strconv.Atoi(eventCount.publisher_id)
-		
-		statistics = advertiserEvaluation[collaboration]
-		switch eventCount.event_type {
-		case "impression":
-			statistics.Impressions = eventCount.total
-		case "click":
-			statistics.Clicks = eventCount.total
-		default:
-			c.AbortWithStatus(http.StatusInternalServerError)
-			return
-		}
-		advertiserEvaluation[collaboration] = statistics
+/* Counts the events of each collaboration of the given dimension,
+ advertiser_id or ad_id, with a publisher since the given time. */
+func collaborationStatistics(dimension string, since time.Time) ([]Statistics, error) {
+	var statistics []Statistics
+	err := db.Table("events").
+		Select(dimension+", publisher_id, "+
+			"SUM(CASE WHEN event_type = 'impression' THEN 1 ELSE 0 END) AS impressions, "+
+			"SUM(CASE WHEN event_type = 'click' THEN 1 ELSE 0 END) AS clicks, "+
+			"SUM(CASE WHEN event_type = 'viewable' THEN 1 ELSE 0 END) AS viewables").
+		Where("time > ? AND event_type IN ?", since.Unix(), []string{"impression", "click", "viewable"}).
+		Group(dimension + ", publisher_id").
+		Scan(&statistics).Error
+	if err != nil {
+		return nil, err
 	}
 
 	/* Compute CTR, together with fixing possible inconsistencies
 	 in data. These inconsistencies can happen, for example by
 	 latency in arrival of click and impression events. */
-	for apc := range advertiserEvaluation {
-		var statistics = advertiserEvaluation[apc]
-		if statistics.Impressions < statistics.Clicks {
-			statistics.Impressions = statistics.Clicks
+	for i := range statistics {
+		s := &statistics[i]
+		if s.Impressions < s.Clicks {
+			s.Impressions = s.Clicks
 		}
-		if statistics.Impressions > 0 {
-			statistics.CTR = float64(statistics.Clicks) / float64(statistics.Impressions)
+		if s.Impressions < s.Viewables {
+			s.Impressions = s.Viewables
+		}
+		if s.Impressions > 0 {
+			s.CTR = float64(s.Clicks) / float64(s.Impressions)
+			s.ViewableRate = float64(s.Viewables) / float64(s.Impressions)
 		}
-		advertiserEvaluation[apc] = statistics
 	}
-	
-	/* Our statistics map is now ready to be sent. */
-	c.JSON(http.StatusOK, advertiserEvaluation)
+	return statistics, nil
 }
 
+/* Sends the mean ctr of each advertiser's ads, per publisher. */
+func sendAdvertisersMeanCTR(c *gin.Context) {
+	statistics, err := collaborationStatistics("advertiser_id", time.Now().Add(-statisticsWindow(c)))
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, statistics)
+}
 
 /* Sends the per-publisher success statistics of each Ad. */
 func sendAdStatistics(c *gin.Context) {
-	var timeCondition = "time > now() - INTERVAL '1 hour'"
-	
-	var eventCounts []AdPublisherEventCount
-	db.Table("events").Select("ad_id, publisher_id, event_type, count(1) AS total").Where(timeCondition).Group("ad_id, publisher_id, event_type").Scan(&eventCounts)
-
-	var collaboration AdPublisherCollaboration
-	for _, eventCount := range eventCounts {
-		collaboration.AdID, _ = strconv.Atoi(eventCount.ad_id)
-		collaboration.PublisherID, _ = strconv.Atoi(eventCount.publisher_id)
-
-		var statistics = adEvaluation[collaboration]
-		switch eventCount.event_type {
-		case "impression":
-			statistics.Impressions = eventCount.total
-		case "click":
-			statistics.Clicks = eventCount.total
-		default:
-			c.AbortWithStatus(http.StatusInternalServerError)
+	statistics, err := collaborationStatistics("ad_id", time.Now().Add(-statisticsWindow(c)))
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, statistics)
+}
+
+// Click counts of a publisher, split by whether their impression was seen.
+type PublisherOrphanClicks struct {
+	PublisherID  string
+	Clicks       int
+	OrphanClicks int
+	OrphanRate   float64
+}
+
+/* Sends, per publisher, the share of clicks that arrived without a
+ matching impression. A high share hints at click fraud. */
+func sendOrphanClickRates(c *gin.Context) {
+	window := DEFAULT_ORPHAN_WINDOW
+	if hours, err := strconv.Atoi(c.Query("hours")); err == nil && hours > 0 {
+		window = time.Duration(hours) * time.Hour
+	}
+	since := time.Now().Add(-window).Unix()
+
+	var rates []PublisherOrphanClicks
+	err := db.Table("events").
+		Select("publisher_id, "+
+			"COUNT(1) AS clicks, "+
+			"SUM(CASE WHEN orphan_click THEN 1 ELSE 0 END) AS orphan_clicks").
+		Where("event_type = ? AND time > ?", "click", since).
+		Group("publisher_id").
+		Scan(&rates).Error
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	for i := range rates {
+		if rates[i].Clicks > 0 {
+			rates[i].OrphanRate = float64(rates[i].OrphanClicks) / float64(rates[i].Clicks)
 		}
-		adEvaluation[collaboration] = statistics
 	}
-	/* Compute CTR, together with fixing possible inconsistencies
-	 in data. These inconsistencies can happen, for example by
-	 latency in arrival of click and impression events. */
-	for apc := range adEvaluation {
-		var statistics = adEvaluation[apc]
-		if statistics.Impressions < statistics.Clicks {
-			statistics.Impressions = statistics.Clicks
+	c.JSON(http.StatusOK, rates)
+}
+
+// Spend and conversions of an ad, with the derived cost per acquisition and return on ad spend.
+type AdConversions struct {
+	AdID         string
+	AdvertiserID string
+	Spend        int64
+	Conversions  int
+	Value        int64
+	CPA          float64
+	ROAS         float64
+}
+
+/* Sends CPA and ROAS per ad, optionally restricted to one advertiser
+ with ?advertiser_id=. Spend only counts billable clicks. */
+func sendConversionStats(c *gin.Context) {
+	query := db.Table("events").
+		Select("ad_id, advertiser_id, "+
+			"SUM(CASE WHEN event_type = 'click' AND NOT not_billable THEN price ELSE 0 END) AS spend, "+
+			"SUM(CASE WHEN event_type = 'conversion' THEN 1 ELSE 0 END) AS conversions, "+
+			"SUM(CASE WHEN event_type = 'conversion' THEN value ELSE 0 END) AS value").
+		Where("event_type IN ?", []string{"click", "conversion"})
+	if advertiserID := c.Query("advertiser_id"); advertiserID != "" {
+		query = query.Where("advertiser_id = ?", advertiserID)
+	}
+
+	var stats []AdConversions
+	if err := query.Group("ad_id, advertiser_id").Scan(&stats).Error; err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	for i := range stats {
+		if stats[i].Conversions > 0 {
+			stats[i].CPA = float64(stats[i].Spend) / float64(stats[i].Conversions)
 		}
-		if statistics.Impressions > 0 {
-			statistics.CTR = float64(statistics.Clicks) / float64(statistics.Impressions)
+		if stats[i].Spend > 0 {
+			stats[i].ROAS = float64(stats[i].Value) / float64(stats[i].Spend)
 		}
-		adEvaluation[apc] = statistics
 	}
-
-	/* Our statistics map is now ready to be sent. */
-	c.JSON(http.StatusOK, adEvaluation)
+	c.JSON(http.StatusOK, stats)
 }
 
 /* Runs the router that will route api calls from ad server to
@@ -142,6 +183,34 @@ func setupAndRunAPIRouter() {
 	router := gin.Default()
 	router.GET(MEAN_CTR_API, sendAdvertisersMeanCTR)
 	router.GET(AD_PUBLISHER_API, sendAdStatistics)
+	router.GET(ORPHAN_CLICKS_API, sendOrphanClickRates)
+	router.GET(CONVERSIONS_API, sendConversionStats)
+	router.GET(ADS_REPORT_API, sendReport("ad_id"))
+	router.GET(ADS_REACH_API, sendReach("ad_id"))
+	router.GET(ADS_ATTRIBUTION_API, sendAttribution("ad_id"))
+	router.GET(ADVERTISERS_REPORT_API, sendReport("advertiser_id"))
+	router.GET(ADVERTISERS_REACH_API, sendReach("advertiser_id"))
+	router.GET(PUBLISHERS_REPORT_API, sendReport("publisher_id"))
+	router.GET(PUBLISHERS_ATTRIBUTION_API, sendAttribution("publisher_id"))
+	router.GET(PUBLISHERS_QUALITY_API, sendPublisherQuality)
+	router.GET(RECONCILIATION_API, sendReconciliation)
+	router.GET(ANOMALIES_API, sendAnomalies)
+	router.GET(LIVE_API, sendLive)
+	router.GET(METRICS_API, gin.WrapH(promhttp.Handler()))
+	SetupScheduledReportRoutes(router.Group(SCHEDULED_REPORTS_API, AdminAuth(getEnv("ADMIN_TOKEN", ""))))
 
 	router.Run(":" + strconv.Itoa(REPORTER_PORT))
-}
\ No newline at end of file
+}
+
+/* Guards the endpoints that change the reporter's configuration with
+ a bearer token. No token configured means no access. */
+func AdminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		given := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
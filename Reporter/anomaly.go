@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const ANOMALIES_API = "/anomalies"
+const ANOMALY_SCHEDULE = "@every 5m"
+
+/*
+Anomalies are looked for in the last complete hour of each ad and each
+publisher, against a baseline of earlier hours: the previous week of
+hours for a rolling baseline, or the same hour of the previous days for
+a seasonal one, which follows daily traffic patterns.
+*/
+const (
+	BASELINE_ROLLING  = "rolling"
+	BASELINE_SEASONAL = "seasonal"
+)
+
+const ROLLING_BASELINE_HOURS = 7 * 24
+const SEASONAL_BASELINE_DAYS = 14
+const DEFAULT_Z_THRESHOLD = 4.0
+
+/* Volumes under which a change is noise rather than an anomaly. */
+const MIN_ANOMALY_IMPRESSIONS = 100
+const MIN_ANOMALY_CLICKS = 20
+
+const MAX_RECENT_ANOMALIES = 100
+const WEBHOOK_ATTEMPTS = 3
+
+/* Kinds of anomalies. */
+const (
+	ANOMALY_CTR_SPIKE       = "ctr_spike"
+	ANOMALY_IMPRESSION_DROP = "impression_drop"
+	ANOMALY_CLICK_BURST     = "click_burst"
+)
+
+var anomaliesDetected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "reporter_anomalies_total",
+	Help: "Anomalies detected in the rollups, by dimension and kind.",
+}, []string{"dimension", "kind"})
+
+var activeAnomalies = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "reporter_active_anomalies",
+	Help: "Anomalies in the last complete hour, by dimension and kind.",
+}, []string{"dimension", "kind"})
+
+// Anomaly is an hour of an ad or a publisher whose metric strays from its baseline
+type Anomaly struct {
+	Kind      string    `json:"kind"`
+	Dimension string    `json:"dimension"` // ad_id or publisher_id.
+	ID        string    `json:"id"`
+	Bucket    time.Time `json:"bucket"`
+	Value     float64   `json:"value"`
+	Baseline  float64   `json:"baseline"` // Mean of the baseline hours.
+	StdDev    float64   `json:"stddev"`
+	ZScore    float64   `json:"z_score"`
+}
+
+// hourlyCounts holds the impressions and clicks of one ad or publisher, by bucket
+type hourlyCounts struct {
+	impressions map[int64]float64
+	clicks      map[int64]float64
+}
+
+var recentAnomalies struct {
+	sync.Mutex
+	list    []Anomaly
+	alerted map[string]time.Time // Anomalies already alerted on, since detection runs several times per hour.
+}
+
+// zScore returns how many standard deviations a value is from the mean of a baseline
+func zScore(baseline []float64, value float64) (z, mean, stddev float64) {
+	if len(baseline) == 0 {
+		return 0, 0, 0
+	}
+	for _, v := range baseline {
+		mean += v
+	}
+	mean /= float64(len(baseline))
+	for _, v := range baseline {
+		stddev += (v - mean) * (v - mean)
+	}
+	stddev = math.Sqrt(stddev / float64(len(baseline)))
+	// A flat baseline would make any change infinitely anomalous.
+	floor := math.Max(math.Sqrt(mean), 1)
+	if mean < 1 {
+		floor = math.Max(mean, 0.01)
+	}
+	return (value - mean) / math.Max(stddev, floor), mean, stddev
+}
+
+// baselineBuckets returns the buckets compared to the given one
+func baselineBuckets(bucket int64, baseline string) []int64 {
+	var buckets []int64
+	if baseline == BASELINE_SEASONAL {
+		for day := 1; day <= SEASONAL_BASELINE_DAYS; day++ {
+			buckets = append(buckets, bucket-int64(day)*24*3600)
+		}
+		return buckets
+	}
+	for hour := 1; hour <= ROLLING_BASELINE_HOURS; hour++ {
+		buckets = append(buckets, bucket-int64(hour)*3600)
+	}
+	return buckets
+}
+
+// loadHourlyCounts sums the hourly rollups of a dimension from the given bucket on
+func loadHourlyCounts(dimension string, from, to int64) (map[string]*hourlyCounts, error) {
+	var rows []struct {
+		ID          string
+		Bucket      int64
+		Impressions int64
+		Clicks      int64
+	}
+	err := db.Table("rollups").
+		Select(dimension+" AS id, bucket, SUM(impressions) AS impressions, SUM(clicks) AS clicks").
+		Where("granularity = ? AND bucket >= ? AND bucket <= ?", GRANULARITY_HOUR, from, to).
+		Group(dimension + ", bucket").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]*hourlyCounts)
+	for _, row := range rows {
+		c, ok := counts[row.ID]
+		if !ok {
+			c = &hourlyCounts{impressions: make(map[int64]float64), clicks: make(map[int64]float64)}
+			counts[row.ID] = c
+		}
+		c.impressions[row.Bucket] += float64(row.Impressions)
+		c.clicks[row.Bucket] += float64(row.Clicks)
+	}
+	return counts, nil
+}
+
+/*
+detectAnomalies compares the given bucket of each ID with its baseline.
+Hours without rollups count as zero. CTR is only compared over hours
+with enough impressions to be meaningful.
+*/
+func detectAnomalies(dimension string, counts map[string]*hourlyCounts, bucket int64, baseline string, threshold float64) []Anomaly {
+	var anomalies []Anomaly
+	buckets := baselineBuckets(bucket, baseline)
+	for id, c := range counts {
+		found := func(kind string, value float64, z, mean, stddev float64) {
+			anomalies = append(anomalies, Anomaly{
+				Kind: kind, Dimension: dimension, ID: id, Bucket: time.Unix(bucket, 0).UTC(),
+				Value: value, Baseline: mean, StdDev: stddev, ZScore: z,
+			})
+		}
+
+		impressions, clicks := c.impressions[bucket], c.clicks[bucket]
+		var baseImpressions, baseClicks, baseCTR []float64
+		for _, b := range buckets {
+			baseImpressions = append(baseImpressions, c.impressions[b])
+			baseClicks = append(baseClicks, c.clicks[b])
+			if c.impressions[b] >= MIN_ANOMALY_IMPRESSIONS {
+				baseCTR = append(baseCTR, c.clicks[b]/c.impressions[b])
+			}
+		}
+
+		if z, mean, stddev := zScore(baseImpressions, impressions); z <= -threshold && mean >= MIN_ANOMALY_IMPRESSIONS {
+			found(ANOMALY_IMPRESSION_DROP, impressions, z, mean, stddev)
+		}
+		if z, mean, stddev := zScore(baseClicks, clicks); z >= threshold && clicks >= MIN_ANOMALY_CLICKS {
+			found(ANOMALY_CLICK_BURST, clicks, z, mean, stddev)
+		}
+		if impressions >= MIN_ANOMALY_IMPRESSIONS && len(baseCTR) > 0 {
+			ctr := clicks / impressions
+			z, mean, stddev := zScore(baseCTR, ctr)
+			// CTRs are far below 1, so their floor comes from the spread alone.
+			if stddev > 0 {
+				z = (ctr - mean) / stddev
+			}
+			if z >= threshold && clicks >= MIN_ANOMALY_CLICKS {
+				found(ANOMALY_CTR_SPIKE, ctr, z, mean, stddev)
+			}
+		}
+	}
+	return anomalies
+}
+
+// sendAlert posts an anomaly to ALERT_WEBHOOK_URL, if set
+func sendAlert(anomaly Anomaly) {
+	url := getEnv("ALERT_WEBHOOK_URL", "")
+	if url == "" {
+		return
+	}
+	body, _ := json.Marshal(gin.H{
+		"text":    fmt.Sprintf("%s on %s %s: %.4g against a baseline of %.4g (z = %.1f)", anomaly.Kind, anomaly.Dimension, anomaly.ID, anomaly.Value, anomaly.Baseline, anomaly.ZScore),
+		"anomaly": anomaly,
+	})
+	for attempt := 1; attempt <= WEBHOOK_ATTEMPTS; attempt++ {
+		resp, err := panelClient.Post(url, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("received status %d", resp.StatusCode)
+		}
+		log.Printf("could not send alert (attempt %d): %v", attempt, err)
+		time.Sleep(time.Duration(attempt) * PROCESS_RETRY_BACKOFF)
+	}
+}
+
+// checkAnomalies looks for anomalies in the last complete hour, and alerts on those not alerted on yet
+func checkAnomalies() {
+	baseline := getEnv("ANOMALY_BASELINE", BASELINE_ROLLING)
+	threshold, err := strconv.ParseFloat(getEnv("ANOMALY_Z_THRESHOLD", ""), 64)
+	if err != nil || threshold <= 0 {
+		threshold = DEFAULT_Z_THRESHOLD
+	}
+	bucket := time.Now().Truncate(time.Hour).Add(-time.Hour).Unix()
+	buckets := baselineBuckets(bucket, baseline)
+	from := buckets[len(buckets)-1]
+
+	var anomalies []Anomaly
+	for _, dimension := range []string{"ad_id", "publisher_id"} {
+		counts, err := loadHourlyCounts(dimension, from, bucket)
+		if err != nil {
+			log.Printf("could not load rollups for anomaly detection: %v", err)
+			return
+		}
+		found := detectAnomalies(dimension, counts, bucket, baseline, threshold)
+		for _, kind := range []string{ANOMALY_CTR_SPIKE, ANOMALY_IMPRESSION_DROP, ANOMALY_CLICK_BURST} {
+			active := 0
+			for _, anomaly := range found {
+				if anomaly.Kind == kind {
+					active++
+				}
+			}
+			activeAnomalies.WithLabelValues(dimension, kind).Set(float64(active))
+		}
+		anomalies = append(anomalies, found...)
+	}
+
+	recentAnomalies.Lock()
+	if recentAnomalies.alerted == nil {
+		recentAnomalies.alerted = make(map[string]time.Time)
+	}
+	for key, at := range recentAnomalies.alerted {
+		if time.Since(at) > 24*time.Hour {
+			delete(recentAnomalies.alerted, key)
+		}
+	}
+	var fresh []Anomaly
+	for _, anomaly := range anomalies {
+		key := fmt.Sprintf("%s/%s/%s/%d", anomaly.Kind, anomaly.Dimension, anomaly.ID, bucket)
+		if _, ok := recentAnomalies.alerted[key]; ok {
+			continue
+		}
+		recentAnomalies.alerted[key] = time.Now()
+		recentAnomalies.list = append(recentAnomalies.list, anomaly)
+		fresh = append(fresh, anomaly)
+	}
+	if len(recentAnomalies.list) > MAX_RECENT_ANOMALIES {
+		recentAnomalies.list = recentAnomalies.list[len(recentAnomalies.list)-MAX_RECENT_ANOMALIES:]
+	}
+	recentAnomalies.Unlock()
+
+	for _, anomaly := range fresh {
+		log.Printf("Anomaly: %s on %s %s, %.4g against %.4g (z = %.1f)", anomaly.Kind, anomaly.Dimension, anomaly.ID, anomaly.Value, anomaly.Baseline, anomaly.ZScore)
+		anomaliesDetected.WithLabelValues(anomaly.Dimension, anomaly.Kind).Inc()
+		sendAlert(anomaly)
+	}
+}
+
+/* Sends the most recent anomalies, newest first. */
+func sendAnomalies(c *gin.Context) {
+	recentAnomalies.Lock()
+	anomalies := make([]Anomaly, 0, len(recentAnomalies.list))
+	for i := len(recentAnomalies.list) - 1; i >= 0; i-- {
+		anomalies = append(anomalies, recentAnomalies.list[i])
+	}
+	recentAnomalies.Unlock()
+	c.JSON(http.StatusOK, anomalies)
+}
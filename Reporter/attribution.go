@@ -0,0 +1,360 @@
+package main
+
+import (
+	"errors"
+	"eventschema"
+	"flag"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+/* Attribution of conversions to the impressions and clicks that led to them. See README.md. */
+
+const ADS_ATTRIBUTION_API = "/reports/ads/attribution"
+const PUBLISHERS_ATTRIBUTION_API = "/reports/publishers/attribution"
+
+/* Attribution models, each crediting the touchpoints of a conversion's path differently. */
+const (
+	ATTRIBUTION_LAST_CLICK  = "last_click"  // All to the last click.
+	ATTRIBUTION_FIRST_CLICK = "first_click" // All to the first click.
+	ATTRIBUTION_LINEAR      = "linear"      // Evenly to every impression and click.
+	ATTRIBUTION_TIME_DECAY  = "time_decay"  // To every impression and click, halving every ATTRIBUTION_HALF_LIFE before the conversion.
+)
+
+var attributionModels = []string{ATTRIBUTION_LAST_CLICK, ATTRIBUTION_FIRST_CLICK, ATTRIBUTION_LINEAR, ATTRIBUTION_TIME_DECAY}
+
+/* Defaults of the lookback windows and half-life, which are set as Go durations. */
+const DEFAULT_CLICK_LOOKBACK = 30 * 24 * time.Hour
+const DEFAULT_IMPRESSION_LOOKBACK = 24 * time.Hour
+const DEFAULT_ATTRIBUTION_HALF_LIFE = 7 * 24 * time.Hour
+
+/*
+Attribution is the share of a conversion, and of its value, one model
+credits to an ad on a publisher. Time is the time of the conversion.
+*/
+type Attribution struct {
+	ID                uint    `gorm:"primarykey"`
+	ConversionEventID string  `gorm:"column:conversion_event_id;index"`
+	Model             string  `gorm:"column:model;index:idx_attribution_model_time"`
+	Time              int64   `gorm:"column:time;index:idx_attribution_model_time"`
+	AdID              string  `gorm:"column:ad_id"`
+	PublisherID       string  `gorm:"column:publisher_id"`
+	AdvertiserID      string  `gorm:"column:advertiser_id"`
+	Credit            float64 `gorm:"column:credit"` // Between 0 and 1.
+	Value             float64 `gorm:"column:value"`
+}
+
+// getDurationEnv reads a Go duration from the environment, falling back on invalid or non-positive values
+func getDurationEnv(key string, fallback time.Duration) time.Duration {
+	duration, err := time.ParseDuration(getEnv(key, ""))
+	if err != nil || duration <= 0 {
+		return fallback
+	}
+	return duration
+}
+
+/*
+conversionPath returns the impressions and clicks of the converting
+viewer's path to the advertiser, oldest first: clicks within
+ATTRIBUTION_CLICK_LOOKBACK of the conversion and impressions within
+ATTRIBUTION_IMPRESSION_LOOKBACK. The viewer is the one of the
+converting click. The path of a viewer who cannot be identified is the
+converting click alone, and the conversion stands for that click once
+its event is no longer stored.
+*/
+func conversionPath(conversion *Event) ([]Event, error) {
+	var click Event
+	err := db.Where("event_type = ? AND click_id = ?", eventschema.TYPE_CLICK, conversion.ClickID).Order("time").Limit(1).Find(&click).Error
+	if err != nil {
+		return nil, err
+	}
+	if click.ClickID == "" || conversion.ClickID == "" {
+		touchpoint := *conversion
+		touchpoint.EventType = eventschema.TYPE_CLICK
+		return []Event{touchpoint}, nil
+	}
+	if viewerKey(&click) == "" {
+		return []Event{click}, nil
+	}
+
+	clickLookback := getDurationEnv("ATTRIBUTION_CLICK_LOOKBACK", DEFAULT_CLICK_LOOKBACK)
+	impressionLookback := getDurationEnv("ATTRIBUTION_IMPRESSION_LOOKBACK", DEFAULT_IMPRESSION_LOOKBACK)
+	scope := db.Where("advertiser_id = ? AND time <= ?", conversion.AdvertiserID, conversion.Time).
+		Where(db.Where("event_type = ? AND time >= ?", eventschema.TYPE_CLICK, conversion.Time-int64(clickLookback.Seconds())).
+			Or("event_type = ? AND time >= ?", eventschema.TYPE_IMPRESSION, conversion.Time-int64(impressionLookback.Seconds())))
+	if click.ViewerHash != "" {
+		scope = scope.Where("viewer_hash = ?", click.ViewerHash)
+	} else {
+		scope = scope.Where("client_ip_hash = ? AND user_agent = ?", click.ClientIPHash, click.UserAgent)
+	}
+	var path []Event
+	if err := scope.Order("time, event_type DESC").Find(&path).Error; err != nil {
+		return nil, err
+	}
+
+	for _, touchpoint := range path {
+		if touchpoint.ClickID == click.ClickID && touchpoint.EventType == eventschema.TYPE_CLICK {
+			return path, nil
+		}
+	}
+	// The converting click may be older than the lookback, it still led to the conversion.
+	return append([]Event{click}, path...), nil
+}
+
+// attributionCredits returns the credit a model gives to each touchpoint of a path
+func attributionCredits(model string, path []Event, conversionTime int64, halfLife time.Duration) []float64 {
+	credits := make([]float64, len(path))
+	lastClick, firstClick := -1, -1
+	for i, touchpoint := range path {
+		if touchpoint.EventType == eventschema.TYPE_CLICK {
+			if firstClick < 0 {
+				firstClick = i
+			}
+			lastClick = i
+		}
+	}
+
+	switch model {
+	case ATTRIBUTION_LAST_CLICK:
+		if lastClick >= 0 {
+			credits[lastClick] = 1
+		}
+	case ATTRIBUTION_FIRST_CLICK:
+		if firstClick >= 0 {
+			credits[firstClick] = 1
+		}
+	case ATTRIBUTION_LINEAR:
+		for i := range credits {
+			credits[i] = 1 / float64(len(path))
+		}
+	case ATTRIBUTION_TIME_DECAY:
+		total := 0.0
+		for i, touchpoint := range path {
+			age := float64(max(conversionTime-touchpoint.Time, 0))
+			credits[i] = math.Exp2(-age / halfLife.Seconds())
+			total += credits[i]
+		}
+		for i := range credits {
+			credits[i] /= total
+		}
+	}
+	return credits
+}
+
+// attributeConversion credits a conversion to its path under every model
+func attributeConversion(conversion *Event) ([]Attribution, error) {
+	path, err := conversionPath(conversion)
+	if err != nil {
+		return nil, err
+	}
+	halfLife := getDurationEnv("ATTRIBUTION_HALF_LIFE", DEFAULT_ATTRIBUTION_HALF_LIFE)
+
+	type key struct {
+		adID        string
+		publisherID string
+	}
+	var attributions []Attribution
+	for _, model := range attributionModels {
+		credits := make(map[key]float64)
+		var order []key
+		for i, credit := range attributionCredits(model, path, conversion.Time, halfLife) {
+			if credit == 0 {
+				continue
+			}
+			k := key{path[i].AdID, path[i].PublisherID}
+			if _, ok := credits[k]; !ok {
+				order = append(order, k)
+			}
+			credits[k] += credit
+		}
+		for _, k := range order {
+			attributions = append(attributions, Attribution{
+				ConversionEventID: conversion.EventID,
+				Model:             model,
+				Time:              conversion.Time,
+				AdID:              k.adID,
+				PublisherID:       k.publisherID,
+				AdvertiserID:      conversion.AdvertiserID,
+				Credit:            credits[k],
+				Value:             credits[k] * float64(conversion.Value),
+			})
+		}
+	}
+	return attributions, nil
+}
+
+/*
+attributeConversions replaces the attributions of a batch of conversions,
+so that attributing a conversion again, as the backfill does, is harmless.
+Other events are ignored.
+*/
+func attributeConversions(events []*Event) error {
+	var attributions []Attribution
+	var ids []string
+	for _, event := range events {
+		if event.EventType != eventschema.TYPE_CONVERSION {
+			continue
+		}
+		attributed, err := attributeConversion(event)
+		if err != nil {
+			return err
+		}
+		attributions = append(attributions, attributed...)
+		ids = append(ids, event.EventID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("conversion_event_id IN ?", ids).Delete(&Attribution{}).Error; err != nil {
+			return err
+		}
+		if len(attributions) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(attributions, BATCH_SIZE).Error
+	})
+}
+
+// backfillAttribution attributes again the conversions that happened between from and to
+func backfillAttribution(from, to time.Time) error {
+	attributed := 0
+	for offset := 0; ; offset += BATCH_SIZE {
+		var conversions []*Event
+		err := db.Where("event_type = ? AND time >= ? AND time < ?", eventschema.TYPE_CONVERSION, from.Unix(), to.Unix()).
+			Order("time, event_id").Offset(offset).Limit(BATCH_SIZE).Find(&conversions).Error
+		if err != nil {
+			return err
+		}
+		if len(conversions) == 0 {
+			break
+		}
+		if err := attributeConversions(conversions); err != nil {
+			return err
+		}
+		attributed += len(conversions)
+	}
+	log.Printf("Attributed %d conversions between %s and %s", attributed, from.Format(time.RFC3339), to.Format(time.RFC3339))
+	return nil
+}
+
+/*
+runAttributionBackfill runs the backfill-attribution command:
+
+	reporter backfill-attribution --from 2024-05-01T00:00:00Z [--to ...]
+
+to attribute again the conversions of a range, after a change of the
+lookback windows for instance. --to defaults to now.
+*/
+func runAttributionBackfill(args []string) error {
+	flags := flag.NewFlagSet("backfill-attribution", flag.ExitOnError)
+	fromFlag := flags.String("from", "", "start of the range, as RFC 3339 or Unix seconds")
+	toFlag := flags.String("to", "", "end of the range, exclusive, now by default")
+	flags.Parse(args)
+
+	if *fromFlag == "" {
+		return errors.New("--from is required")
+	}
+	from, err := parseReportTime(*fromFlag, time.Time{})
+	if err != nil {
+		return errors.New("invalid --from")
+	}
+	to, err := parseReportTime(*toFlag, time.Now().UTC())
+	if err != nil {
+		return errors.New("invalid --to")
+	}
+	return backfillAttribution(from, to)
+}
+
+// AttributionRow holds the conversions and value one model attributes to an ad or publisher over one bucket
+type AttributionRow struct {
+	ID          string    `json:"id"`
+	Bucket      time.Time `json:"bucket"`
+	Conversions float64   `json:"conversions"`
+	Value       float64   `json:"value"`
+}
+
+// queryAttribution sums the attributions of a model by dimension, ad_id or publisher_id
+func queryAttribution(dimension, model string, query ReportQuery) ([]AttributionRow, int64, error) {
+	bucket, groups := strconv.FormatInt(query.From.Unix(), 10), dimension
+	if size, ok := rollupGranularities[query.Granularity]; ok {
+		bucket, groups = "time - (time % "+strconv.FormatInt(size, 10)+")", dimension+", bucket"
+	}
+
+	scope := func() *gorm.DB {
+		scope := db.Table("attributions").
+			Where("model = ? AND time >= ? AND time < ?", model, query.From.Unix(), query.To.Unix())
+		for column, value := range query.Filters {
+			scope = scope.Where(column+" = ?", value)
+		}
+		return scope.Group(groups)
+	}
+
+	var total int64
+	if err := db.Table("(?) AS grouped", scope().Select(dimension+", "+bucket+" AS bucket")).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var rows []struct {
+		ID          string
+		Bucket      int64
+		Conversions float64
+		Value       float64
+	}
+	err := scope().Select(dimension + " AS id, " + bucket + " AS bucket, SUM(credit) AS conversions, SUM(value) AS value").
+		Order(groups).
+		Offset((query.Page - 1) * query.PageSize).
+		Limit(query.PageSize).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	report := make([]AttributionRow, len(rows))
+	for i, row := range rows {
+		report[i] = AttributionRow{ID: row.ID, Bucket: time.Unix(row.Bucket, 0).UTC(), Conversions: row.Conversions, Value: row.Value}
+	}
+	return report, total, nil
+}
+
+// sendAttribution returns a handler serving the attribution report of one dimension
+func sendAttribution(dimension string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query, err := parseReportQuery(c)
+		if err == nil && c.Query("granularity") == "" {
+			query.Granularity = GRANULARITY_TOTAL
+		}
+		model := c.DefaultQuery("model", ATTRIBUTION_LAST_CLICK)
+		if err == nil && !slices.Contains(attributionModels, model) {
+			err = errors.New("model must be last_click, first_click, linear or time_decay")
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		rows, total, err := queryAttribution(dimension, model, query)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "could not build report"})
+			return
+		}
+
+		c.Header("X-Total-Count", strconv.FormatInt(total, 10))
+		c.JSON(http.StatusOK, gin.H{
+			"data":        rows,
+			"model":       model,
+			"page":        query.Page,
+			"page_size":   query.PageSize,
+			"total":       total,
+			"granularity": query.Granularity,
+			"from":        query.From,
+			"to":          query.To,
+		})
+	}
+}
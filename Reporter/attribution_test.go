@@ -0,0 +1,129 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAttributionCredits(t *testing.T) {
+	const now = int64(1714557600)
+	halfLife := time.Hour
+	path := []Event{
+		{EventType: "impression", Time: now - 2*3600},
+		{EventType: "click", Time: now - 3600},
+		{EventType: "impression", Time: now - 1800},
+		{EventType: "click", Time: now},
+	}
+	impressionsOnly := []Event{{EventType: "impression", Time: now - 3600}, {EventType: "impression", Time: now}}
+
+	tests := []struct {
+		name  string
+		model string
+		path  []Event
+		want  []float64
+	}{
+		{"last click", ATTRIBUTION_LAST_CLICK, path, []float64{0, 0, 0, 1}},
+		{"first click", ATTRIBUTION_FIRST_CLICK, path, []float64{0, 1, 0, 0}},
+		{"linear", ATTRIBUTION_LINEAR, path, []float64{0.25, 0.25, 0.25, 0.25}},
+		// Weights 1/4, 1/2, 1/sqrt(2) and 1, over their sum.
+		{"time decay", ATTRIBUTION_TIME_DECAY, path, []float64{
+			0.25 / (1.75 + math.Sqrt2/2), 0.5 / (1.75 + math.Sqrt2/2),
+			(math.Sqrt2 / 2) / (1.75 + math.Sqrt2/2), 1 / (1.75 + math.Sqrt2/2)}},
+		{"last click without clicks", ATTRIBUTION_LAST_CLICK, impressionsOnly, []float64{0, 0}},
+		{"linear without clicks", ATTRIBUTION_LINEAR, impressionsOnly, []float64{0.5, 0.5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := attributionCredits(tt.model, tt.path, now, halfLife)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if math.Abs(got[i]-tt.want[i]) > 1e-9 {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestAttributeConversions(t *testing.T) {
+	s := openTestStore(t)
+	at := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	touchpoint := func(id, eventType, adID string, before time.Duration, clickID string) *Event {
+		event := storedEvent(id, eventType, adID, "7", at.Add(-before))
+		event.AdvertiserID, event.ViewerHash, event.ClickID = "adv", "viewer", clickID
+		return event
+	}
+	conversion := touchpoint("conv", "conversion", "3", 0, "c2")
+	conversion.Value = 900
+	events := []*Event{
+		touchpoint("e1", "impression", "2", 2*time.Hour, ""),
+		touchpoint("e2", "click", "1", 90*time.Minute, "c1"),
+		touchpoint("e3", "click", "3", time.Hour, "c2"),
+		touchpoint("e4", "impression", "9", time.Hour, ""),
+		conversion,
+	}
+	events[3].ViewerHash = "someone else"
+	if _, err := s.InsertEvents(events); err != nil {
+		t.Fatal(err)
+	}
+	// Attributing again, as the backfill does, replaces the first attributions.
+	for run := 0; run < 2; run++ {
+		if err := attributeConversions([]*Event{conversion}); err != nil {
+			t.Fatalf("could not attribute conversion: %v", err)
+		}
+	}
+
+	third := 1.0 / 3
+	tests := []struct {
+		model string
+		want  map[string]float64
+	}{
+		{ATTRIBUTION_LAST_CLICK, map[string]float64{"3": 1}},
+		{ATTRIBUTION_FIRST_CLICK, map[string]float64{"1": 1}},
+		{ATTRIBUTION_LINEAR, map[string]float64{"1": third, "2": third, "3": third}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			var attributions []Attribution
+			if err := s.DB().Where("model = ?", tt.model).Find(&attributions).Error; err != nil {
+				t.Fatal(err)
+			}
+			if len(attributions) != len(tt.want) {
+				t.Fatalf("got %+v, want credits %v", attributions, tt.want)
+			}
+			for _, attribution := range attributions {
+				want, ok := tt.want[attribution.AdID]
+				if !ok || math.Abs(attribution.Credit-want) > 1e-9 || math.Abs(attribution.Value-want*900) > 1e-6 {
+					t.Errorf("ad %s credited %v (value %v), want %v", attribution.AdID, attribution.Credit, attribution.Value, want)
+				}
+				if attribution.ConversionEventID != "conv" || attribution.Time != at.Unix() {
+					t.Errorf("attribution %+v is not the conversion's", attribution)
+				}
+			}
+		})
+	}
+}
+
+func TestAttributeConversionWithoutClick(t *testing.T) {
+	openTestStore(t)
+	at := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	conversion := storedEvent("conv", "conversion", "5", "7", at)
+	conversion.ClickID = "unknown"
+
+	attributions, err := attributeConversion(conversion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attributions) != len(attributionModels) {
+		t.Fatalf("got %d attributions, want one per model", len(attributions))
+	}
+	for _, attribution := range attributions {
+		if attribution.AdID != "5" || attribution.Credit != 1 {
+			t.Errorf("%s credited ad %s with %v, want all to the converting ad", attribution.Model, attribution.AdID, attribution.Credit)
+		}
+	}
+}
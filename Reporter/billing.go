@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"eventschema"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+)
+
+/*
+Billing runs as a consumer group of its own, so that the events are
+billed at Panel's pace without holding back their storage. Panel books
+each event once per idempotency key, the event ID, so a message billed
+again after a crash is not charged twice.
+*/
+const BILLING_GROUP_ID = "reporter_billing"
+const PANEL_API = "https://panel.lontra.tech/api/v1"
+const IDEMPOTENCY_KEY_HEADER = "Idempotency-Key"
+const PANEL_TIMEOUT = 10 * time.Second
+const BILLING_MAX_BACKOFF = time.Minute
+const MAX_BILLING_ATTEMPTS = 10 // About 4 minutes of backoff, after which an event no longer holds back its partition.
+
+const RECONCILE_SCHEDULE = "@every 1h"
+const RECONCILE_WINDOW = 24 * time.Hour
+const RECONCILE_SETTLE = 10 * time.Minute // Clicks more recent than this may still be on their way to Panel.
+const RECONCILIATION_API = "/billing/reconciliation"
+
+// errPanelRejected marks events that Panel refuses, and that retrying cannot bill
+var errPanelRejected = errors.New("rejected by Panel")
+
+var panelClient = &http.Client{Timeout: PANEL_TIMEOUT}
+
+var billingOutcomes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "reporter_billing_events_total",
+	Help: "Events sent to Panel for billing, by outcome: billed, retried or dead_letter.",
+}, []string{"outcome"})
+
+var unreconciledClicks = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "reporter_billing_unreconciled_clicks",
+	Help: "Clicks on which the stored events and Panel's ledger disagree, as of the last reconciliation.",
+})
+
+func setupBillingReader() *kafka.Reader {
+	return kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  []string{BROKER_ADDRESS},
+		Topic:    TOPIC,
+		GroupID:  BILLING_GROUP_ID,
+		MinBytes: 10e3, // 10KB
+		MaxBytes: 10e6, // 10MB
+	})
+}
+
+// billedByPanel tells whether an event is applied by Panel: billable clicks move credit, billable impressions are counted
+func billedByPanel(event *Event) bool {
+	if event.NotBillable {
+		return false
+	}
+	return event.EventType == eventschema.TYPE_CLICK || event.EventType == eventschema.TYPE_IMPRESSION
+}
+
+// callAPI sends an event to Panel, under its event ID as idempotency key
+func callAPI(event Event) error {
+	url := fmt.Sprintf("%s/ads/%s/event", PANEL_API, event.AdID)
+	payload := map[string]interface{}{
+		"publisher_id": event.PublisherID,
+		"event_type":   event.EventType,
+		"time":         event.Time,
+		"price":        event.Price,
+	}
+	body, _ := json.Marshal(payload)
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(body))
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(IDEMPOTENCY_KEY_HEADER, event.EventID)
+	req.Header.Set("Authorization", "Bearer "+getEnv("PANEL_ADMIN_TOKEN", ""))
+
+	resp, err := panelClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+		return fmt.Errorf("%w: status %d", errPanelRejected, resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("received non-200 response: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+/*
+consumeBilling bills the events of each partition in order, committing
+the offset of a message once Panel has applied its event or refused it.
+*/
+func consumeBilling(reader *kafka.Reader, deadLetters *kafka.Writer) {
+	dispatchPartitions(reader, BILLING_GROUP_ID, func(messages <-chan kafka.Message) {
+		for msg := range messages {
+			billMessage(msg, deadLetters)
+			if err := reader.CommitMessages(context.Background(), msg); err != nil {
+				log.Printf("could not commit billing offset %d of partition %d: %v", msg.Offset, msg.Partition, err)
+			}
+		}
+	})
+}
+
+/*
+billMessage sends the event of a message to Panel, retrying with backoff
+until Panel applies it. Events Panel refuses, or still fails to apply
+after MAX_BILLING_ATTEMPTS, are dead-lettered, and left for the
+reconciliation to report.
+*/
+func billMessage(msg kafka.Message, deadLetters *kafka.Writer) {
+	event, err := decodeEvent(msg)
+	if err != nil {
+		// Dead-lettered by the storage consumer.
+		return
+	}
+	if event.EventID == "" {
+		event.EventID = messageEventID(msg)
+	}
+	if event.NotBillable {
+		log.Printf("Not billing %s event %s, fraud score %d (%s)", event.EventType, event.EventID, event.FraudScore, event.FraudReasons)
+		return
+	}
+	if !billedByPanel(event) {
+		return
+	}
+
+	backoff := PROCESS_RETRY_BACKOFF
+	for attempt := 1; ; attempt++ {
+		err := callAPI(*event)
+		if err == nil {
+			billingOutcomes.WithLabelValues("billed").Inc()
+			return
+		}
+		if errors.Is(err, errPanelRejected) || attempt == MAX_BILLING_ATTEMPTS {
+			log.Printf("Could not bill %s event %s: %v", event.EventType, event.EventID, err)
+			sendToDeadLetter(deadLetters, msg, err)
+			billingOutcomes.WithLabelValues("dead_letter").Inc()
+			return
+		}
+
+		log.Printf("Failed to bill %s event %s, retrying in %v: %v", event.EventType, event.EventID, backoff, err)
+		billingOutcomes.WithLabelValues("retried").Inc()
+		time.Sleep(backoff)
+		backoff = min(2*backoff, BILLING_MAX_BACKOFF)
+	}
+}
+
+// AdReconciliation compares the billable clicks stored for an ad with those Panel billed
+type AdReconciliation struct {
+	AdID         string
+	StoredClicks int64
+	BilledClicks int64
+	Debit        int64 // Debited from the advertiser by Panel.
+}
+
+// Reconciliation lists the ads whose stored and billed clicks disagree over a time range
+type Reconciliation struct {
+	From       time.Time
+	To         time.Time
+	CheckedAt  time.Time
+	Mismatches []AdReconciliation
+}
+
+var lastReconciliation struct {
+	sync.Mutex
+	report *Reconciliation
+}
+
+// fetchBilledClicks returns Panel's billed clicks per ad, for the clicks that happened in [from, to)
+func fetchBilledClicks(from, to time.Time) (map[string]AdReconciliation, error) {
+	url := fmt.Sprintf("%s/ledger/clicks?from=%d&to=%d", PANEL_API, from.Unix(), to.Unix())
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+getEnv("PANEL_ADMIN_TOKEN", ""))
+	resp, err := panelClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("received non-200 response: %d", resp.StatusCode)
+	}
+
+	var billed []struct {
+		AdID   int   `json:"ad_id"`
+		Clicks int64 `json:"clicks"`
+		Debit  int64 `json:"debit"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&billed); err != nil {
+		return nil, err
+	}
+	byAd := make(map[string]AdReconciliation, len(billed))
+	for _, b := range billed {
+		adID := strconv.Itoa(b.AdID)
+		byAd[adID] = AdReconciliation{AdID: adID, BilledClicks: b.Clicks, Debit: b.Debit}
+	}
+	return byAd, nil
+}
+
+/*
+reconcileBilling compares, per ad, the billable clicks stored over the
+last day with the clicks Panel billed, and reports the ads on which
+they disagree. The most recent clicks are left out, since they may not
+have been billed yet.
+*/
+func reconcileBilling() {
+	to := time.Now().Add(-RECONCILE_SETTLE).Truncate(time.Minute)
+	from := to.Add(-RECONCILE_WINDOW)
+
+	var stored []struct {
+		AdID   string
+		Clicks int64
+	}
+	err := db.Model(&Event{}).
+		Select("ad_id, COUNT(1) AS clicks").
+		Where("event_type = ? AND NOT not_billable AND time >= ? AND time < ?", eventschema.TYPE_CLICK, from.Unix(), to.Unix()).
+		Group("ad_id").
+		Scan(&stored).Error
+	if err != nil {
+		log.Printf("could not count stored clicks: %v", err)
+		return
+	}
+	byAd, err := fetchBilledClicks(from, to)
+	if err != nil {
+		log.Printf("could not fetch billed clicks from Panel: %v", err)
+		return
+	}
+	for _, s := range stored {
+		ad := byAd[s.AdID]
+		ad.AdID = s.AdID
+		ad.StoredClicks = s.Clicks
+		byAd[s.AdID] = ad
+	}
+
+	report := &Reconciliation{From: from, To: to, CheckedAt: time.Now(), Mismatches: []AdReconciliation{}}
+	var unreconciled int64
+	for _, ad := range byAd {
+		if ad.StoredClicks == ad.BilledClicks {
+			continue
+		}
+		log.Printf("Billing mismatch on ad %s: %d billable clicks stored, %d billed", ad.AdID, ad.StoredClicks, ad.BilledClicks)
+		report.Mismatches = append(report.Mismatches, ad)
+		if ad.StoredClicks > ad.BilledClicks {
+			unreconciled += ad.StoredClicks - ad.BilledClicks
+		} else {
+			unreconciled += ad.BilledClicks - ad.StoredClicks
+		}
+	}
+	unreconciledClicks.Set(float64(unreconciled))
+
+	lastReconciliation.Lock()
+	lastReconciliation.report = report
+	lastReconciliation.Unlock()
+}
+
+/* Sends the result of the last reconciliation of billed clicks. */
+func sendReconciliation(c *gin.Context) {
+	lastReconciliation.Lock()
+	report := lastReconciliation.report
+	lastReconciliation.Unlock()
+	if report == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no reconciliation has run yet"})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"strings"
+	"time"
+)
+
+const USAGE = `Usage: reporter [command] [flags]
+
+Commands:
+  consume                               Consume events and serve the API (default)
+  replay --from X --to Y [--partition N]
+                                        Store again the events of a time range, or of an offset range of one partition
+  replay --file dump.jsonl              Store again the events of a JSONL dump
+  rollup rebuild --range FROM/TO        Recompute the rollups of the whole days of a range
+  export --from X --to Y [--format csv|jsonl|parquet] [--output file]
+                                        Dump the events of a time range
+  backfill-attribution --from X [--to Y]
+                                        Attribute again the conversions of a time range
+  score-quality [--day YYYY-MM-DD]      Score the traffic quality of the publishers on a day, yesterday by default
+
+Times are RFC 3339 or Unix seconds.
+`
+
+/* Commands of the reporter, by name. Each runs once the event store is migrated. */
+var commands = map[string]func(args []string) error{
+	"consume":              runConsume,
+	"replay":               runReplay,
+	"rollup":               runRollup,
+	"export":               runExport,
+	"backfill-attribution": runAttributionBackfill,
+	"score-quality":        runQualityScoring,
+}
+
+// parseRange parses a FROM/TO range of RFC 3339 times or Unix seconds
+func parseRange(value string) (time.Time, time.Time, error) {
+	start, end, ok := strings.Cut(value, "/")
+	if !ok {
+		return time.Time{}, time.Time{}, errors.New("range must be FROM/TO")
+	}
+	from, err := parseReportTime(start, time.Time{})
+	if err != nil || start == "" {
+		return time.Time{}, time.Time{}, errors.New("invalid start of range")
+	}
+	to, err := parseReportTime(end, time.Time{})
+	if err != nil || end == "" {
+		return time.Time{}, time.Time{}, errors.New("invalid end of range")
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, errors.New("range must start before it ends")
+	}
+	return from, to, nil
+}
+
+/*
+runRollup runs the rollup commands:
+
+	reporter rollup rebuild --range 2024-05-01T00:00:00Z/2024-05-08T00:00:00Z
+
+rebuilds the rollups of the whole UTC days the range overlaps.
+*/
+func runRollup(args []string) error {
+	if len(args) == 0 || args[0] != "rebuild" {
+		return errors.New("usage: rollup rebuild --range FROM/TO")
+	}
+	flags := flag.NewFlagSet("rollup rebuild", flag.ExitOnError)
+	rangeFlag := flags.String("range", "", "range to rebuild, as FROM/TO")
+	flags.Parse(args[1:])
+
+	from, to, err := parseRange(*rangeFlag)
+	if err != nil {
+		return err
+	}
+	if err := store.RebuildRollups(from, to); err != nil {
+		return err
+	}
+	log.Printf("Rebuilt the rollups of the days from %s to %s", from.Format(time.DateOnly), to.Format(time.DateOnly))
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+/*
+Raw events are deduplicated by event ID in the background by the
+ReplacingMergeTree engine, and partitioned by day so that retention
+drops whole partitions.
+*/
+const CLICKHOUSE_EVENTS_OPTIONS = "ENGINE = ReplacingMergeTree PARTITION BY toYYYYMMDD(toDateTime(time)) ORDER BY (ad_id, time, event_id)"
+
+/*
+Rollup rows of the same bucket are summed up by the engine, and by the
+SUMs of the reports until then. The table is created by hand rather than
+from Rollup, whose ID column the engine would sum along with the counters.
+*/
+const CLICKHOUSE_ROLLUPS_TABLE = `CREATE TABLE IF NOT EXISTS rollups (
+	granularity String,
+	bucket Int64,
+	ad_id String,
+	publisher_id String,
+	advertiser_id String,
+	impressions Int64,
+	clicks Int64,
+	billable_clicks Int64,
+	viewables Int64,
+	conversions Int64,
+	spend Int64,
+	conversion_value Int64,
+	updated_at DateTime
+) ENGINE = SummingMergeTree((impressions, clicks, billable_clicks, viewables, conversions, spend, conversion_value))
+ORDER BY (granularity, bucket, ad_id, publisher_id)`
+
+const CLICKHOUSE_REACH_OPTIONS = "ENGINE = MergeTree ORDER BY (dimension, day, dimension_id)"
+const CLICKHOUSE_ATTRIBUTION_OPTIONS = "ENGINE = MergeTree ORDER BY (model, time)"
+const CLICKHOUSE_QUALITY_OPTIONS = "ENGINE = MergeTree ORDER BY (day, publisher_id)"
+
+/*
+Rollups of one granularity, computed from a source of events. Their
+columns match those rollupRange computes for the SQL stores.
+*/
+const CLICKHOUSE_ROLLUP_SELECT = `SELECT
+	'%[1]s' AS granularity,
+	time - (time %% %[2]d) AS bucket,
+	ad_id,
+	publisher_id,
+	any(advertiser_id) AS advertiser_id,
+	countIf(event_type = 'impression') AS impressions,
+	countIf(event_type = 'click') AS clicks,
+	countIf(event_type = 'click' AND NOT not_billable) AS billable_clicks,
+	countIf(event_type = 'viewable') AS viewables,
+	countIf(event_type = 'conversion') AS conversions,
+	sumIf(price, event_type = 'click' AND NOT not_billable) AS spend,
+	sumIf(value, event_type = 'conversion') AS conversion_value,
+	now() AS updated_at
+FROM %[3]s
+WHERE deleted_at IS NULL
+GROUP BY bucket, ad_id, publisher_id`
+
+/* Materialized view feeding the rollups of one granularity, on every insert into events. */
+const CLICKHOUSE_ROLLUP_VIEW = "CREATE MATERIALIZED VIEW IF NOT EXISTS rollups_%[1]s_mv TO rollups AS " + CLICKHOUSE_ROLLUP_SELECT
+
+const CLICKHOUSE_ROLLUP_COLUMNS = "granularity, bucket, ad_id, publisher_id, advertiser_id, impressions, clicks, " +
+	"billable_clicks, viewables, conversions, spend, conversion_value, updated_at"
+
+// ClickHouseStore keeps the events in ClickHouse, which maintains their rollups itself
+type ClickHouseStore struct {
+	db *gorm.DB
+}
+
+func (s *ClickHouseStore) DB() *gorm.DB {
+	return s.db
+}
+
+func (s *ClickHouseStore) Migrate() error {
+	if err := s.db.Set("gorm:table_options", CLICKHOUSE_EVENTS_OPTIONS).AutoMigrate(&Event{}); err != nil {
+		return err
+	}
+	if err := s.db.Exec(CLICKHOUSE_ROLLUPS_TABLE).Error; err != nil {
+		return err
+	}
+	if err := s.db.Set("gorm:table_options", CLICKHOUSE_REACH_OPTIONS).AutoMigrate(&ReachSketch{}); err != nil {
+		return err
+	}
+	if err := s.db.Set("gorm:table_options", CLICKHOUSE_ATTRIBUTION_OPTIONS).AutoMigrate(&Attribution{}); err != nil {
+		return err
+	}
+	if err := s.db.Set("gorm:table_options", CLICKHOUSE_QUALITY_OPTIONS).AutoMigrate(&PublisherQuality{}); err != nil {
+		return err
+	}
+	if err := s.db.AutoMigrate(&ScheduledReport{}); err != nil {
+		return err
+	}
+	for granularity, size := range rollupGranularities {
+		if err := s.db.Exec(fmt.Sprintf(CLICKHOUSE_ROLLUP_VIEW, granularity, size, "events")).Error; err != nil {
+			return fmt.Errorf("%s rollup view: %v", granularity, err)
+		}
+	}
+	return nil
+}
+
+/*
+InsertEvents skips the events already stored before inserting a batch,
+since the materialized views would count a duplicate before the engine
+gets to merge it away. Partitions are consumed by a single worker, so
+no other insert of the same events can run meanwhile.
+*/
+func (s *ClickHouseStore) InsertEvents(events []*Event) ([]*Event, error) {
+	inserted, err := newEvents(s.db, events)
+	if err != nil || len(inserted) == 0 {
+		return inserted, err
+	}
+	now := time.Now()
+	for _, event := range inserted {
+		event.CreatedAt, event.UpdatedAt = now, now
+	}
+	if err := s.db.CreateInBatches(inserted, BATCH_SIZE).Error; err != nil {
+		return nil, err
+	}
+	return inserted, nil
+}
+
+// RollupEvents has nothing to do, the materialized views roll events up as they are inserted
+func (s *ClickHouseStore) RollupEvents() error {
+	return nil
+}
+
+/*
+RebuildRollups deletes the rollups of the whole days between from and
+to, waiting for the mutation to complete, and inserts them again from
+the deduplicated events.
+*/
+func (s *ClickHouseStore) RebuildRollups(from, to time.Time) error {
+	start, end := from.Truncate(DAY).Unix(), to.Add(DAY-time.Second).Truncate(DAY).Unix()
+	err := s.db.Exec("ALTER TABLE rollups DELETE WHERE bucket >= ? AND bucket < ? SETTINGS mutations_sync = 2", start, end).Error
+	if err != nil {
+		return err
+	}
+	for granularity, size := range rollupGranularities {
+		source := "(SELECT * FROM events FINAL WHERE time >= ? AND time < ?)"
+		statement := "INSERT INTO rollups (" + CLICKHOUSE_ROLLUP_COLUMNS + ") " + fmt.Sprintf(CLICKHOUSE_ROLLUP_SELECT, granularity, size, source)
+		if err := s.db.Exec(statement, start, end).Error; err != nil {
+			return fmt.Errorf("%s rollup: %v", granularity, err)
+		}
+	}
+	return nil
+}
+
+// ApplyRetention drops the daily partitions of events that end before the cutoff
+func (s *ClickHouseStore) ApplyRetention(cutoff time.Time) error {
+	var partitions []string
+	err := s.db.Raw("SELECT DISTINCT partition FROM system.parts WHERE database = currentDatabase() AND table = 'events' AND active").
+		Scan(&partitions).Error
+	if err != nil {
+		return err
+	}
+	for _, partition := range partitions {
+		day, err := time.Parse(PARTITION_NAME_LAYOUT, partition)
+		if err != nil || day.AddDate(0, 0, 1).After(cutoff) {
+			continue
+		}
+		if err := s.db.Exec("ALTER TABLE events DROP PARTITION " + partition).Error; err != nil {
+			return err
+		}
+		log.Printf("Dropped event partition %s", partition)
+	}
+	return nil
+}
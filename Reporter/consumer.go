@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+)
+
+/* A partition worker flushes its batch once it holds BATCH_SIZE messages, or every BATCH_INTERVAL. */
+const BATCH_SIZE = 500
+const BATCH_INTERVAL = time.Second
+const PARTITION_QUEUE_SIZE = 2 * BATCH_SIZE
+
+var consumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "reporter_consumer_lag",
+	Help: "Messages left to fetch in each partition, by consumer group.",
+}, []string{"group", "partition"})
+
+var batchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "reporter_batch_size",
+	Help:    "Messages per flushed batch.",
+	Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+})
+
+var batchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name: "reporter_batch_duration_seconds",
+	Help: "Time taken to decode and store a batch.",
+})
+
+var eventLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "reporter_event_latency_seconds",
+	Help:    "Time from an event to its storage.",
+	Buckets: prometheus.ExponentialBuckets(0.25, 2, 12),
+})
+
+var eventsConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "reporter_events_total",
+	Help: "Consumed events, by outcome: inserted, duplicate or dead_letter.",
+}, []string{"outcome"})
+
+var eventsStored = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "reporter_stored_events_total",
+	Help: "Stored events, by type.",
+}, []string{"type"})
+
+var publisherEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "reporter_publisher_events_total",
+	Help: "Billable clicks and impressions stored, by publisher and type.",
+}, []string{"publisher_id", "type"})
+
+/*
+Consumes events, handing each partition to its own worker so that
+partitions are stored in parallel while the events of one ad, which
+share a partition, keep their order. The offset of a message is only
+committed once its batch is stored or dead-lettered. A crash in between
+redelivers the batch, and the unique event IDs turn its second insert
+into a no-op.
+*/
+func consumeEvents(reader *kafka.Reader, deadLetters *kafka.Writer) {
+	dispatchPartitions(reader, GROUP_ID, func(messages <-chan kafka.Message) {
+		runPartitionWorker(reader, deadLetters, messages)
+	})
+}
+
+// dispatchPartitions fetches messages and hands those of each partition to a worker of its own
+func dispatchPartitions(reader *kafka.Reader, group string, worker func(messages <-chan kafka.Message)) {
+	defer reader.Close()
+
+	workers := make(map[int]chan kafka.Message)
+	for {
+		msg, err := reader.FetchMessage(context.Background())
+		if err != nil {
+			log.Printf("could not fetch message: %v", err)
+			continue
+		}
+		consumerLag.WithLabelValues(group, strconv.Itoa(msg.Partition)).Set(float64(msg.HighWaterMark - msg.Offset - 1))
+
+		messages, ok := workers[msg.Partition]
+		if !ok {
+			messages = make(chan kafka.Message, PARTITION_QUEUE_SIZE)
+			workers[msg.Partition] = messages
+			go worker(messages)
+		}
+		messages <- msg
+	}
+}
+
+/*
+retryStore runs a write until it succeeds, backing off between attempts.
+Errors from the data written give up after MAX_PROCESS_ATTEMPTS, while
+those from a store that is out of reach or overloaded are retried for as
+long as it takes, since dead-lettering would lose events that are fine.
+*/
+func retryStore(what string, write func() error) error {
+	backoff := PROCESS_RETRY_BACKOFF
+	for attempt := 1; ; attempt++ {
+		err := write()
+		if err == nil {
+			return nil
+		}
+		transient := isTransientStoreError(err)
+		log.Printf("could not %s (attempt %d, transient %t): %v", what, attempt, transient, err)
+		if !transient && attempt >= MAX_PROCESS_ATTEMPTS {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff = min(2*backoff, PROCESS_MAX_BACKOFF)
+	}
+}
+
+/*
+retryUntilDone runs the follow-up of a stored batch until it succeeds.
+A redelivered batch is not stored again, so its follow-ups would not run
+again either: giving up would lose them for good, while retrying holds
+back the commit of the batch's offsets.
+*/
+func retryUntilDone(what string, followUp func() error) {
+	backoff := PROCESS_RETRY_BACKOFF
+	for attempt := 1; ; attempt++ {
+		err := followUp()
+		if err == nil {
+			return
+		}
+		log.Printf("could not %s (attempt %d): %v", what, attempt, err)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, PROCESS_MAX_BACKOFF)
+	}
+}
+
+// runPartitionWorker stores the messages of one partition in batches, and commits their offsets
+func runPartitionWorker(reader *kafka.Reader, deadLetters *kafka.Writer, messages <-chan kafka.Message) {
+	ticker := time.NewTicker(BATCH_INTERVAL)
+	defer ticker.Stop()
+
+	batch := make([]kafka.Message, 0, BATCH_SIZE)
+	flush := func() {
+		processBatch(batch, deadLetters)
+		last := batch[len(batch)-1]
+		if err := reader.CommitMessages(context.Background(), last); err != nil {
+			log.Printf("could not commit offset %d of partition %d: %v", last.Offset, last.Partition, err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case msg := <-messages:
+			batch = append(batch, msg)
+			if len(batch) >= BATCH_SIZE {
+				flush()
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				flush()
+			}
+		}
+	}
+}
+
+/*
+processBatch stores the events of a batch of messages. Messages that
+cannot be decoded are dead-lettered. A batch that cannot be stored is
+retried, then stored event by event so that only the events at fault
+are dead-lettered. While the store is out of reach, the batch is retried
+until it is back, which holds back the commit of its offsets. The
+viewers of the stored events are then added to the reach sketches and
+their conversions attributed, both retried until they succeed, and their
+counts fed to the live feed.
+*/
+func processBatch(batch []kafka.Message, deadLetters *kafka.Writer) {
+	start := time.Now()
+	batchSize.Observe(float64(len(batch)))
+	defer func() { batchDuration.Observe(time.Since(start).Seconds()) }()
+
+	events := make([]*Event, 0, len(batch))
+	sources := make([]kafka.Message, 0, len(batch))
+	for _, msg := range batch {
+		event, err := decodeEvent(msg)
+		if err != nil {
+			log.Printf("could not unmarshal event: %v", err)
+			sendToDeadLetter(deadLetters, msg, err)
+			eventsConsumed.WithLabelValues("dead_letter").Inc()
+			continue
+		}
+		if event.EventID == "" {
+			event.EventID = messageEventID(msg)
+		}
+		events = append(events, event)
+		sources = append(sources, msg)
+	}
+	if len(events) == 0 {
+		return
+	}
+
+	var inserted []*Event
+	err := retryStore(fmt.Sprintf("insert batch of %d events into DB", len(events)), func() (err error) {
+		inserted, err = store.InsertEvents(events)
+		return err
+	})
+	if err != nil {
+		inserted = inserted[:0]
+		for i, event := range events {
+			var single []*Event
+			err := retryStore("insert event "+event.EventID+" into DB", func() (err error) {
+				single, err = store.InsertEvents([]*Event{event})
+				return err
+			})
+			if err != nil {
+				sendToDeadLetter(deadLetters, sources[i], err)
+				eventsConsumed.WithLabelValues("dead_letter").Inc()
+				continue
+			}
+			inserted = append(inserted, single...)
+		}
+	}
+
+	retryUntilDone(fmt.Sprintf("record reach of %d events", len(inserted)), func() error {
+		return recordReach(inserted)
+	})
+	retryUntilDone("attribute conversions", func() error {
+		return attributeConversions(inserted)
+	})
+
+	if live != nil {
+		live.Add(inserted)
+	}
+
+	eventsConsumed.WithLabelValues("inserted").Add(float64(len(inserted)))
+	eventsConsumed.WithLabelValues("duplicate").Add(float64(len(events) - len(inserted)))
+	for _, event := range inserted {
+		eventLatency.Observe(time.Since(time.Unix(event.Time, 0)).Seconds())
+		eventsStored.WithLabelValues(event.EventType).Inc()
+		if billedByPanel(event) {
+			publisherEvents.WithLabelValues(event.PublisherID, event.EventType).Inc()
+		}
+	}
+}
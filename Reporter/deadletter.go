@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+/* Headers added to dead-lettered messages, on top of their own. */
+const (
+	DEAD_LETTER_REASON_HEADER    = "dead-letter-reason"
+	DEAD_LETTER_TOPIC_HEADER     = "original-topic"
+	DEAD_LETTER_PARTITION_HEADER = "original-partition"
+	DEAD_LETTER_OFFSET_HEADER    = "original-offset"
+)
+
+func setupDeadLetterWriter() *kafka.Writer {
+	return &kafka.Writer{
+		Addr:                   kafka.TCP(BROKER_ADDRESS),
+		Topic:                  DEAD_LETTER_TOPIC,
+		RequiredAcks:           kafka.RequireAll,
+		AllowAutoTopicCreation: true,
+	}
+}
+
+// deadLetterMessage copies a message for the dead-letter topic, recording why and where it failed
+func deadLetterMessage(msg kafka.Message, reason error) kafka.Message {
+	headers := append([]kafka.Header{}, msg.Headers...)
+	headers = append(headers,
+		kafka.Header{Key: DEAD_LETTER_REASON_HEADER, Value: []byte(reason.Error())},
+		kafka.Header{Key: DEAD_LETTER_TOPIC_HEADER, Value: []byte(msg.Topic)},
+		kafka.Header{Key: DEAD_LETTER_PARTITION_HEADER, Value: []byte(strconv.Itoa(msg.Partition))},
+		kafka.Header{Key: DEAD_LETTER_OFFSET_HEADER, Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+	)
+	return kafka.Message{Key: msg.Key, Value: msg.Value, Headers: headers}
+}
+
+/*
+sendToDeadLetter moves a message that cannot be processed to the
+dead-letter topic. It blocks until the write succeeds, since the offset
+of the message is committed right after.
+*/
+func sendToDeadLetter(writer *kafka.Writer, msg kafka.Message, reason error) {
+	deadLetter := deadLetterMessage(msg, reason)
+	for attempt := 1; ; attempt++ {
+		err := writer.WriteMessages(context.Background(), deadLetter)
+		if err == nil {
+			log.Printf("Dead-lettered offset %d of partition %d: %v", msg.Offset, msg.Partition, reason)
+			return
+		}
+		log.Printf("could not dead-letter offset %d of partition %d (attempt %d): %v", msg.Offset, msg.Partition, attempt, err)
+		time.Sleep(PROCESS_RETRY_BACKOFF)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+/* Formats events can be exported in. */
+const (
+	EXPORT_CSV     = "csv"
+	EXPORT_JSONL   = "jsonl"   // One event of the shared schema per line, which replay --file reads back.
+	EXPORT_PARQUET = "parquet" // Snappy compressed.
+)
+
+// ExportedEvent is a row of a CSV or Parquet export, named as in the shared schema
+type ExportedEvent struct {
+	EventID      string `parquet:"event_id"`
+	Type         string `parquet:"type"`
+	AdID         string `parquet:"ad_id"`
+	AdvertiserID string `parquet:"advertiser_id"`
+	PublisherID  string `parquet:"publisher_id"`
+	Price        int64  `parquet:"price"`
+	Timestamp    int64  `parquet:"timestamp"`
+	ClientIPHash string `parquet:"client_ip_hash"`
+	UserAgent    string `parquet:"user_agent"`
+	FraudScore   int64  `parquet:"fraud_score"`
+	NotBillable  bool   `parquet:"not_billable"`
+	FraudReasons string `parquet:"fraud_reasons"` // Comma separated.
+	ResponseID   string `parquet:"response_id"`
+	OrphanClick  bool   `parquet:"orphan_click"`
+	InViewMs     int64  `parquet:"in_view_ms"`
+	ClickID      string `parquet:"click_id"`
+	ConversionID string `parquet:"conversion_id"`
+	Value        int64  `parquet:"value"`
+	Consent      bool   `parquet:"consent"`
+	ViewerHash   string `parquet:"viewer_hash"`
+}
+
+var EXPORT_COLUMNS = []string{"event_id", "type", "ad_id", "advertiser_id", "publisher_id", "price", "timestamp",
+	"client_ip_hash", "user_agent", "fraud_score", "not_billable", "fraud_reasons", "response_id", "orphan_click",
+	"in_view_ms", "click_id", "conversion_id", "value", "consent", "viewer_hash"}
+
+func exportedEvent(event *Event) ExportedEvent {
+	return ExportedEvent{
+		EventID:      event.EventID,
+		Type:         event.EventType,
+		AdID:         event.AdID,
+		AdvertiserID: event.AdvertiserID,
+		PublisherID:  event.PublisherID,
+		Price:        event.Price,
+		Timestamp:    event.Time,
+		ClientIPHash: event.ClientIPHash,
+		UserAgent:    event.UserAgent,
+		FraudScore:   int64(event.FraudScore),
+		NotBillable:  event.NotBillable,
+		FraudReasons: event.FraudReasons,
+		ResponseID:   event.ResponseID,
+		OrphanClick:  event.OrphanClick,
+		InViewMs:     event.InViewMs,
+		ClickID:      event.ClickID,
+		ConversionID: event.ConversionID,
+		Value:        event.Value,
+		Consent:      event.Consent,
+		ViewerHash:   event.ViewerHash,
+	}
+}
+
+// csvRecord lays an exported event out in the order of EXPORT_COLUMNS
+func (e ExportedEvent) csvRecord() []string {
+	return []string{e.EventID, e.Type, e.AdID, e.AdvertiserID, e.PublisherID, strconv.FormatInt(e.Price, 10),
+		strconv.FormatInt(e.Timestamp, 10), e.ClientIPHash, e.UserAgent, strconv.FormatInt(e.FraudScore, 10),
+		strconv.FormatBool(e.NotBillable), e.FraudReasons, e.ResponseID, strconv.FormatBool(e.OrphanClick),
+		strconv.FormatInt(e.InViewMs, 10), e.ClickID, e.ConversionID, strconv.FormatInt(e.Value, 10),
+		strconv.FormatBool(e.Consent), e.ViewerHash}
+}
+
+/*
+runExport runs the export command, which dumps the events of a time
+range ordered by time:
+
+	reporter export --from 2024-05-01T00:00:00Z --to 2024-05-02T00:00:00Z --format parquet --output events.parquet
+
+--to defaults to now, --from to a day before --to, and --output to the
+standard output.
+*/
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	fromFlag := flags.String("from", "", "start of the range")
+	toFlag := flags.String("to", "", "end of the range, exclusive")
+	format := flags.String("format", EXPORT_CSV, "csv, jsonl or parquet")
+	output := flags.String("output", "-", "file to write, - for the standard output")
+	flags.Parse(args)
+
+	to, err := parseReportTime(*toFlag, time.Now().UTC())
+	if err != nil {
+		return errors.New("invalid --to")
+	}
+	from, err := parseReportTime(*fromFlag, to.Add(-DEFAULT_REPORT_RANGE))
+	if err != nil {
+		return errors.New("invalid --from")
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	var write func(events []*Event) error
+	var close func() error
+	switch strings.ToLower(*format) {
+	case EXPORT_CSV:
+		writer := csv.NewWriter(w)
+		writer.Write(EXPORT_COLUMNS)
+		write = func(events []*Event) error {
+			for _, event := range events {
+				writer.Write(exportedEvent(event).csvRecord())
+			}
+			writer.Flush()
+			return writer.Error()
+		}
+		close = func() error { return nil }
+	case EXPORT_JSONL:
+		encoder := json.NewEncoder(w)
+		write = func(events []*Event) error {
+			for _, event := range events {
+				if err := encoder.Encode(toSchemaEvent(event)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		close = func() error { return nil }
+	case EXPORT_PARQUET:
+		writer := parquet.NewGenericWriter[ExportedEvent](w, parquet.Compression(&parquet.Snappy))
+		write = func(events []*Event) error {
+			rows := make([]ExportedEvent, len(events))
+			for i, event := range events {
+				rows[i] = exportedEvent(event)
+			}
+			_, err := writer.Write(rows)
+			return err
+		}
+		close = writer.Close
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	exported, err := exportEvents(from, to, write)
+	if err != nil {
+		return err
+	}
+	if err := close(); err != nil {
+		return err
+	}
+	log.Printf("Exported %d events", exported)
+	return nil
+}
+
+/*
+exportEvents hands the events of a time range to write, one page at a
+time. Pages follow each other by time and event ID rather than by
+offset, so that a long export does not slow down as it goes.
+*/
+func exportEvents(from, to time.Time, write func(events []*Event) error) (int, error) {
+	exported := 0
+	lastTime, lastID := from.Unix(), ""
+	for {
+		var events []*Event
+		err := db.Where("time >= ? AND time < ?", from.Unix(), to.Unix()).
+			Where("time > ? OR (time = ? AND event_id > ?)", lastTime, lastTime, lastID).
+			Order("time, event_id").Limit(BATCH_SIZE).Find(&events).Error
+		if err != nil {
+			return exported, err
+		}
+		if len(events) == 0 {
+			return exported, nil
+		}
+		if err := write(events); err != nil {
+			return exported, err
+		}
+		exported += len(events)
+		lastTime, lastID = events[len(events)-1].Time, events[len(events)-1].EventID
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"eventschema"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const LIVE_API = "/live"
+
+/* Seconds of counts kept in memory, and sent to a subscriber as soon as it connects. */
+const LIVE_WINDOW = 60
+
+/* Ticks a subscriber may fall behind by before its ticks are dropped. */
+const LIVE_SUBSCRIBER_BUFFER = 16
+
+/* Origin browsers may read the feed from unless LIVE_ALLOWED_ORIGIN says otherwise: Panel's. */
+const DEFAULT_LIVE_ALLOWED_ORIGIN = "https://panel.lontra.tech"
+
+/* Dimensions a live token can be scoped to. */
+var liveTokenDimensions = map[string]bool{"advertiser_id": true, "publisher_id": true}
+
+var liveSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "reporter_live_subscribers",
+	Help: "Clients subscribed to the live feed.",
+})
+
+// LiveCount holds the billable events of an ad on a publisher during a second
+type LiveCount struct {
+	AdID         string `json:"ad_id"`
+	AdvertiserID string `json:"advertiser_id"`
+	PublisherID  string `json:"publisher_id"`
+	Impressions  int64  `json:"impressions"`
+	Clicks       int64  `json:"clicks"`
+	Spend        int64  `json:"spend"` // Price of the clicks.
+}
+
+// LiveTick holds the counts of a second, which is empty when nothing was billed
+type LiveTick struct {
+	Time   int64       `json:"time"`
+	Counts []LiveCount `json:"counts"`
+}
+
+type liveKey struct {
+	adID        string
+	publisherID string
+}
+
+/*
+liveFeed aggregates the events stored by the consumer into per second
+counts, and broadcasts every second's counts to its subscribers. Events
+are counted in the second they are stored rather than the second they
+happened, so that late events still show up. Only the events Panel bills
+are counted, so that the counts add up to Panel's columns.
+*/
+type liveFeed struct {
+	mu          sync.Mutex
+	current     map[liveKey]*LiveCount
+	history     []LiveTick
+	subscribers map[chan LiveTick]struct{}
+}
+
+/* Set when consuming, so that replays and other commands do not feed it. */
+var live *liveFeed
+
+func newLiveFeed() *liveFeed {
+	return &liveFeed{
+		current:     make(map[liveKey]*LiveCount),
+		subscribers: make(map[chan LiveTick]struct{}),
+	}
+}
+
+// Add counts the billable events among the stored ones
+func (f *liveFeed) Add(events []*Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, event := range events {
+		if !billedByPanel(event) {
+			continue
+		}
+		key := liveKey{event.AdID, event.PublisherID}
+		count, ok := f.current[key]
+		if !ok {
+			count = &LiveCount{AdID: event.AdID, AdvertiserID: event.AdvertiserID, PublisherID: event.PublisherID}
+			f.current[key] = count
+		}
+		switch event.EventType {
+		case eventschema.TYPE_IMPRESSION:
+			count.Impressions++
+		case eventschema.TYPE_CLICK:
+			count.Clicks++
+			count.Spend += event.Price
+		}
+	}
+}
+
+// run closes a tick every second. It blocks the calling goroutine indefinitely.
+func (f *liveFeed) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		f.tick(now)
+	}
+}
+
+// tick closes the current second and sends its counts to the subscribers
+func (f *liveFeed) tick(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tick := LiveTick{Time: now.Unix(), Counts: make([]LiveCount, 0, len(f.current))}
+	for _, count := range f.current {
+		tick.Counts = append(tick.Counts, *count)
+	}
+	sort.Slice(tick.Counts, func(i, j int) bool {
+		if tick.Counts[i].AdID != tick.Counts[j].AdID {
+			return tick.Counts[i].AdID < tick.Counts[j].AdID
+		}
+		return tick.Counts[i].PublisherID < tick.Counts[j].PublisherID
+	})
+	f.current = make(map[liveKey]*LiveCount)
+
+	f.history = append(f.history, tick)
+	if len(f.history) > LIVE_WINDOW {
+		f.history = f.history[len(f.history)-LIVE_WINDOW:]
+	}
+	for subscriber := range f.subscribers {
+		select {
+		case subscriber <- tick:
+		default: // The subscriber is too slow, it misses this tick.
+		}
+	}
+}
+
+// subscribe returns a channel of the coming ticks, and the ticks of the window so far
+func (f *liveFeed) subscribe() (chan LiveTick, []LiveTick) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	subscriber := make(chan LiveTick, LIVE_SUBSCRIBER_BUFFER)
+	f.subscribers[subscriber] = struct{}{}
+	liveSubscribers.Inc()
+	return subscriber, append([]LiveTick(nil), f.history...)
+}
+
+func (f *liveFeed) unsubscribe(subscriber chan LiveTick) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.subscribers, subscriber)
+	liveSubscribers.Dec()
+}
+
+// filterTick keeps the counts of a tick matching the given IDs, empty ones matching all
+func filterTick(tick LiveTick, adID, advertiserID, publisherID string) LiveTick {
+	filtered := LiveTick{Time: tick.Time, Counts: make([]LiveCount, 0)}
+	for _, count := range tick.Counts {
+		if (adID == "" || count.AdID == adID) &&
+			(advertiserID == "" || count.AdvertiserID == advertiserID) &&
+			(publisherID == "" || count.PublisherID == publisherID) {
+			filtered.Counts = append(filtered.Counts, count)
+		}
+	}
+	return filtered
+}
+
+/*
+verifyLiveToken checks a token Panel signed with LIVE_TOKEN_SECRET for one
+advertiser's or publisher's page, and returns the dimension and ID it is
+scoped to. Tokens read dimension.id.expiry.signature, the signature being
+the hex HMAC-SHA256 of the rest.
+*/
+func verifyLiveToken(token, secret string, now time.Time) (dimension, id string, ok bool) {
+	parts := strings.Split(token, ".")
+	if secret == "" || len(parts) != 4 || !liveTokenDimensions[parts[0]] || parts[1] == "" {
+		return "", "", false
+	}
+	expiry, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || now.Unix() >= expiry {
+		return "", "", false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(parts[:3], ".")))
+	if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(parts[3])) {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+/*
+Streams the per second counts as server-sent events named "counts",
+starting with the last LIVE_WINDOW seconds. Every second is sent, even
+without counts, so that clients can tell the stream is alive. The
+counts can be narrowed with the ad_id, advertiser_id and publisher_id
+query parameters. EventSource cannot send headers, so browsers pass a
+live token as the token query parameter, which limits the counts to its
+advertiser or publisher. Other clients may send ADMIN_TOKEN instead.
+*/
+func sendLive(c *gin.Context) {
+	adID, advertiserID, publisherID := c.Query("ad_id"), c.Query("advertiser_id"), c.Query("publisher_id")
+	admin := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	adminToken := getEnv("ADMIN_TOKEN", "")
+	if adminToken == "" || subtle.ConstantTimeCompare([]byte(admin), []byte(adminToken)) != 1 {
+		dimension, id, ok := verifyLiveToken(c.Query("token"), getEnv("LIVE_TOKEN_SECRET", ""), time.Now())
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		if dimension == "advertiser_id" {
+			advertiserID = id
+		} else {
+			publisherID = id
+		}
+	}
+	if live == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "live feed is not running"})
+		return
+	}
+
+	subscriber, history := live.subscribe()
+	defer live.unsubscribe(subscriber)
+
+	c.Header("Access-Control-Allow-Origin", getEnv("LIVE_ALLOWED_ORIGIN", DEFAULT_LIVE_ALLOWED_ORIGIN))
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // Keeps proxies from buffering the stream.
+	for _, tick := range history {
+		c.SSEvent("counts", filterTick(tick, adID, advertiserID, publisherID))
+	}
+	c.Writer.Flush()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case tick := <-subscriber:
+			c.SSEvent("counts", filterTick(tick, adID, advertiserID, publisherID))
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// signLiveToken signs a token the way Panel does
+func signLiveToken(secret, dimension, id string, expiry time.Time) string {
+	payload := dimension + "." + id + "." + strconv.FormatInt(expiry.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return payload + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyLiveToken(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	valid := signLiveToken("secret", "advertiser_id", "5", now.Add(time.Hour))
+
+	tests := []struct {
+		name      string
+		token     string
+		secret    string
+		dimension string
+		id        string
+		ok        bool
+	}{
+		{"advertiser token", valid, "secret", "advertiser_id", "5", true},
+		{"publisher token", signLiveToken("secret", "publisher_id", "7", now.Add(time.Hour)), "secret", "publisher_id", "7", true},
+		{"no secret configured", valid, "", "", "", false},
+		{"other secret", valid, "other", "", "", false},
+		{"expired", signLiveToken("secret", "advertiser_id", "5", now), "secret", "", "", false},
+		{"unknown dimension", signLiveToken("secret", "ad_id", "5", now.Add(time.Hour)), "secret", "", "", false},
+		{"tampered ID", "advertiser_id.6" + valid[len("advertiser_id.5"):], "secret", "", "", false},
+		{"malformed", "advertiser_id.5", "secret", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dimension, id, ok := verifyLiveToken(tt.token, tt.secret, now)
+			if dimension != tt.dimension || id != tt.id || ok != tt.ok {
+				t.Errorf("got %q %q %t, want %q %q %t", dimension, id, ok, tt.dimension, tt.id, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSendLiveRequiresToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("LIVE_TOKEN_SECRET", "secret")
+	t.Setenv("ADMIN_TOKEN", "admin")
+	router := gin.New()
+	router.GET(LIVE_API, sendLive)
+
+	// The live feed is not running in tests: authorized requests get that far.
+	token := signLiveToken("secret", "publisher_id", "7", time.Now().Add(time.Hour))
+	tests := []struct {
+		name          string
+		query         string
+		authorization string
+		code          int
+	}{
+		{"no token", "?publisher_id=7", "", http.StatusUnauthorized},
+		{"invalid token", "?publisher_id=7&token=nope", "", http.StatusUnauthorized},
+		{"live token", "?publisher_id=7&token=" + token, "", http.StatusServiceUnavailable},
+		{"admin token", "", "Bearer admin", http.StatusServiceUnavailable},
+		{"wrong admin token", "", "Bearer other", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, LIVE_API+tt.query, nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.code {
+				t.Errorf("got %d, want %d", w.Code, tt.code)
+			}
+		})
+	}
+}
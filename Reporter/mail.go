@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+/*
+Reports are mailed through SMTP_ADDR. Any SMTP server will do, such as
+a local stand-in like MailHog while testing. SMTP_USERNAME enables
+PLAIN authentication, which net/smtp only allows over TLS or to localhost.
+*/
+const DEFAULT_SMTP_ADDR = "localhost:1025"
+const DEFAULT_SMTP_FROM = "reports@lontra.tech"
+
+// base64Lines encodes data in base64, wrapped at 76 characters as MIME requires
+func base64Lines(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var lines bytes.Buffer
+	for len(encoded) > 76 {
+		lines.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	lines.WriteString(encoded + "\r\n")
+	return lines.Bytes()
+}
+
+// reportEmail builds a multipart email holding the HTML report as body and the CSV report as attachment
+func reportEmail(from string, to []string, rendered *RenderedReport) ([]byte, error) {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+
+	html, err := parts.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/html; charset=utf-8"},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	html.Write(base64Lines(rendered.HTML))
+
+	attachment, err := parts.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/csv; charset=utf-8"},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {fmt.Sprintf("attachment; filename=\"report-%s.csv\"", rendered.To.Format("2006-01-02"))},
+	})
+	if err != nil {
+		return nil, err
+	}
+	attachment.Write(base64Lines(rendered.CSV))
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", from)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", rendered.Name))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", parts.Boundary())
+	message.Write(body.Bytes())
+	return message.Bytes(), nil
+}
+
+// sendReportEmail mails a rendered report to the given addresses
+func sendReportEmail(recipients []string, rendered *RenderedReport) error {
+	addr := getEnv("SMTP_ADDR", DEFAULT_SMTP_ADDR)
+	from := getEnv("SMTP_FROM", DEFAULT_SMTP_FROM)
+	message, err := reportEmail(from, recipients, rendered)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if username := getEnv("SMTP_USERNAME", ""); username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		auth = smtp.PlainAuth("", username, getEnv("SMTP_PASSWORD", ""), host)
+	}
+	return smtp.SendMail(addr, auth, from, recipients, message)
+}
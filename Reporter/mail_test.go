@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"net/mail"
+	"testing"
+	"time"
+)
+
+func TestReportEmailSubject(t *testing.T) {
+	tests := []struct {
+		name string
+	}{
+		{"Weekly ads"},
+		{"Réclames de la semaine"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rendered := &RenderedReport{Name: tt.name, To: time.Now(), HTML: []byte("<p></p>"), CSV: []byte("a\n")}
+			message, err := reportEmail("reports@example.com", []string{"ops@example.com"}, rendered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := mail.ReadMessage(bytes.NewReader(message))
+			if err != nil {
+				t.Fatalf("could not parse email: %v", err)
+			}
+			subject, err := new(mail.AddressParser).WordDecoder.DecodeHeader(parsed.Header.Get("Subject"))
+			if err != nil || subject != tt.name {
+				t.Errorf("subject %q (%v), want %q", subject, err, tt.name)
+			}
+		})
+	}
+}
+
+func TestScheduledReportNameControlCharacters(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"Weekly ads", true},
+		{"Weekly ads\r\nBcc: victim@example.com", false},
+		{"Weekly\tads", false},
+	}
+	for _, tt := range tests {
+		report := ScheduledReport{Name: tt.name, Schedule: "0 0 8 * * MON", Dimension: "ads", Delivery: DELIVERY_DIRECTORY}
+		if err := report.setDefaults(); (err == nil) != tt.valid {
+			t.Errorf("setDefaults(%q) = %v, want valid %t", tt.name, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const PARTITION_PREMAKE_DAYS = 3 // Daily partitions are created this many days ahead.
+const PARTITION_NAME_LAYOUT = "20060102"
+
+/*
+PostgresStore partitions the events table by day on the event time, so
+that retention drops whole partitions instead of deleting rows. Only a
+new events table is partitioned: an existing one is kept as it is, and
+retention deletes its old rows.
+*/
+type PostgresStore struct {
+	db *gorm.DB
+}
+
+func (s *PostgresStore) DB() *gorm.DB {
+	return s.db
+}
+
+func (s *PostgresStore) Migrate() error {
+	if !s.db.Migrator().HasTable(&Event{}) {
+		if err := s.createPartitionedEvents(); err != nil {
+			return err
+		}
+	}
+	if err := s.db.AutoMigrate(&Event{}, &Rollup{}, &Watermark{}, &ScheduledReport{}, &ReachSketch{}, &Attribution{}, &PublisherQuality{}); err != nil {
+		return err
+	}
+	return s.ensurePartitions(time.Now().UTC())
+}
+
+/*
+createPartitionedEvents creates the partitioned events table with the
+columns the partitioning depends on. AutoMigrate adds the others. The
+partition key has to be part of the primary key and of unique indexes,
+which is harmless for event IDs since a redelivered event keeps its time.
+*/
+func (s *PostgresStore) createPartitionedEvents() error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		statements := []string{
+			"CREATE TABLE events (id bigserial, time bigint NOT NULL, event_id text, PRIMARY KEY (id, time)) PARTITION BY RANGE (time)",
+			"CREATE UNIQUE INDEX idx_events_event_id_unique ON events (event_id, time)",
+			"CREATE TABLE events_default PARTITION OF events DEFAULT",
+		}
+		for _, statement := range statements {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *PostgresStore) partitioned() (bool, error) {
+	var partitioned bool
+	err := s.db.Raw("SELECT EXISTS (SELECT 1 FROM pg_partitioned_table WHERE partrelid = 'events'::regclass)").Scan(&partitioned).Error
+	return partitioned, err
+}
+
+/*
+ensurePartitions creates the daily partitions from the given day to
+PARTITION_PREMAKE_DAYS ahead. A day whose events already went to the
+default partition cannot get its own, and is left there.
+*/
+func (s *PostgresStore) ensurePartitions(from time.Time) error {
+	if partitioned, err := s.partitioned(); err != nil || !partitioned {
+		return err
+	}
+	day := from.Truncate(24 * time.Hour)
+	for i := 0; i <= PARTITION_PREMAKE_DAYS; i++ {
+		start := day.AddDate(0, 0, i)
+		statement := fmt.Sprintf("CREATE TABLE IF NOT EXISTS events_%s PARTITION OF events FOR VALUES FROM (%d) TO (%d)",
+			start.Format(PARTITION_NAME_LAYOUT), start.Unix(), start.AddDate(0, 0, 1).Unix())
+		if err := s.db.Exec(statement).Error; err != nil {
+			log.Printf("could not create event partition for %s: %v", start.Format(time.DateOnly), err)
+		}
+	}
+	return nil
+}
+
+func (s *PostgresStore) InsertEvents(events []*Event) ([]*Event, error) {
+	return insertSQLEvents(s.db, events)
+}
+
+func (s *PostgresStore) RollupEvents() error {
+	return rollupSQLEvents(s.db, true)
+}
+
+func (s *PostgresStore) RebuildRollups(from, to time.Time) error {
+	return rebuildSQLRollups(s.db, true, from, to)
+}
+
+/*
+ApplyRetention drops the daily partitions that end before the cutoff,
+and deletes the older rows left in the default partition or in an
+unpartitioned table. It also creates the partitions of the coming days.
+*/
+func (s *PostgresStore) ApplyRetention(cutoff time.Time) error {
+	if err := s.ensurePartitions(time.Now().UTC()); err != nil {
+		return err
+	}
+	partitioned, err := s.partitioned()
+	if err != nil {
+		return err
+	}
+	if !partitioned {
+		return s.db.Unscoped().Where("time < ?", cutoff.Unix()).Delete(&Event{}).Error
+	}
+
+	var partitions []string
+	err = s.db.Raw("SELECT child.relname FROM pg_inherits JOIN pg_class child ON child.oid = pg_inherits.inhrelid " +
+		"WHERE pg_inherits.inhparent = 'events'::regclass AND child.relname <> 'events_default'").
+		Scan(&partitions).Error
+	if err != nil {
+		return err
+	}
+	for _, partition := range partitions {
+		day, err := time.Parse(PARTITION_NAME_LAYOUT, strings.TrimPrefix(partition, "events_"))
+		if err != nil || day.AddDate(0, 0, 1).After(cutoff) {
+			continue
+		}
+		if err := s.db.Exec("DROP TABLE " + partition).Error; err != nil {
+			return err
+		}
+		log.Printf("Dropped event partition %s", partition)
+	}
+	return s.db.Exec("DELETE FROM events_default WHERE time < ?", cutoff.Unix()).Error
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"eventschema"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gorm.io/gorm"
+)
+
+const PUBLISHERS_QUALITY_API = "/publishers/quality"
+const QUALITY_SCHEDULE = "0 30 0 * * *" // Daily at 00:30, once the previous day is complete.
+
+/* Impressions and clicks under which a publisher is not scored, its rates being noise. */
+const MIN_QUALITY_EVENTS = 100
+
+/*
+Each signal is turned into a penalty between 0 and 1, reached at its
+saturation, and the score is 100 minus the weighted penalties. A CTR is
+only penalised from CTR_OUTLIER_Z standard deviations above the CTRs of
+the other publishers, fully at twice that.
+*/
+const (
+	INVALID_SATURATION   = 0.5
+	ORPHAN_SATURATION    = 0.5
+	DUPLICATE_SATURATION = 0.5
+	CTR_OUTLIER_Z        = 3.0
+
+	INVALID_WEIGHT   = 0.4
+	ORPHAN_WEIGHT    = 0.2
+	CTR_WEIGHT       = 0.2
+	DUPLICATE_WEIGHT = 0.2
+)
+
+/* Statuses of a publisher, from its score. AdServer serves excluded publishers no ads, and Panel holds the payouts of the others until reviewed. */
+const (
+	QUALITY_OK       = "ok"
+	QUALITY_REVIEW   = "review"
+	QUALITY_EXCLUDED = "excluded"
+)
+
+const DEFAULT_QUALITY_REVIEW_SCORE = 70.0
+const DEFAULT_QUALITY_EXCLUDE_SCORE = 40.0
+
+var publishersByQuality = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "reporter_publishers_by_quality_status",
+	Help: "Publishers scored on the last scored day, by status.",
+}, []string{"status"})
+
+/*
+PublisherQuality is the quality of the traffic of a publisher on one
+day, Day being the Unix time at which the day starts, in UTC.
+*/
+type PublisherQuality struct {
+	ID              uint      `json:"-" gorm:"primarykey"`
+	Day             int64     `json:"day" gorm:"column:day;index:idx_quality_key"`
+	PublisherID     string    `json:"publisher_id" gorm:"column:publisher_id;index:idx_quality_key"`
+	Impressions     int64     `json:"impressions" gorm:"column:impressions"`
+	Clicks          int64     `json:"clicks" gorm:"column:clicks"`
+	InvalidEvents   int64     `json:"invalid_events" gorm:"column:invalid_events"`   // Flagged not billable by EventServer.
+	InvalidReasons  string    `json:"invalid_reasons" gorm:"column:invalid_reasons"` // reason=count, most frequent first, comma separated.
+	OrphanClicks    int64     `json:"orphan_clicks" gorm:"column:orphan_clicks"`
+	DuplicateEvents int64     `json:"duplicate_events" gorm:"column:duplicate_events"` // Repeated impressions or clicks of one response.
+	InvalidShare    float64   `json:"invalid_share" gorm:"column:invalid_share"`
+	OrphanRate      float64   `json:"orphan_rate" gorm:"column:orphan_rate"`
+	CTR             float64   `json:"ctr" gorm:"column:ctr"`
+	CTRZScore       float64   `json:"ctr_z_score" gorm:"column:ctr_z_score"` // Against the other publishers of the day.
+	DuplicateRatio  float64   `json:"duplicate_ratio" gorm:"column:duplicate_ratio"`
+	Score           float64   `json:"score" gorm:"column:score"` // From 0, worst, to 100.
+	Status          string    `json:"status" gorm:"column:status"`
+	CreatedAt       time.Time `json:"-"`
+}
+
+// publisherTraffic holds the counts of a publisher the score is computed from
+type publisherTraffic struct {
+	PublisherID       string
+	Impressions       int64
+	Clicks            int64
+	InvalidEvents     int64
+	OrphanClicks      int64
+	WithResponse      int64 // Impressions and clicks carrying a response ID.
+	DistinctResponses int64 // Distinct pairs of type and response ID among them.
+}
+
+// saturate maps a rate to a penalty between 0 and 1, reached at the saturation
+func saturate(rate, saturation float64) float64 {
+	return math.Min(math.Max(rate/saturation, 0), 1)
+}
+
+// qualityStatus derives the status of a publisher from its score
+func qualityStatus(score, reviewScore, excludeScore float64) string {
+	switch {
+	case score < excludeScore:
+		return QUALITY_EXCLUDED
+	case score < reviewScore:
+		return QUALITY_REVIEW
+	default:
+		return QUALITY_OK
+	}
+}
+
+// scoreTraffic scores the publishers of a day with enough traffic, comparing their CTRs with each other
+func scoreTraffic(day int64, traffic []publisherTraffic, reviewScore, excludeScore float64) []PublisherQuality {
+	var scored []PublisherQuality
+	for _, t := range traffic {
+		if t.Impressions+t.Clicks < MIN_QUALITY_EVENTS {
+			continue
+		}
+		quality := PublisherQuality{
+			Day:             day,
+			PublisherID:     t.PublisherID,
+			Impressions:     t.Impressions,
+			Clicks:          t.Clicks,
+			InvalidEvents:   t.InvalidEvents,
+			OrphanClicks:    t.OrphanClicks,
+			DuplicateEvents: t.WithResponse - t.DistinctResponses,
+			InvalidShare:    float64(t.InvalidEvents) / float64(t.Impressions+t.Clicks),
+		}
+		if t.Clicks > 0 {
+			quality.OrphanRate = float64(t.OrphanClicks) / float64(t.Clicks)
+		}
+		if t.Impressions > 0 {
+			quality.CTR = float64(t.Clicks) / float64(t.Impressions)
+		}
+		if t.WithResponse > 0 {
+			quality.DuplicateRatio = float64(quality.DuplicateEvents) / float64(t.WithResponse)
+		}
+		scored = append(scored, quality)
+	}
+
+	for i := range scored {
+		var others []float64
+		for j := range scored {
+			if j != i && scored[j].Impressions > 0 {
+				others = append(others, scored[j].CTR)
+			}
+		}
+		if len(others) >= 2 && scored[i].Impressions > 0 {
+			scored[i].CTRZScore, _, _ = zScore(others, scored[i].CTR)
+		}
+
+		penalty := INVALID_WEIGHT*saturate(scored[i].InvalidShare, INVALID_SATURATION) +
+			ORPHAN_WEIGHT*saturate(scored[i].OrphanRate, ORPHAN_SATURATION) +
+			CTR_WEIGHT*saturate(scored[i].CTRZScore-CTR_OUTLIER_Z, CTR_OUTLIER_Z) +
+			DUPLICATE_WEIGHT*saturate(scored[i].DuplicateRatio, DUPLICATE_SATURATION)
+		scored[i].Score = math.Round(1000*(1-penalty)) / 10
+		scored[i].Status = qualityStatus(scored[i].Score, reviewScore, excludeScore)
+	}
+	return scored
+}
+
+// loadInvalidReasons sums the fraud reasons of the invalid events, by publisher
+func loadInvalidReasons(from, to int64) (map[string]string, error) {
+	var rows []struct {
+		PublisherID  string
+		FraudReasons string
+		Events       int64
+	}
+	err := db.Table("events").
+		Select("publisher_id, fraud_reasons, COUNT(1) AS events").
+		Where("not_billable AND NOT orphan_click AND event_type IN ? AND time >= ? AND time < ?",
+			[]string{eventschema.TYPE_IMPRESSION, eventschema.TYPE_CLICK}, from, to).
+		Group("publisher_id, fraud_reasons").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]map[string]int64)
+	for _, row := range rows {
+		if counts[row.PublisherID] == nil {
+			counts[row.PublisherID] = make(map[string]int64)
+		}
+		for _, reason := range strings.Split(row.FraudReasons, ",") {
+			if reason != "" {
+				counts[row.PublisherID][reason] += row.Events
+			}
+		}
+	}
+	reasons := make(map[string]string, len(counts))
+	for publisherID, byReason := range counts {
+		names := make([]string, 0, len(byReason))
+		for name := range byReason {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			if byReason[names[i]] != byReason[names[j]] {
+				return byReason[names[i]] > byReason[names[j]]
+			}
+			return names[i] < names[j]
+		})
+		for i, name := range names {
+			names[i] = fmt.Sprintf("%s=%d", name, byReason[name])
+		}
+		reasons[publisherID] = strings.Join(names, ",")
+	}
+	return reasons, nil
+}
+
+/*
+scorePublishers scores the publishers on the UTC day starting at day,
+replacing the scores of that day if it was scored already.
+*/
+func scorePublishers(day time.Time) ([]PublisherQuality, error) {
+	from, to := day.Unix(), day.Add(DAY).Unix()
+	var traffic []publisherTraffic
+	err := db.Table("events").
+		Select("publisher_id, "+
+			"SUM(CASE WHEN event_type = ? THEN 1 ELSE 0 END) AS impressions, "+
+			"SUM(CASE WHEN event_type = ? THEN 1 ELSE 0 END) AS clicks, "+
+			"SUM(CASE WHEN not_billable AND NOT orphan_click THEN 1 ELSE 0 END) AS invalid_events, "+
+			"SUM(CASE WHEN event_type = ? AND orphan_click THEN 1 ELSE 0 END) AS orphan_clicks, "+
+			"SUM(CASE WHEN response_id <> '' THEN 1 ELSE 0 END) AS with_response, "+
+			"COUNT(DISTINCT CASE WHEN response_id <> '' THEN event_type || ':' || response_id END) AS distinct_responses",
+			eventschema.TYPE_IMPRESSION, eventschema.TYPE_CLICK, eventschema.TYPE_CLICK).
+		Where("event_type IN ? AND time >= ? AND time < ?",
+			[]string{eventschema.TYPE_IMPRESSION, eventschema.TYPE_CLICK}, from, to).
+		Group("publisher_id").
+		Scan(&traffic).Error
+	if err != nil {
+		return nil, err
+	}
+	reasons, err := loadInvalidReasons(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	reviewScore, err := strconv.ParseFloat(getEnv("QUALITY_REVIEW_SCORE", ""), 64)
+	if err != nil {
+		reviewScore = DEFAULT_QUALITY_REVIEW_SCORE
+	}
+	excludeScore, err := strconv.ParseFloat(getEnv("QUALITY_EXCLUDE_SCORE", ""), 64)
+	if err != nil {
+		excludeScore = DEFAULT_QUALITY_EXCLUDE_SCORE
+	}
+	scored := scoreTraffic(from, traffic, reviewScore, excludeScore)
+	for i := range scored {
+		scored[i].InvalidReasons = reasons[scored[i].PublisherID]
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("day = ?", from).Delete(&PublisherQuality{}).Error; err != nil {
+			return err
+		}
+		if len(scored) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(scored, BATCH_SIZE).Error
+	})
+	return scored, err
+}
+
+// notifyPanel sends the score and status of a publisher to Panel, which holds the payouts of those not ok
+func notifyPanel(quality PublisherQuality) error {
+	url := fmt.Sprintf("%s/publishers/%s/quality", PANEL_API, quality.PublisherID)
+	body, _ := json.Marshal(gin.H{"score": quality.Score, "status": quality.Status, "day": quality.Day})
+	var err error
+	for attempt := 1; attempt <= WEBHOOK_ATTEMPTS; attempt++ {
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+getEnv("PANEL_ADMIN_TOKEN", ""))
+		var resp *http.Response
+		resp, err = panelClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return nil
+			}
+			err = fmt.Errorf("received status %d", resp.StatusCode)
+			if resp.StatusCode < 500 {
+				return err
+			}
+		}
+		time.Sleep(time.Duration(attempt) * PROCESS_RETRY_BACKOFF)
+	}
+	return err
+}
+
+// scoreYesterday scores the publishers on the previous UTC day, and reports their statuses to Panel
+func scoreYesterday() {
+	day := time.Now().UTC().Truncate(DAY).Add(-DAY)
+	scored, err := scorePublishers(day)
+	if err != nil {
+		log.Printf("could not score publishers: %v", err)
+		return
+	}
+	publishersByQuality.Reset()
+	for _, quality := range scored {
+		publishersByQuality.WithLabelValues(quality.Status).Inc()
+		if err := notifyPanel(quality); err != nil {
+			log.Printf("could not send the quality of publisher %s to Panel: %v", quality.PublisherID, err)
+		}
+	}
+	log.Printf("Scored %d publishers on %s", len(scored), day.Format(time.DateOnly))
+}
+
+/*
+runQualityScoring runs the score-quality command, which scores the
+publishers on a past day again, yesterday by default:
+
+	reporter score-quality --day 2024-05-01
+
+Scores are stored, but not sent to Panel.
+*/
+func runQualityScoring(args []string) error {
+	flags := flag.NewFlagSet("score-quality", flag.ExitOnError)
+	dayFlag := flags.String("day", "", "day to score, as YYYY-MM-DD")
+	flags.Parse(args)
+
+	day := time.Now().UTC().Truncate(DAY).Add(-DAY)
+	if *dayFlag != "" {
+		var err error
+		if day, err = time.Parse(time.DateOnly, *dayFlag); err != nil {
+			return errors.New("invalid --day")
+		}
+	}
+	scored, err := scorePublishers(day)
+	if err != nil {
+		return err
+	}
+	log.Printf("Scored %d publishers on %s", len(scored), day.Format(time.DateOnly))
+	return nil
+}
+
+/*
+Sends the quality of the publishers on a day, the last scored one
+unless ?day=YYYY-MM-DD is given, worst first. ?publisher_id= and
+?status= narrow the publishers down.
+*/
+func sendPublisherQuality(c *gin.Context) {
+	var day int64
+	if value := c.Query("day"); value != "" {
+		parsed, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid day"})
+			return
+		}
+		day = parsed.Unix()
+	} else {
+		err := db.Model(&PublisherQuality{}).Select("COALESCE(MAX(day), 0)").Scan(&day).Error
+		if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	scope := db.Where("day = ?", day)
+	if publisherID := c.Query("publisher_id"); publisherID != "" {
+		scope = scope.Where("publisher_id = ?", publisherID)
+	}
+	if status := c.Query("status"); status != "" {
+		scope = scope.Where("status = ?", status)
+	}
+	qualities := make([]PublisherQuality, 0)
+	if err := scope.Order("score, publisher_id").Find(&qualities).Error; err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, qualities)
+}
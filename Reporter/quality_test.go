@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestScoreTraffic(t *testing.T) {
+	clean := func(id string, clicks int64) publisherTraffic {
+		return publisherTraffic{PublisherID: id, Impressions: 1000, Clicks: clicks, WithResponse: 1000 + clicks, DistinctResponses: 1000 + clicks}
+	}
+	invalid := clean("invalid", 10)
+	invalid.InvalidEvents = 505
+	orphans := clean("orphans", 10)
+	orphans.OrphanClicks = 5
+	duplicates := clean("duplicates", 10)
+	duplicates.DistinctResponses = 505
+	worst := clean("worst", 10)
+	worst.InvalidEvents, worst.OrphanClicks, worst.DistinctResponses = 505, 5, 505
+	traffic := []publisherTraffic{
+		clean("a", 10), clean("b", 12), clean("c", 11),
+		{PublisherID: "small", Impressions: 80, Clicks: 19},
+		invalid, orphans, duplicates, worst,
+		clean("clicky", 500),
+	}
+
+	scored := scoreTraffic(1714521600, traffic, DEFAULT_QUALITY_REVIEW_SCORE, DEFAULT_QUALITY_EXCLUDE_SCORE)
+	byPublisher := make(map[string]PublisherQuality, len(scored))
+	for _, quality := range scored {
+		byPublisher[quality.PublisherID] = quality
+	}
+
+	tests := []struct {
+		name        string
+		publisherID string
+		score       float64
+		status      string
+	}{
+		{"clean traffic", "a", 100, QUALITY_OK},
+		{"half invalid", "invalid", 60, QUALITY_REVIEW},
+		{"half orphan clicks", "orphans", 80, QUALITY_OK},
+		{"half duplicates", "duplicates", 80, QUALITY_OK},
+		{"every signal", "worst", 20, QUALITY_EXCLUDED},
+		{"outlying CTR", "clicky", 80, QUALITY_OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quality, ok := byPublisher[tt.publisherID]
+			if !ok {
+				t.Fatalf("%s was not scored", tt.publisherID)
+			}
+			if quality.Score != tt.score || quality.Status != tt.status {
+				t.Errorf("scored %v (%s), want %v (%s): %+v", quality.Score, quality.Status, tt.score, tt.status, quality)
+			}
+			if quality.Day != 1714521600 {
+				t.Errorf("scored day %d", quality.Day)
+			}
+		})
+	}
+
+	if _, ok := byPublisher["small"]; ok {
+		t.Error("a publisher under MIN_QUALITY_EVENTS was scored")
+	}
+	if got := byPublisher["duplicates"].DuplicateEvents; got != 505 {
+		t.Errorf("counted %d duplicate events, want 505", got)
+	}
+	if got := byPublisher["clicky"].CTRZScore; got < 2*CTR_OUTLIER_Z {
+		t.Errorf("CTR z-score of %v, want at least %v", got, 2*CTR_OUTLIER_Z)
+	}
+}
+
+func TestQualityStatus(t *testing.T) {
+	tests := []struct {
+		score float64
+		want  string
+	}{
+		{100, QUALITY_OK},
+		{70, QUALITY_OK},
+		{69.9, QUALITY_REVIEW},
+		{40, QUALITY_REVIEW},
+		{39.9, QUALITY_EXCLUDED},
+		{0, QUALITY_EXCLUDED},
+	}
+	for _, tt := range tests {
+		if got := qualityStatus(tt.score, DEFAULT_QUALITY_REVIEW_SCORE, DEFAULT_QUALITY_EXCLUDE_SCORE); got != tt.want {
+			t.Errorf("qualityStatus(%v) = %s, want %s", tt.score, got, tt.want)
+		}
+	}
+}
+
+func TestScorePublishersCountsOrphansOnce(t *testing.T) {
+	s := openTestStore(t)
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	var events []*Event
+	for i := 0; i < 100; i++ {
+		events = append(events, storedEvent(fmt.Sprintf("i%d", i), "impression", "1", "7", day.Add(time.Hour)))
+	}
+	orphan := storedEvent("orphan", "click", "1", "7", day.Add(time.Hour))
+	orphan.OrphanClick, orphan.NotBillable, orphan.FraudReasons = true, true, "orphan_click"
+	flagged := storedEvent("flagged", "click", "1", "7", day.Add(time.Hour))
+	flagged.NotBillable, flagged.FraudReasons = true, "click_rate"
+	events = append(events, orphan, flagged)
+	if _, err := s.InsertEvents(events); err != nil {
+		t.Fatal(err)
+	}
+
+	scored, err := scorePublishers(day)
+	if err != nil || len(scored) != 1 {
+		t.Fatalf("scored %v (%v), want one publisher", scored, err)
+	}
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"invalid events", scored[0].InvalidEvents, int64(1)},
+		{"orphan clicks", scored[0].OrphanClicks, int64(1)},
+		{"invalid reasons", scored[0].InvalidReasons, "click_rate=1"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"eventschema"
+	"log"
+	"math"
+	"math/bits"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+/* Reach and frequency reports, served from HyperLogLog sketches of the viewers of each ad and advertiser per day. */
+
+const ADS_REACH_API = "/reports/ads/reach"
+const ADVERTISERS_REACH_API = "/reports/advertisers/reach"
+
+const REACH_COMPACTION_SCHEDULE = "@every 10m"
+
+/*
+Sketches have 2^HLL_PRECISION registers, for a standard error of
+1.04 / sqrt(2^HLL_PRECISION), about 1.6%.
+*/
+const HLL_PRECISION = 12
+const HLL_REGISTERS = 1 << HLL_PRECISION
+
+/* Encodings of the registers of a sketch, given by their first byte. */
+const (
+	HLL_DENSE  = 0 // One byte per register.
+	HLL_SPARSE = 1 // Index (2 bytes) and value (1 byte) of the non-zero registers.
+)
+
+const DAY = 24 * time.Hour
+
+/*
+ReachSketch holds the viewers of the impressions of an ad or an advertiser
+on one day, Day being the Unix time at which the day starts, in UTC.
+Each batch of events adds a row per ad and advertiser it has impressions
+of, and the rows of a day are merged together by the compaction job and
+by the queries.
+*/
+type ReachSketch struct {
+	ID          uint   `gorm:"primarykey"`
+	Dimension   string `gorm:"column:dimension;index:idx_reach_key"` // ad_id or advertiser_id.
+	DimensionID string `gorm:"column:dimension_id;index:idx_reach_key"`
+	Day         int64  `gorm:"column:day;index:idx_reach_key"`
+	Impressions int64  `gorm:"column:impressions"` // Impressions of identified viewers.
+	Registers   []byte `gorm:"column:registers"`
+	CreatedAt   time.Time
+}
+
+// HyperLogLog estimates the number of distinct values added to it
+type HyperLogLog struct {
+	registers [HLL_REGISTERS]uint8
+}
+
+func (h *HyperLogLog) Add(value string) {
+	sum := sha256.Sum256([]byte(value))
+	hash := binary.BigEndian.Uint64(sum[:8])
+	index := hash >> (64 - HLL_PRECISION)
+	rank := uint8(bits.LeadingZeros64(hash<<HLL_PRECISION|1<<(HLL_PRECISION-1)) + 1)
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+}
+
+// Estimate returns the estimated count of distinct values, using linear counting for small counts
+func (h *HyperLogLog) Estimate() int64 {
+	m := float64(HLL_REGISTERS)
+	sum, zeros := 0.0, 0
+	for _, rank := range h.registers {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(math.Round(estimate))
+}
+
+// MarshalBinary encodes the registers sparsely as long as that is smaller
+func (h *HyperLogLog) MarshalBinary() []byte {
+	sparse := []byte{HLL_SPARSE}
+	for i, rank := range h.registers {
+		if rank == 0 {
+			continue
+		}
+		if len(sparse)+3 > HLL_REGISTERS {
+			return append([]byte{HLL_DENSE}, h.registers[:]...)
+		}
+		sparse = append(sparse, byte(i>>8), byte(i), rank)
+	}
+	return sparse
+}
+
+// UnmarshalBinary merges encoded registers into the sketch
+func (h *HyperLogLog) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("empty sketch")
+	}
+	switch data[0] {
+	case HLL_DENSE:
+		if len(data) != HLL_REGISTERS+1 {
+			return errors.New("invalid dense sketch")
+		}
+		for i, rank := range data[1:] {
+			h.registers[i] = max(h.registers[i], rank)
+		}
+	case HLL_SPARSE:
+		if (len(data)-1)%3 != 0 {
+			return errors.New("invalid sparse sketch")
+		}
+		for i := 1; i < len(data); i += 3 {
+			index := int(data[i])<<8 | int(data[i+1])
+			if index >= HLL_REGISTERS {
+				return errors.New("invalid sparse sketch")
+			}
+			h.registers[index] = max(h.registers[index], data[i+2])
+		}
+	default:
+		return errors.New("unknown sketch encoding")
+	}
+	return nil
+}
+
+/*
+viewerKey identifies the viewer of an event: by the hash of the
+publisher's viewer ID, or else by the IP hash and user agent of the
+device. Viewers who did not consent cannot be identified, and are left
+out of the reach.
+*/
+func viewerKey(event *Event) string {
+	if event.ViewerHash != "" {
+		return "viewer:" + event.ViewerHash
+	}
+	if event.ClientIPHash != "" {
+		return "device:" + event.ClientIPHash + "/" + event.UserAgent
+	}
+	return ""
+}
+
+/*
+recordReach adds the viewers of the impressions of a batch of newly
+stored events to the reach sketches, with one new row per ad or
+advertiser and day.
+*/
+func recordReach(events []*Event) error {
+	type key struct {
+		dimension string
+		id        string
+		day       int64
+	}
+	sketches := make(map[key]*HyperLogLog)
+	impressions := make(map[key]int64)
+	for _, event := range events {
+		viewer := viewerKey(event)
+		if event.EventType != eventschema.TYPE_IMPRESSION || viewer == "" {
+			continue
+		}
+		day := time.Unix(event.Time, 0).UTC().Truncate(DAY).Unix()
+		for _, k := range []key{{"ad_id", event.AdID, day}, {"advertiser_id", event.AdvertiserID, day}} {
+			if k.id == "" {
+				continue
+			}
+			if sketches[k] == nil {
+				sketches[k] = &HyperLogLog{}
+			}
+			sketches[k].Add(viewer)
+			impressions[k]++
+		}
+	}
+	if len(sketches) == 0 {
+		return nil
+	}
+
+	rows := make([]ReachSketch, 0, len(sketches))
+	now := time.Now()
+	for k, sketch := range sketches {
+		rows = append(rows, ReachSketch{
+			Dimension: k.dimension, DimensionID: k.id, Day: k.day,
+			Impressions: impressions[k], Registers: sketch.MarshalBinary(), CreatedAt: now,
+		})
+	}
+	return db.CreateInBatches(rows, BATCH_SIZE).Error
+}
+
+/*
+compactReachSketches merges the rows of each sketch into one. Rows are
+only replaced if this run deleted all of them, so that concurrent runs
+cannot count impressions twice. ClickHouse has no transactions to
+guarantee that, and its rows are left to the queries to merge.
+*/
+func compactReachSketches() {
+	if _, ok := store.(*ClickHouseStore); ok {
+		return
+	}
+	var keys []struct {
+		Dimension   string
+		DimensionID string
+		Day         int64
+	}
+	err := db.Model(&ReachSketch{}).
+		Select("dimension, dimension_id, day").
+		Group("dimension, dimension_id, day").
+		Having("COUNT(*) > 1").
+		Scan(&keys).Error
+	if err != nil {
+		log.Printf("could not compact reach sketches: %v", err)
+		return
+	}
+
+	for _, k := range keys {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var rows []ReachSketch
+			if err := tx.Where("dimension = ? AND dimension_id = ? AND day = ?", k.Dimension, k.DimensionID, k.Day).Find(&rows).Error; err != nil {
+				return err
+			}
+			if len(rows) < 2 {
+				return nil
+			}
+			merged := ReachSketch{Dimension: k.Dimension, DimensionID: k.DimensionID, Day: k.Day}
+			var sketch HyperLogLog
+			ids := make([]uint, len(rows))
+			for i, row := range rows {
+				ids[i] = row.ID
+				merged.Impressions += row.Impressions
+				if err := sketch.UnmarshalBinary(row.Registers); err != nil {
+					return err
+				}
+			}
+			deleted := tx.Where("id IN ?", ids).Delete(&ReachSketch{})
+			if deleted.Error != nil {
+				return deleted.Error
+			}
+			if deleted.RowsAffected != int64(len(rows)) {
+				return errors.New("sketch compacted concurrently")
+			}
+			merged.Registers = sketch.MarshalBinary()
+			return tx.Create(&merged).Error
+		})
+		if err != nil {
+			log.Printf("could not compact reach sketch of %s %s: %v", k.Dimension, k.DimensionID, err)
+		}
+	}
+}
+
+// ReachRow holds the reach of one ad or advertiser over one day, or over the whole range
+type ReachRow struct {
+	ID          string    `json:"id"`
+	Bucket      time.Time `json:"bucket"`
+	Impressions int64     `json:"impressions"` // Impressions of identified viewers.
+	Reach       int64     `json:"reach"`       // Estimated distinct viewers.
+	Frequency   float64   `json:"frequency"`   // Average impressions per viewer.
+}
+
+/*
+queryReach merges the sketches of a dimension, ad_id or advertiser_id,
+over the days the query range overlaps, and returns one page of rows
+with the total row count.
+*/
+func queryReach(dimension string, query ReportQuery) ([]ReachRow, int64, error) {
+	scope := db.Model(&ReachSketch{}).
+		Where("dimension = ? AND day >= ? AND day < ?", dimension, query.From.Truncate(DAY).Unix(), query.To.Unix())
+	if value, ok := query.Filters[dimension]; ok {
+		scope = scope.Where("dimension_id = ?", value)
+	}
+	var sketches []ReachSketch
+	if err := scope.Find(&sketches).Error; err != nil {
+		return nil, 0, err
+	}
+
+	type key struct {
+		id  string
+		day int64
+	}
+	merged := make(map[key]*HyperLogLog)
+	impressions := make(map[key]int64)
+	for _, row := range sketches {
+		k := key{row.DimensionID, row.Day}
+		if query.Granularity == GRANULARITY_TOTAL {
+			k.day = query.From.Unix()
+		}
+		if merged[k] == nil {
+			merged[k] = &HyperLogLog{}
+		}
+		if err := merged[k].UnmarshalBinary(row.Registers); err != nil {
+			return nil, 0, err
+		}
+		impressions[k] += row.Impressions
+	}
+
+	keys := make([]key, 0, len(merged))
+	for k := range merged {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].id != keys[j].id {
+			return keys[i].id < keys[j].id
+		}
+		return keys[i].day < keys[j].day
+	})
+	total := int64(len(keys))
+	start := min((query.Page-1)*query.PageSize, len(keys))
+	keys = keys[start:min(start+query.PageSize, len(keys))]
+
+	rows := make([]ReachRow, len(keys))
+	for i, k := range keys {
+		rows[i] = ReachRow{
+			ID:          k.id,
+			Bucket:      time.Unix(k.day, 0).UTC(),
+			Impressions: impressions[k],
+			Reach:       merged[k].Estimate(),
+		}
+		if rows[i].Reach > 0 {
+			rows[i].Frequency = float64(rows[i].Impressions) / float64(rows[i].Reach)
+		}
+	}
+	return rows, total, nil
+}
+
+// sendReach returns a handler serving the reach report of one dimension
+func sendReach(dimension string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query, err := parseReportQuery(c)
+		if err == nil && c.Query("granularity") == "" {
+			query.Granularity = GRANULARITY_TOTAL
+		}
+		if err == nil && query.Granularity != GRANULARITY_DAY && query.Granularity != GRANULARITY_TOTAL {
+			err = errors.New("granularity must be day or total")
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		rows, total, err := queryReach(dimension, query)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "could not build report"})
+			return
+		}
+
+		c.Header("X-Total-Count", strconv.FormatInt(total, 10))
+		if c.Query("format") == "csv" || c.GetHeader("Accept") == "text/csv" {
+			c.Header("Content-Type", "text/csv")
+			c.Status(http.StatusOK)
+			writer := csv.NewWriter(c.Writer)
+			writer.Write([]string{"id", "bucket", "impressions", "reach", "frequency"})
+			for _, row := range rows {
+				writer.Write([]string{row.ID, row.Bucket.Format(time.RFC3339), strconv.FormatInt(row.Impressions, 10),
+					strconv.FormatInt(row.Reach, 10), strconv.FormatFloat(row.Frequency, 'f', 3, 64)})
+			}
+			writer.Flush()
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"data":        rows,
+			"page":        query.Page,
+			"page_size":   query.PageSize,
+			"total":       total,
+			"granularity": query.Granularity,
+			"from":        query.From,
+			"to":          query.To,
+		})
+	}
+}
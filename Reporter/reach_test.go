@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHyperLogLogEstimate(t *testing.T) {
+	tests := []struct {
+		name     string
+		distinct int
+		repeats  int
+	}{
+		{"empty", 0, 1},
+		{"one viewer", 1, 1},
+		{"repeated viewers", 100, 5},
+		{"linear counting range", 1000, 1},
+		{"raw estimate range", 50000, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &HyperLogLog{}
+			for r := 0; r < tt.repeats; r++ {
+				for i := 0; i < tt.distinct; i++ {
+					h.Add(fmt.Sprintf("viewer:%d", i))
+				}
+			}
+			// Three standard errors.
+			tolerance := 3 * 1.04 / math.Sqrt(HLL_REGISTERS) * float64(tt.distinct)
+			if got := h.Estimate(); math.Abs(float64(got-int64(tt.distinct))) > math.Max(tolerance, 1) {
+				t.Errorf("estimated %d, want %d ± %.0f", got, tt.distinct, tolerance)
+			}
+		})
+	}
+}
+
+func TestHyperLogLogMarshalBinary(t *testing.T) {
+	tests := []struct {
+		name     string
+		distinct int
+		encoding byte
+	}{
+		{"few viewers are sparse", 10, HLL_SPARSE},
+		{"many viewers are dense", 20000, HLL_DENSE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &HyperLogLog{}
+			for i := 0; i < tt.distinct; i++ {
+				h.Add(fmt.Sprintf("viewer:%d", i))
+			}
+			data := h.MarshalBinary()
+			if data[0] != tt.encoding {
+				t.Fatalf("encoded as %d, want %d", data[0], tt.encoding)
+			}
+			decoded := &HyperLogLog{}
+			if err := decoded.UnmarshalBinary(data); err != nil {
+				t.Fatalf("could not decode sketch: %v", err)
+			}
+			if decoded.registers != h.registers {
+				t.Error("decoded registers differ from the encoded ones")
+			}
+		})
+	}
+}
+
+func TestHyperLogLogUnmarshalBinaryMerges(t *testing.T) {
+	a, b := &HyperLogLog{}, &HyperLogLog{}
+	for i := 0; i < 1000; i++ {
+		a.Add(fmt.Sprintf("viewer:%d", i))
+		b.Add(fmt.Sprintf("viewer:%d", i+500))
+	}
+	merged := &HyperLogLog{}
+	for _, h := range []*HyperLogLog{a, b} {
+		if err := merged.UnmarshalBinary(h.MarshalBinary()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := merged.Estimate(); math.Abs(float64(got-1500)) > 1500*0.05 {
+		t.Errorf("estimated %d viewers in the union, want about 1500", got)
+	}
+}
+
+func TestHyperLogLogUnmarshalBinaryInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"unknown encoding", []byte{7}},
+		{"short dense", []byte{HLL_DENSE, 1, 2}},
+		{"truncated sparse", []byte{HLL_SPARSE, 0, 1}},
+		{"sparse index out of range", []byte{HLL_SPARSE, 0xff, 0xff, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := (&HyperLogLog{}).UnmarshalBinary(tt.data); err == nil {
+				t.Error("invalid sketch was decoded")
+			}
+		})
+	}
+}
+
+func TestRecordReach(t *testing.T) {
+	s := openTestStore(t)
+	at := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	impression := func(id, viewer string) *Event {
+		event := storedEvent(id, "impression", "1", "7", at)
+		event.ViewerHash = viewer
+		return event
+	}
+	events := []*Event{
+		impression("e1", "a"),
+		impression("e2", "a"),
+		impression("e3", "b"),
+		impression("e4", ""), // Without consent, the viewer cannot be counted.
+		storedEvent("e5", "click", "1", "7", at),
+	}
+	if err := recordReach(events); err != nil {
+		t.Fatalf("could not record reach: %v", err)
+	}
+
+	tests := []struct {
+		dimension   string
+		id          string
+		impressions int64
+		viewers     int64
+	}{
+		{"ad_id", "1", 3, 2},
+		{"advertiser_id", "adv-1", 3, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dimension, func(t *testing.T) {
+			var rows []ReachSketch
+			err := s.DB().Where("dimension = ? AND dimension_id = ? AND day = ?", tt.dimension, tt.id, at.Truncate(DAY).Unix()).
+				Find(&rows).Error
+			if err != nil || len(rows) != 1 {
+				t.Fatalf("got %d rows (%v), want 1", len(rows), err)
+			}
+			sketch := &HyperLogLog{}
+			if err := sketch.UnmarshalBinary(rows[0].Registers); err != nil {
+				t.Fatal(err)
+			}
+			if rows[0].Impressions != tt.impressions || sketch.Estimate() != tt.viewers {
+				t.Errorf("got %d impressions of %d viewers, want %d of %d",
+					rows[0].Impressions, sketch.Estimate(), tt.impressions, tt.viewers)
+			}
+		})
+	}
+}
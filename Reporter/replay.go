@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"eventschema"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const MAX_DUMP_LINE = 1 << 20
+
+/*
+runReplay runs the replay command, which feeds past events through the
+same batches as the consumer:
+
+	reporter replay --from 2024-05-01T00:00:00Z --to 2024-05-02T00:00:00Z
+	reporter replay --partition 3 --from 120000 --to 125000
+	reporter replay --file events.jsonl
+
+Events already stored are skipped by their event ID, so replaying only
+stores the missing ones. Replay reads the topic without a consumer group,
+and leaves the offsets of the consumer as they are.
+*/
+func runReplay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	fromFlag := flags.String("from", "", "start of the range: a time, or an offset with --partition")
+	toFlag := flags.String("to", "", "end of the range, exclusive: a time, or an offset with --partition")
+	partition := flags.Int("partition", -1, "partition whose offsets --from and --to are")
+	file := flags.String("file", "", "JSONL dump of events, as written by export --format jsonl")
+	flags.Parse(args)
+
+	deadLetters := setupDeadLetterWriter()
+	defer deadLetters.Close()
+
+	if *file != "" {
+		return replayFile(*file, deadLetters)
+	}
+	if *fromFlag == "" {
+		return errors.New("--from or --file is required")
+	}
+
+	if *partition >= 0 {
+		from, err := strconv.ParseInt(*fromFlag, 10, 64)
+		if err != nil {
+			return errors.New("invalid --from offset")
+		}
+		to := int64(-1)
+		if *toFlag != "" {
+			if to, err = strconv.ParseInt(*toFlag, 10, 64); err != nil {
+				return errors.New("invalid --to offset")
+			}
+		}
+		return replayPartition(*partition, from, to, time.Time{}, deadLetters)
+	}
+
+	from, err := parseReportTime(*fromFlag, time.Time{})
+	if err != nil {
+		return errors.New("invalid --from")
+	}
+	to, err := parseReportTime(*toFlag, time.Now().UTC())
+	if err != nil {
+		return errors.New("invalid --to")
+	}
+	conn, err := kafka.Dial("tcp", BROKER_ADDRESS)
+	if err != nil {
+		return err
+	}
+	partitions, err := conn.ReadPartitions(TOPIC)
+	conn.Close()
+	if err != nil {
+		return err
+	}
+	for _, p := range partitions {
+		leader, err := kafka.DialLeader(context.Background(), "tcp", BROKER_ADDRESS, TOPIC, p.ID)
+		if err != nil {
+			return err
+		}
+		start, err := leader.ReadOffset(from)
+		leader.Close()
+		if err != nil {
+			return fmt.Errorf("partition %d: %v", p.ID, err)
+		}
+		if err := replayPartition(p.ID, start, -1, to, deadLetters); err != nil {
+			return fmt.Errorf("partition %d: %v", p.ID, err)
+		}
+	}
+	return nil
+}
+
+/*
+replayPartition stores the messages of a partition from an offset on,
+until the offset to (exclusive) if not -1, the first message produced at
+or after until if set, or the end of the partition.
+*/
+func replayPartition(partition int, from, to int64, until time.Time, deadLetters *kafka.Writer) error {
+	leader, err := kafka.DialLeader(context.Background(), "tcp", BROKER_ADDRESS, TOPIC, partition)
+	if err != nil {
+		return err
+	}
+	last, err := leader.ReadLastOffset()
+	leader.Close()
+	if err != nil {
+		return err
+	}
+	if to < 0 || to > last {
+		to = last
+	}
+	if from >= to {
+		return nil
+	}
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   []string{BROKER_ADDRESS},
+		Topic:     TOPIC,
+		Partition: partition,
+		MinBytes:  10e3, // 10KB
+		MaxBytes:  10e6, // 10MB
+	})
+	defer reader.Close()
+	if err := reader.SetOffset(from); err != nil {
+		return err
+	}
+
+	replayed := 0
+	batch := make([]kafka.Message, 0, BATCH_SIZE)
+	for {
+		msg, err := reader.ReadMessage(context.Background())
+		if err != nil {
+			return err
+		}
+		done := !until.IsZero() && !msg.Time.Before(until)
+		if !done {
+			batch = append(batch, msg)
+		}
+		if len(batch) > 0 && (done || len(batch) == BATCH_SIZE || msg.Offset+1 >= to) {
+			processBatch(batch, deadLetters)
+			replayed += len(batch)
+			batch = batch[:0]
+		}
+		if done || msg.Offset+1 >= to {
+			break
+		}
+	}
+	log.Printf("Replayed %d messages of partition %d", replayed, partition)
+	return nil
+}
+
+/*
+replayFile stores the events of a JSONL dump, one event of the shared
+schema per line. Events without an ID are identified by their line.
+*/
+func replayFile(path string, deadLetters *kafka.Writer) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	version := []kafka.Header{{Key: eventschema.VERSION_HEADER, Value: []byte(strconv.Itoa(eventschema.SCHEMA_VERSION))}}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), MAX_DUMP_LINE)
+	replayed, line := 0, int64(0)
+	batch := make([]kafka.Message, 0, BATCH_SIZE)
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var event eventschema.Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		batch = append(batch, kafka.Message{Topic: path, Offset: line, Value: eventschema.Marshal(&event), Headers: version})
+		if len(batch) == BATCH_SIZE {
+			processBatch(batch, deadLetters)
+			replayed += len(batch)
+			batch = batch[:0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(batch) > 0 {
+		processBatch(batch, deadLetters)
+		replayed += len(batch)
+	}
+	log.Printf("Replayed %d events of %s", replayed, path)
+	return nil
+}
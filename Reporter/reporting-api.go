@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+/* Reporting API for advertisers and publishers, served from the rollups. See README.md. */
+
+const ADS_REPORT_API = "/reports/ads"
+const ADVERTISERS_REPORT_API = "/reports/advertisers"
+const PUBLISHERS_REPORT_API = "/reports/publishers"
+
+const GRANULARITY_TOTAL = "total" // One row per dimension over the whole range.
+const DEFAULT_REPORT_RANGE = 24 * time.Hour
+const DEFAULT_PAGE_SIZE = 100
+const MAX_PAGE_SIZE = 1000
+
+// ReportRow holds the statistics of one ad, advertiser or publisher over one bucket
+type ReportRow struct {
+	ID              string    `json:"id"`
+	Bucket          time.Time `json:"bucket"`
+	Impressions     int64     `json:"impressions"`
+	Clicks          int64     `json:"clicks"`
+	BillableClicks  int64     `json:"billable_clicks"`
+	Viewables       int64     `json:"viewables"`
+	Conversions     int64     `json:"conversions"`
+	Spend           int64     `json:"spend"`
+	ConversionValue int64     `json:"conversion_value"`
+	CTR             float64   `json:"ctr"`
+}
+
+// ReportQuery is a report request, as parsed from the query string
+type ReportQuery struct {
+	From        time.Time
+	To          time.Time
+	Granularity string
+	Filters     map[string]string // Column to value, from the ad_id, advertiser_id and publisher_id parameters.
+	Page        int
+	PageSize    int
+}
+
+// parseReportTime accepts RFC 3339 timestamps and Unix seconds
+func parseReportTime(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func parseReportQuery(c *gin.Context) (ReportQuery, error) {
+	var query ReportQuery
+	var err error
+	now := time.Now().UTC()
+	if query.To, err = parseReportTime(c.Query("to"), now); err != nil {
+		return query, errors.New("invalid to")
+	}
+	if query.From, err = parseReportTime(c.Query("from"), query.To.Add(-DEFAULT_REPORT_RANGE)); err != nil {
+		return query, errors.New("invalid from")
+	}
+	if !query.From.Before(query.To) {
+		return query, errors.New("from must be before to")
+	}
+
+	query.Granularity = c.DefaultQuery("granularity", GRANULARITY_HOUR)
+	if _, ok := rollupGranularities[query.Granularity]; !ok && query.Granularity != GRANULARITY_TOTAL {
+		return query, errors.New("granularity must be minute, hour, day or total")
+	}
+
+	query.Filters = make(map[string]string)
+	for _, column := range []string{"ad_id", "advertiser_id", "publisher_id"} {
+		if value := c.Query(column); value != "" {
+			query.Filters[column] = value
+		}
+	}
+
+	if query.Page, err = strconv.Atoi(c.DefaultQuery("page", "1")); err != nil || query.Page < 1 {
+		return query, errors.New("invalid page")
+	}
+	query.PageSize, err = strconv.Atoi(c.DefaultQuery("page_size", strconv.Itoa(DEFAULT_PAGE_SIZE)))
+	if err != nil || query.PageSize < 1 || query.PageSize > MAX_PAGE_SIZE {
+		return query, errors.New("page_size must be between 1 and " + strconv.Itoa(MAX_PAGE_SIZE))
+	}
+	return query, nil
+}
+
+/*
+queryReport sums the rollups by dimension, one of ad_id, advertiser_id
+or publisher_id, and returns one page of rows with the total row count.
+A total report is built from the minute rollups, so that its range is
+honoured to the minute. A range starting within a bucket includes that
+bucket, as it includes the bucket it ends within.
+*/
+func queryReport(dimension string, query ReportQuery) ([]ReportRow, int64, error) {
+	granularity := query.Granularity
+	bucket, groups := "bucket", dimension+", bucket"
+	if granularity == GRANULARITY_TOTAL {
+		granularity = GRANULARITY_MINUTE
+		bucket, groups = strconv.FormatInt(query.From.Unix(), 10), dimension
+	}
+	from := query.From.Truncate(time.Duration(rollupGranularities[granularity]) * time.Second)
+
+	scope := func() *gorm.DB {
+		scope := db.Table("rollups").
+			Where("granularity = ? AND bucket >= ? AND bucket < ?", granularity, from.Unix(), query.To.Unix())
+		for column, value := range query.Filters {
+			scope = scope.Where(column+" = ?", value)
+		}
+		return scope.Group(groups)
+	}
+
+	var total int64
+	if err := db.Table("(?) AS grouped", scope().Select(dimension)).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var rows []struct {
+		ID              string
+		Bucket          int64
+		Impressions     int64
+		Clicks          int64
+		BillableClicks  int64
+		Viewables       int64
+		Conversions     int64
+		Spend           int64
+		ConversionValue int64
+	}
+	err := scope().Select(dimension + " AS id, " + bucket + " AS bucket, " +
+		"SUM(impressions) AS impressions, SUM(clicks) AS clicks, SUM(billable_clicks) AS billable_clicks, " +
+		"SUM(viewables) AS viewables, SUM(conversions) AS conversions, " +
+		"SUM(spend) AS spend, SUM(conversion_value) AS conversion_value").
+		Order(groups).
+		Offset((query.Page - 1) * query.PageSize).
+		Limit(query.PageSize).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	report := make([]ReportRow, len(rows))
+	for i, row := range rows {
+		report[i] = ReportRow{
+			ID:              row.ID,
+			Bucket:          time.Unix(row.Bucket, 0).UTC(),
+			Impressions:     row.Impressions,
+			Clicks:          row.Clicks,
+			BillableClicks:  row.BillableClicks,
+			Viewables:       row.Viewables,
+			Conversions:     row.Conversions,
+			Spend:           row.Spend,
+			ConversionValue: row.ConversionValue,
+		}
+		if row.Impressions > 0 {
+			report[i].CTR = float64(row.Clicks) / float64(row.Impressions)
+		}
+	}
+	return report, total, nil
+}
+
+/* Metrics of a report row, in the order of the report columns. */
+var REPORT_METRICS = []string{"impressions", "clicks", "billable_clicks", "viewables", "conversions", "spend", "conversion_value", "ctr"}
+
+// metricValue formats one metric of a report row
+func metricValue(row ReportRow, metric string) string {
+	switch metric {
+	case "impressions":
+		return strconv.FormatInt(row.Impressions, 10)
+	case "clicks":
+		return strconv.FormatInt(row.Clicks, 10)
+	case "billable_clicks":
+		return strconv.FormatInt(row.BillableClicks, 10)
+	case "viewables":
+		return strconv.FormatInt(row.Viewables, 10)
+	case "conversions":
+		return strconv.FormatInt(row.Conversions, 10)
+	case "spend":
+		return strconv.FormatInt(row.Spend, 10)
+	case "conversion_value":
+		return strconv.FormatInt(row.ConversionValue, 10)
+	case "ctr":
+		return strconv.FormatFloat(row.CTR, 'f', 6, 64)
+	}
+	return ""
+}
+
+// reportTable lays report rows out as a header and records, with the given metrics as columns
+func reportTable(rows []ReportRow, metrics []string) ([]string, [][]string) {
+	header := append([]string{"id", "bucket"}, metrics...)
+	records := make([][]string, len(rows))
+	for i, row := range rows {
+		record := []string{row.ID, row.Bucket.Format(time.RFC3339)}
+		for _, metric := range metrics {
+			record = append(record, metricValue(row, metric))
+		}
+		records[i] = record
+	}
+	return header, records
+}
+
+func writeCSV(w io.Writer, rows []ReportRow, metrics []string) error {
+	header, records := reportTable(rows, metrics)
+	writer := csv.NewWriter(w)
+	writer.Write(header)
+	writer.WriteAll(records)
+	return writer.Error()
+}
+
+func writeReportCSV(c *gin.Context, rows []ReportRow) {
+	c.Header("Content-Type", "text/csv")
+	c.Status(http.StatusOK)
+	writeCSV(c.Writer, rows, REPORT_METRICS)
+}
+
+// sendReport returns a handler serving the report of one dimension
+func sendReport(dimension string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query, err := parseReportQuery(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		rows, total, err := queryReport(dimension, query)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "could not build report"})
+			return
+		}
+
+		c.Header("X-Total-Count", strconv.FormatInt(total, 10))
+		if c.Query("format") == "csv" || c.GetHeader("Accept") == "text/csv" {
+			writeReportCSV(c, rows)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"data":        rows,
+			"page":        query.Page,
+			"page_size":   query.PageSize,
+			"total":       total,
+			"granularity": query.Granularity,
+			"from":        query.From,
+			"to":          query.To,
+		})
+	}
+}
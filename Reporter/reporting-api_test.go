@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueryReportIncludesPartialBuckets(t *testing.T) {
+	s := openTestStore(t)
+	at := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	events := []*Event{
+		storedEvent("e1", "impression", "1", "7", at.Add(10*time.Minute)),
+		storedEvent("e2", "impression", "1", "7", at.Add(40*time.Minute)),
+		storedEvent("e3", "impression", "1", "7", at.Add(70*time.Minute)),
+		storedEvent("e4", "impression", "1", "7", at.Add(100*time.Minute)),
+	}
+	if _, err := s.InsertEvents(events); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RollupEvents(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		granularity string
+		from, to    time.Duration
+		want        int64
+	}{
+		{"hours from within the first", GRANULARITY_HOUR, 30 * time.Minute, 90 * time.Minute, 4},
+		{"aligned hours", GRANULARITY_HOUR, 0, time.Hour, 2},
+		{"day from within it", GRANULARITY_DAY, 30 * time.Minute, 2 * time.Hour, 4},
+		{"total honoured to the minute", GRANULARITY_TOTAL, 30 * time.Minute, 90 * time.Minute, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := ReportQuery{
+				From: at.Add(tt.from), To: at.Add(tt.to), Granularity: tt.granularity,
+				Filters: map[string]string{}, Page: 1, PageSize: DEFAULT_PAGE_SIZE,
+			}
+			rows, _, err := queryReport("ad_id", query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var impressions int64
+			for _, row := range rows {
+				impressions += row.Impressions
+			}
+			if impressions != tt.want {
+				t.Errorf("got %d impressions, want %d", impressions, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+/* Granularities of the rollups, with the size of their buckets in seconds. */
+const (
+	GRANULARITY_MINUTE = "minute"
+	GRANULARITY_HOUR   = "hour"
+	GRANULARITY_DAY    = "day"
+)
+
+var rollupGranularities = map[string]int64{
+	GRANULARITY_MINUTE: 60,
+	GRANULARITY_HOUR:   60 * 60,
+	GRANULARITY_DAY:    24 * 60 * 60,
+}
+
+const ROLLUP_WATERMARK = "rollups"
+const ROLLUP_SCHEDULE = "@every 1m"
+
+var rollupDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "reporter_rollup_duration_seconds",
+	Help: "Time taken by the scheduled rollups, by outcome: success or failure.",
+}, []string{"outcome"})
+
+var lastRollup = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "reporter_rollup_last_success_timestamp_seconds",
+	Help: "Unix time of the last successful rollup.",
+})
+
+/*
+Events are only rolled up once they are this old, so that an insert
+still in flight with a lower ID than the newest event cannot be
+skipped by the watermark.
+*/
+const ROLLUP_LAG = 30 * time.Second
+
+/*
+Rollup holds the counts of one ad on one publisher over one bucket.
+Bucket is the Unix time at which the bucket starts, in UTC.
+*/
+type Rollup struct {
+	ID              uint   `gorm:"primarykey"`
+	Granularity     string `gorm:"column:granularity;uniqueIndex:idx_rollup_key"`
+	Bucket          int64  `gorm:"column:bucket;uniqueIndex:idx_rollup_key"`
+	AdID            string `gorm:"column:ad_id;uniqueIndex:idx_rollup_key"`
+	PublisherID     string `gorm:"column:publisher_id;uniqueIndex:idx_rollup_key"`
+	AdvertiserID    string `gorm:"column:advertiser_id"`
+	Impressions     int64  `gorm:"column:impressions"`
+	Clicks          int64  `gorm:"column:clicks"`
+	BillableClicks  int64  `gorm:"column:billable_clicks"`
+	Viewables       int64  `gorm:"column:viewables"`
+	Conversions     int64  `gorm:"column:conversions"`
+	Spend           int64  `gorm:"column:spend"` // Price of billable clicks.
+	ConversionValue int64  `gorm:"column:conversion_value"`
+	UpdatedAt       time.Time
+}
+
+// Watermark records the ID of the last event a job has processed
+type Watermark struct {
+	Name        string `gorm:"primarykey"`
+	LastEventID uint
+	UpdatedAt   time.Time
+}
+
+/* Counters added up by the upsert, when a bucket already exists. */
+var rollupCounters = []string{"impressions", "clicks", "billable_clicks", "viewables", "conversions", "spend", "conversion_value"}
+
+/*
+rollupSQLEvents folds the events that arrived since the watermark into
+the minute, hour and day rollups. Counts are added to existing buckets,
+and the watermark moves in the same transaction, so a run that fails
+can simply be retried and no event is ever counted twice. Stores that
+can run several reporters lock the watermark row for the run.
+*/
+func rollupSQLEvents(db *gorm.DB, lock bool) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		watermark := Watermark{Name: ROLLUP_WATERMARK}
+		query := tx
+		if lock {
+			query = tx.Clauses(clause.Locking{Strength: "UPDATE"})
+		}
+		if err := query.FirstOrCreate(&watermark).Error; err != nil {
+			return err
+		}
+
+		var upTo uint
+		err := tx.Model(&Event{}).
+			Where("id > ? AND created_at < ?", watermark.LastEventID, time.Now().Add(-ROLLUP_LAG)).
+			Select("COALESCE(MAX(id), 0)").
+			Scan(&upTo).Error
+		if err != nil || upTo == 0 {
+			return err
+		}
+
+		for granularity, size := range rollupGranularities {
+			if err := rollupRange(tx, granularity, size, "id > ? AND id <= ?", watermark.LastEventID, upTo); err != nil {
+				return fmt.Errorf("%s rollup: %v", granularity, err)
+			}
+		}
+
+		watermark.LastEventID = upTo
+		return tx.Save(&watermark).Error
+	})
+}
+
+// rollupEvents runs the rollup of the event store
+func rollupEvents() {
+	start := time.Now()
+	if err := store.RollupEvents(); err != nil {
+		log.Printf("could not roll up events: %v", err)
+		rollupDuration.WithLabelValues("failure").Observe(time.Since(start).Seconds())
+		return
+	}
+	rollupDuration.WithLabelValues("success").Observe(time.Since(start).Seconds())
+	lastRollup.SetToCurrentTime()
+}
+
+/*
+rebuildSQLRollups recomputes the rollups of the whole UTC days between
+from and to from the events, after a fix of the aggregation for
+instance. Only the events up to the watermark are counted, those after
+it are left to the next rollup run.
+*/
+func rebuildSQLRollups(db *gorm.DB, lock bool, from, to time.Time) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		watermark := Watermark{Name: ROLLUP_WATERMARK}
+		query := tx
+		if lock {
+			query = tx.Clauses(clause.Locking{Strength: "UPDATE"})
+		}
+		if err := query.FirstOrCreate(&watermark).Error; err != nil {
+			return err
+		}
+
+		start, end := from.Truncate(DAY).Unix(), to.Add(DAY-time.Second).Truncate(DAY).Unix()
+		if err := tx.Where("bucket >= ? AND bucket < ?", start, end).Delete(&Rollup{}).Error; err != nil {
+			return err
+		}
+		for granularity, size := range rollupGranularities {
+			err := rollupRange(tx, granularity, size, "id <= ? AND time >= ? AND time < ?", watermark.LastEventID, start, end)
+			if err != nil {
+				return fmt.Errorf("%s rollup: %v", granularity, err)
+			}
+		}
+		return nil
+	})
+}
+
+// rollupRange adds the events matching a condition to the rollups of one granularity
+func rollupRange(tx *gorm.DB, granularity string, size int64, condition string, args ...interface{}) error {
+	var rollups []Rollup
+	err := tx.Table("events").
+		Select("time - (time % ?) AS bucket, "+
+			"ad_id, publisher_id, MAX(advertiser_id) AS advertiser_id, "+
+			"SUM(CASE WHEN event_type = 'impression' THEN 1 ELSE 0 END) AS impressions, "+
+			"SUM(CASE WHEN event_type = 'click' THEN 1 ELSE 0 END) AS clicks, "+
+			"SUM(CASE WHEN event_type = 'click' AND NOT not_billable THEN 1 ELSE 0 END) AS billable_clicks, "+
+			"SUM(CASE WHEN event_type = 'viewable' THEN 1 ELSE 0 END) AS viewables, "+
+			"SUM(CASE WHEN event_type = 'conversion' THEN 1 ELSE 0 END) AS conversions, "+
+			"SUM(CASE WHEN event_type = 'click' AND NOT not_billable THEN price ELSE 0 END) AS spend, "+
+			"SUM(CASE WHEN event_type = 'conversion' THEN value ELSE 0 END) AS conversion_value",
+			size).
+		Where(condition, args...).
+		Where("deleted_at IS NULL").
+		Group("bucket, ad_id, publisher_id").
+		Scan(&rollups).Error
+	if err != nil || len(rollups) == 0 {
+		return err
+	}
+	for i := range rollups {
+		rollups[i].Granularity = granularity
+	}
+
+	assignments := map[string]interface{}{"updated_at": time.Now()}
+	for _, counter := range rollupCounters {
+		assignments[counter] = gorm.Expr("rollups." + counter + " + EXCLUDED." + counter)
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "granularity"}, {Name: "bucket"}, {Name: "ad_id"}, {Name: "publisher_id"}},
+		DoUpdates: clause.Assignments(assignments),
+	}).CreateInBatches(&rollups, 500).Error
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRollupEvents(t *testing.T) {
+	s := openTestStore(t)
+	at := time.Date(2024, 5, 1, 10, 15, 30, 0, time.UTC)
+
+	click := func(id string, price int64, billable bool) *Event {
+		event := storedEvent(id, "click", "1", "7", at)
+		event.Price, event.NotBillable = price, !billable
+		return event
+	}
+	conversion := storedEvent("e5", "conversion", "1", "7", at.Add(time.Hour))
+	conversion.Value = 900
+	events := []*Event{
+		storedEvent("e1", "impression", "1", "7", at),
+		storedEvent("e2", "impression", "1", "7", at.Add(2*time.Minute)),
+		click("e3", 120, true),
+		click("e4", 80, false),
+		conversion,
+		storedEvent("e6", "impression", "2", "7", at),
+	}
+	if _, err := s.InsertEvents(events); err != nil {
+		t.Fatalf("could not insert events: %v", err)
+	}
+	// A second run has nothing new to fold in, and must not count the events again.
+	for run := 0; run < 2; run++ {
+		if err := s.RollupEvents(); err != nil {
+			t.Fatalf("could not roll up events: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		granularity string
+		bucket      time.Time
+		adID        string
+		want        Rollup
+	}{
+		{"minute of the first events", GRANULARITY_MINUTE, at.Truncate(time.Minute), "1",
+			Rollup{Impressions: 1, Clicks: 2, BillableClicks: 1, Spend: 120}},
+		{"minute of the later impression", GRANULARITY_MINUTE, at.Truncate(time.Minute).Add(2 * time.Minute), "1",
+			Rollup{Impressions: 1}},
+		{"hour of the clicks", GRANULARITY_HOUR, at.Truncate(time.Hour), "1",
+			Rollup{Impressions: 2, Clicks: 2, BillableClicks: 1, Spend: 120}},
+		{"hour of the conversion", GRANULARITY_HOUR, at.Truncate(time.Hour).Add(time.Hour), "1",
+			Rollup{Conversions: 1, ConversionValue: 900}},
+		{"day", GRANULARITY_DAY, at.Truncate(DAY), "1",
+			Rollup{Impressions: 2, Clicks: 2, BillableClicks: 1, Spend: 120, Conversions: 1, ConversionValue: 900}},
+		{"day of another ad", GRANULARITY_DAY, at.Truncate(DAY), "2",
+			Rollup{Impressions: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Rollup
+			err := s.DB().Where("granularity = ? AND bucket = ? AND ad_id = ? AND publisher_id = ?",
+				tt.granularity, tt.bucket.Unix(), tt.adID, "7").First(&got).Error
+			if err != nil {
+				t.Fatalf("no rollup: %v", err)
+			}
+			if got.Impressions != tt.want.Impressions || got.Clicks != tt.want.Clicks ||
+				got.BillableClicks != tt.want.BillableClicks || got.Spend != tt.want.Spend ||
+				got.Conversions != tt.want.Conversions || got.ConversionValue != tt.want.ConversionValue {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if got.AdvertiserID != "adv-"+tt.adID {
+				t.Errorf("advertiser is %q", got.AdvertiserID)
+			}
+		})
+	}
+}
+
+func TestRollupEventsAddsToBuckets(t *testing.T) {
+	s := openTestStore(t)
+	at := time.Date(2024, 5, 1, 10, 15, 30, 0, time.UTC)
+
+	if _, err := s.InsertEvents([]*Event{storedEvent("e1", "impression", "1", "7", at)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RollupEvents(); err != nil {
+		t.Fatal(err)
+	}
+	// Events too recent for the watermark wait for a later run.
+	recent := storedEvent("e3", "impression", "1", "7", at)
+	recent.CreatedAt = time.Now()
+	if _, err := s.InsertEvents([]*Event{storedEvent("e2", "impression", "1", "7", at), recent}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RollupEvents(); err != nil {
+		t.Fatal(err)
+	}
+
+	var day Rollup
+	if err := s.DB().Where("granularity = ? AND ad_id = ?", GRANULARITY_DAY, "1").First(&day).Error; err != nil {
+		t.Fatal(err)
+	}
+	if day.Impressions != 2 {
+		t.Errorf("day has %d impressions, want 2", day.Impressions)
+	}
+}
+
+func TestRebuildRollups(t *testing.T) {
+	s := openTestStore(t)
+	at := time.Date(2024, 5, 1, 10, 15, 30, 0, time.UTC)
+
+	events := []*Event{
+		storedEvent("e1", "impression", "1", "7", at),
+		storedEvent("e2", "impression", "1", "7", at.Add(DAY)),
+	}
+	if _, err := s.InsertEvents(events); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RollupEvents(); err != nil {
+		t.Fatal(err)
+	}
+	// A corrupted bucket is fixed by the rebuild of its day, which leaves the other days alone.
+	s.DB().Model(&Rollup{}).Where("1 = 1").Update("impressions", 42)
+	if err := s.RebuildRollups(at, at); err != nil {
+		t.Fatalf("could not rebuild rollups: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		day  time.Time
+		want int64
+	}{
+		{"rebuilt day", at.Truncate(DAY), 1},
+		{"day left alone", at.Add(DAY).Truncate(DAY), 42},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rollup Rollup
+			err := s.DB().Where("granularity = ? AND bucket = ?", GRANULARITY_DAY, tt.day.Unix()).First(&rollup).Error
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rollup.Impressions != tt.want {
+				t.Errorf("got %d impressions, want %d", rollup.Impressions, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/robfig/cron"
+	"gorm.io/gorm"
+)
+
+const SCHEDULED_REPORTS_API = "/scheduled_reports"
+const DEFAULT_REPORT_PERIOD = 7 * 24 * time.Hour
+const MAX_SCHEDULED_REPORT_ROWS = 100 * MAX_PAGE_SIZE
+const DEFAULT_REPORT_OUTBOX = "reports"
+
+/* How a scheduled report is delivered. */
+const (
+	DELIVERY_EMAIL     = "email"     // Sent through SMTP_ADDR to the recipients.
+	DELIVERY_DIRECTORY = "directory" // Written to REPORT_OUTBOX_DIR.
+)
+
+/* Dimensions a report can be scheduled on, with the column they group by. */
+var reportDimensions = map[string]string{
+	"ads":         "ad_id",
+	"advertisers": "advertiser_id",
+	"publishers":  "publisher_id",
+}
+
+/*
+ScheduledReport is a report rendered on a cron schedule, covering the
+Period up to the run, and delivered as CSV and HTML. Schedule uses the
+six field syntax of robfig/cron, seconds first: "0 0 8 * * MON" runs on
+Mondays at 8:00.
+*/
+type ScheduledReport struct {
+	gorm.Model
+	Name         string     `json:"name"`
+	Schedule     string     `json:"schedule"`
+	Dimension    string     `json:"dimension"`   // ads, advertisers or publishers.
+	Granularity  string     `json:"granularity"` // As in the reporting API, total by default.
+	Period       string     `json:"period"`      // Go duration covered by the report, 168h by default.
+	Metrics      string     `json:"metrics"`     // Comma separated, every metric by default.
+	AdID         string     `json:"ad_id"`
+	AdvertiserID string     `json:"advertiser_id"`
+	PublisherID  string     `json:"publisher_id"`
+	Delivery     string     `json:"delivery"`
+	Recipients   string     `json:"recipients"` // Comma separated email addresses.
+	LastRunAt    *time.Time `json:"last_run_at"`
+	LastError    string     `json:"last_error"`
+}
+
+// setDefaults fills in the optional fields, and checks the others
+func (r *ScheduledReport) setDefaults() error {
+	// The name is the subject of the emails, where a line break would start a header of its own.
+	if strings.IndexFunc(r.Name, unicode.IsControl) >= 0 {
+		return errors.New("name must not contain control characters")
+	}
+	if _, err := cron.Parse(r.Schedule); err != nil {
+		return fmt.Errorf("invalid schedule: %v", err)
+	}
+	if _, ok := reportDimensions[r.Dimension]; !ok {
+		return errors.New("dimension must be ads, advertisers or publishers")
+	}
+	if r.Granularity == "" {
+		r.Granularity = GRANULARITY_TOTAL
+	}
+	if _, ok := rollupGranularities[r.Granularity]; !ok && r.Granularity != GRANULARITY_TOTAL {
+		return errors.New("granularity must be minute, hour, day or total")
+	}
+	if r.Period == "" {
+		r.Period = DEFAULT_REPORT_PERIOD.String()
+	}
+	if period, err := time.ParseDuration(r.Period); err != nil || period <= 0 {
+		return errors.New("invalid period")
+	}
+	if r.Metrics == "" {
+		r.Metrics = strings.Join(REPORT_METRICS, ",")
+	}
+	for _, metric := range r.metrics() {
+		if metricValue(ReportRow{}, metric) == "" {
+			return fmt.Errorf("unknown metric %q", metric)
+		}
+	}
+
+	switch r.Delivery {
+	case DELIVERY_EMAIL:
+		if _, err := mail.ParseAddressList(r.Recipients); err != nil {
+			return fmt.Errorf("invalid recipients: %v", err)
+		}
+	case DELIVERY_DIRECTORY:
+	default:
+		return errors.New("delivery must be email or directory")
+	}
+	return nil
+}
+
+func (r *ScheduledReport) metrics() []string {
+	metrics := strings.Split(r.Metrics, ",")
+	for i := range metrics {
+		metrics[i] = strings.TrimSpace(metrics[i])
+	}
+	return metrics
+}
+
+// query returns the report request of a run at the given time
+func (r *ScheduledReport) query(now time.Time) ReportQuery {
+	period, _ := time.ParseDuration(r.Period)
+	bucket := time.Hour
+	if size, ok := rollupGranularities[r.Granularity]; ok {
+		bucket = time.Duration(size) * time.Second
+	}
+	to := now.UTC().Truncate(bucket)
+
+	filters := make(map[string]string)
+	for column, value := range map[string]string{"ad_id": r.AdID, "advertiser_id": r.AdvertiserID, "publisher_id": r.PublisherID} {
+		if value != "" {
+			filters[column] = value
+		}
+	}
+	return ReportQuery{From: to.Add(-period), To: to, Granularity: r.Granularity, Filters: filters, Page: 1, PageSize: MAX_PAGE_SIZE}
+}
+
+// RenderedReport is a run of a scheduled report, ready to be delivered
+type RenderedReport struct {
+	Name    string
+	From    time.Time
+	To      time.Time
+	Header  []string
+	Records [][]string
+	CSV     []byte
+	HTML    []byte
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Name}}</title></head>
+<body style="font-family: sans-serif">
+<h2>{{.Name}}</h2>
+<p>From {{.From.Format "2006-01-02 15:04"}} to {{.To.Format "2006-01-02 15:04"}} UTC</p>
+<table border="1" cellpadding="4" cellspacing="0" style="border-collapse: collapse">
+<tr>{{range .Header}}<th>{{.}}</th>{{end}}</tr>
+{{range .Records}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{else}}<tr><td colspan="{{len .Header}}">No events in this period.</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// renderReport queries the rows of a run, up to MAX_SCHEDULED_REPORT_ROWS, and renders them
+func renderReport(report *ScheduledReport, now time.Time) (*RenderedReport, error) {
+	query := report.query(now)
+	var rows []ReportRow
+	for len(rows) < MAX_SCHEDULED_REPORT_ROWS {
+		page, total, err := queryReport(reportDimensions[report.Dimension], query)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, page...)
+		if len(page) < query.PageSize || int64(len(rows)) >= total {
+			break
+		}
+		query.Page++
+	}
+
+	name := report.Name
+	if name == "" {
+		name = fmt.Sprintf("Report %d", report.ID)
+	}
+	rendered := &RenderedReport{Name: name, From: query.From, To: query.To}
+	rendered.Header, rendered.Records = reportTable(rows, report.metrics())
+
+	var csvBuffer, htmlBuffer bytes.Buffer
+	if err := writeCSV(&csvBuffer, rows, report.metrics()); err != nil {
+		return nil, err
+	}
+	if err := reportTemplate.Execute(&htmlBuffer, rendered); err != nil {
+		return nil, err
+	}
+	rendered.CSV, rendered.HTML = csvBuffer.Bytes(), htmlBuffer.Bytes()
+	return rendered, nil
+}
+
+// writeReportFiles drops a rendered report as a CSV and an HTML file into REPORT_OUTBOX_DIR
+func writeReportFiles(report *ScheduledReport, rendered *RenderedReport) error {
+	dir := getEnv("REPORT_OUTBOX_DIR", DEFAULT_REPORT_OUTBOX)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	base := filepath.Join(dir, fmt.Sprintf("report-%d-%s", report.ID, rendered.To.Format("20060102T150405")))
+	if err := os.WriteFile(base+".csv", rendered.CSV, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(base+".html", rendered.HTML, 0644)
+}
+
+// runReport renders a scheduled report and delivers it
+func runReport(report *ScheduledReport, now time.Time) error {
+	rendered, err := renderReport(report, now)
+	if err != nil {
+		return err
+	}
+	if report.Delivery == DELIVERY_EMAIL {
+		recipients, err := mail.ParseAddressList(report.Recipients)
+		if err != nil {
+			return err
+		}
+		to := make([]string, len(recipients))
+		for i, recipient := range recipients {
+			to[i] = recipient.Address
+		}
+		return sendReportEmail(to, rendered)
+	}
+	return writeReportFiles(report, rendered)
+}
+
+// runScheduledReport runs a report from its schedule, and records the outcome
+func runScheduledReport(id uint) {
+	var report ScheduledReport
+	if err := db.First(&report, id).Error; err != nil {
+		log.Printf("could not load scheduled report %d: %v", id, err)
+		return
+	}
+	now := time.Now()
+	lastError := ""
+	if err := runReport(&report, now); err != nil {
+		log.Printf("could not deliver scheduled report %d: %v", id, err)
+		lastError = err.Error()
+	}
+	db.Model(&report).Updates(map[string]interface{}{"last_run_at": now, "last_error": lastError})
+}
+
+/*
+The scheduled reports run on a cron of their own, rebuilt whenever a
+report changes since robfig/cron cannot remove entries.
+*/
+var reportScheduler struct {
+	sync.Mutex
+	cron *cron.Cron
+}
+
+// scheduleReports (re)starts the cron running the scheduled reports
+func scheduleReports() error {
+	var reports []ScheduledReport
+	if err := db.Find(&reports).Error; err != nil {
+		return err
+	}
+	c := cron.New()
+	for _, report := range reports {
+		id := report.ID
+		if err := c.AddFunc(report.Schedule, func() { runScheduledReport(id) }); err != nil {
+			log.Printf("could not schedule report %d: %v", id, err)
+		}
+	}
+
+	reportScheduler.Lock()
+	defer reportScheduler.Unlock()
+	if reportScheduler.cron != nil {
+		reportScheduler.cron.Stop()
+	}
+	reportScheduler.cron = c
+	c.Start()
+	return nil
+}
+
+func findScheduledReport(c *gin.Context) (*ScheduledReport, bool) {
+	var report ScheduledReport
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return nil, false
+	}
+	if err := db.First(&report, id).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "no such report"})
+		return nil, false
+	}
+	return &report, true
+}
+
+// saveScheduledReport validates and stores a report from the request body, then reschedules the reports
+func saveScheduledReport(c *gin.Context, report *ScheduledReport, status int) {
+	stored := *report
+	if err := c.ShouldBindJSON(report); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	report.Model, report.LastRunAt, report.LastError = stored.Model, stored.LastRunAt, stored.LastError
+	if err := report.setDefaults(); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := db.Save(report).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "could not save report"})
+		return
+	}
+	if err := scheduleReports(); err != nil {
+		log.Printf("could not reschedule reports: %v", err)
+	}
+	c.JSON(status, report)
+}
+
+func createScheduledReport(c *gin.Context) {
+	saveScheduledReport(c, &ScheduledReport{}, http.StatusCreated)
+}
+
+func updateScheduledReport(c *gin.Context) {
+	if report, ok := findScheduledReport(c); ok {
+		saveScheduledReport(c, report, http.StatusOK)
+	}
+}
+
+func listScheduledReports(c *gin.Context) {
+	var reports []ScheduledReport
+	if err := db.Order("id").Find(&reports).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "could not list reports"})
+		return
+	}
+	c.JSON(http.StatusOK, reports)
+}
+
+func getScheduledReport(c *gin.Context) {
+	if report, ok := findScheduledReport(c); ok {
+		c.JSON(http.StatusOK, report)
+	}
+}
+
+func deleteScheduledReport(c *gin.Context) {
+	report, ok := findScheduledReport(c)
+	if !ok {
+		return
+	}
+	if err := db.Delete(report).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "could not delete report"})
+		return
+	}
+	if err := scheduleReports(); err != nil {
+		log.Printf("could not reschedule reports: %v", err)
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// runScheduledReportNow delivers a report right away, outside of its schedule
+func runScheduledReportNow(c *gin.Context) {
+	report, ok := findScheduledReport(c)
+	if !ok {
+		return
+	}
+	if err := runReport(report, time.Now()); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"delivered": report.Delivery})
+}
+
+// SetupScheduledReportRoutes registers the API managing scheduled reports
+func SetupScheduledReportRoutes(group *gin.RouterGroup) {
+	group.GET("", listScheduledReports)
+	group.POST("", createScheduledReport)
+	group.GET("/:id", getScheduledReport)
+	group.PUT("/:id", updateScheduledReport)
+	group.DELETE("/:id", deleteScheduledReport)
+	group.POST("/:id/run", runScheduledReportNow)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	clickhousego "github.com/ClickHouse/clickhouse-go/v2"
+	gosqlite "github.com/glebarez/go-sqlite"
+	"github.com/glebarez/sqlite"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/driver/clickhouse"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+/* Stores the events can be kept in, chosen with EVENT_STORE. */
+const (
+	EVENT_STORE_POSTGRES   = "postgres"   // Partitioned by day, for small deployments.
+	EVENT_STORE_CLICKHOUSE = "clickhouse" // Columnar, with materialized rollups, for large ones.
+	EVENT_STORE_SQLITE     = "sqlite"     // Embedded, for local testing.
+)
+
+const DEFAULT_CLICKHOUSE_DSN = "clickhouse://localhost:9000/default"
+const DEFAULT_SQLITE_PATH = "reporter.db"
+const DEFAULT_RETENTION_DAYS = 90 // Raw events are kept this long. Rollups are kept forever.
+const RETENTION_SCHEDULE = "@every 1h"
+
+/*
+EventStore keeps the raw events and their rollups. Every store exposes
+its tables through GORM, so that reports are queried the same way
+whichever store holds them.
+*/
+type EventStore interface {
+	DB() *gorm.DB
+	Migrate() error
+	// InsertEvents stores a batch of events, and returns those that were not stored yet.
+	InsertEvents(events []*Event) ([]*Event, error)
+	// RollupEvents folds the events stored since its last run into the rollups.
+	RollupEvents() error
+	// RebuildRollups recomputes the rollups of the whole days between from and to.
+	RebuildRollups(from, to time.Time) error
+	// ApplyRetention deletes the events that happened before the cutoff.
+	ApplyRetention(cutoff time.Time) error
+}
+
+var store EventStore
+
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+// openEventStore connects to the store configured by EVENT_STORE
+func openEventStore() (EventStore, error) {
+	switch kind := getEnv("EVENT_STORE", EVENT_STORE_POSTGRES); kind {
+	case EVENT_STORE_POSTGRES:
+		CreateDBIfNotExists()
+		db, err := ConnectToDB()
+		return &PostgresStore{db: db}, err
+	case EVENT_STORE_CLICKHOUSE:
+		db, err := gorm.Open(clickhouse.Open(getEnv("CLICKHOUSE_DSN", DEFAULT_CLICKHOUSE_DSN)), &gorm.Config{})
+		return &ClickHouseStore{db: db}, err
+	case EVENT_STORE_SQLITE:
+		db, err := gorm.Open(sqlite.Open(getEnv("SQLITE_PATH", DEFAULT_SQLITE_PATH)), &gorm.Config{})
+		return &SQLiteStore{db: db}, err
+	default:
+		return nil, fmt.Errorf("unknown event store %q", kind)
+	}
+}
+
+// applyRetention deletes the raw events older than EVENT_RETENTION_DAYS, unless it is 0
+func applyRetention() {
+	days, err := strconv.Atoi(getEnv("EVENT_RETENTION_DAYS", strconv.Itoa(DEFAULT_RETENTION_DAYS)))
+	if err != nil || days <= 0 {
+		return
+	}
+	cutoff := time.Now().UTC().AddDate(0, 0, -days)
+	if err := store.ApplyRetention(cutoff); err != nil {
+		log.Printf("could not apply event retention: %v", err)
+	}
+}
+
+/* SQLite result codes of a store that is busy or out of reach, see sqlite.org/rescode.html. */
+const (
+	SQLITE_BUSY     = 5
+	SQLITE_LOCKED   = 6
+	SQLITE_IOERR    = 10
+	SQLITE_FULL     = 13
+	SQLITE_CANTOPEN = 14
+)
+
+/* ClickHouse error codes of a server that is overloaded or out of reach. */
+var clickHouseTransientCodes = map[int32]bool{
+	159: true, // TIMEOUT_EXCEEDED
+	202: true, // TOO_MANY_SIMULTANEOUS_QUERIES
+	209: true, // SOCKET_TIMEOUT
+	210: true, // NETWORK_ERROR
+	241: true, // MEMORY_LIMIT_EXCEEDED
+	242: true, // TABLE_IS_READ_ONLY
+	252: true, // TOO_MANY_PARTS
+}
+
+/*
+isTransientStoreError tells whether an error comes from the store being
+out of reach or overloaded, rather than from the data written, so that
+retrying the same write later can succeed.
+*/
+func isTransientStoreError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) || pgconn.Timeout(err) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// Connection exceptions, insufficient resources, operator intervention and system errors.
+		for _, class := range []string{"08", "53", "57", "58"} {
+			if strings.HasPrefix(pgErr.Code, class) {
+				return true
+			}
+		}
+		return pgErr.Code == "40001" || pgErr.Code == "40P01" // Serialization failures and deadlocks.
+	}
+	var sqliteErr *gosqlite.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code() & 0xff {
+		case SQLITE_BUSY, SQLITE_LOCKED, SQLITE_IOERR, SQLITE_FULL, SQLITE_CANTOPEN:
+			return true
+		}
+		return false
+	}
+	var chErr *clickhousego.Exception
+	if errors.As(err, &chErr) {
+		return clickHouseTransientCodes[chErr.Code]
+	}
+	return false
+}
+
+// newEvents returns the events of a batch not stored yet, without the duplicates within the batch
+func newEvents(tx *gorm.DB, events []*Event) ([]*Event, error) {
+	ids := make([]string, len(events))
+	for i, event := range events {
+		ids[i] = event.EventID
+	}
+	var stored []string
+	if err := tx.Model(&Event{}).Where("event_id IN ?", ids).Pluck("event_id", &stored).Error; err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(events))
+	for _, id := range stored {
+		seen[id] = true
+	}
+	var fresh []*Event
+	for _, event := range events {
+		if !seen[event.EventID] {
+			seen[event.EventID] = true
+			fresh = append(fresh, event)
+		}
+	}
+	return fresh, nil
+}
+
+/*
+insertSQLEvents stores a batch of events in one transaction and returns
+the events it stored. The unique event ID index makes a concurrent
+insert of the same event a no-op, which the pre-check cannot see, so
+each event counts as stored only if its insert added a row.
+*/
+func insertSQLEvents(db *gorm.DB, events []*Event) ([]*Event, error) {
+	var inserted []*Event
+	err := db.Transaction(func(tx *gorm.DB) error {
+		fresh, err := newEvents(tx, events)
+		if err != nil {
+			return err
+		}
+		for _, event := range fresh {
+			result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(event)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 1 {
+				inserted = append(inserted, event)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inserted, nil
+}
+
+// SQLiteStore keeps everything in an embedded SQLite file
+type SQLiteStore struct {
+	db *gorm.DB
+}
+
+func (s *SQLiteStore) DB() *gorm.DB {
+	return s.db
+}
+
+func (s *SQLiteStore) Migrate() error {
+	return s.db.AutoMigrate(&Event{}, &Rollup{}, &Watermark{}, &ScheduledReport{}, &ReachSketch{}, &Attribution{}, &PublisherQuality{})
+}
+
+func (s *SQLiteStore) InsertEvents(events []*Event) ([]*Event, error) {
+	return insertSQLEvents(s.db, events)
+}
+
+func (s *SQLiteStore) RollupEvents() error {
+	return rollupSQLEvents(s.db, false)
+}
+
+func (s *SQLiteStore) RebuildRollups(from, to time.Time) error {
+	return rebuildSQLRollups(s.db, false, from, to)
+}
+
+func (s *SQLiteStore) ApplyRetention(cutoff time.Time) error {
+	return s.db.Unscoped().Where("time < ?", cutoff.Unix()).Delete(&Event{}).Error
+}
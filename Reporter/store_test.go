@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	clickhousego "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/glebarez/sqlite"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// openTestStore points the store and db globals at a fresh SQLite store
+func openTestStore(t *testing.T) *SQLiteStore {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "reporter.db")
+	conn, err := gorm.Open(sqlite.Open(path), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("could not open SQLite store: %v", err)
+	}
+	s := &SQLiteStore{db: conn}
+	if err := s.Migrate(); err != nil {
+		t.Fatalf("could not migrate SQLite store: %v", err)
+	}
+	previousStore, previousDB := store, db
+	store, db = s, conn
+	t.Cleanup(func() {
+		store, db = previousStore, previousDB
+		if sqlDB, err := conn.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return s
+}
+
+// storedEvent returns an event old enough to be rolled up
+func storedEvent(id, eventType, adID, publisherID string, at time.Time) *Event {
+	event := &Event{
+		EventID: id, EventType: eventType, AdID: adID, AdvertiserID: "adv-" + adID,
+		PublisherID: publisherID, Time: at.Unix(),
+	}
+	event.CreatedAt = time.Now().Add(-2 * ROLLUP_LAG)
+	return event
+}
+
+func TestInsertSQLEventsIsIdempotent(t *testing.T) {
+	s := openTestStore(t)
+	at := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		batch []string
+		want  []string
+	}{
+		{"new events", []string{"e1", "e2"}, []string{"e1", "e2"}},
+		{"redelivered batch", []string{"e1", "e2"}, nil},
+		{"partly stored batch", []string{"e2", "e3"}, []string{"e3"}},
+		{"duplicates within a batch", []string{"e4", "e4"}, []string{"e4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := make([]*Event, len(tt.batch))
+			for i, id := range tt.batch {
+				events[i] = storedEvent(id, "impression", "1", "7", at)
+			}
+			inserted, err := insertSQLEvents(s.DB(), events)
+			if err != nil {
+				t.Fatalf("could not insert events: %v", err)
+			}
+			var got []string
+			for _, event := range inserted {
+				got = append(got, event.EventID)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("inserted %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("inserted %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+
+	var count int64
+	s.DB().Model(&Event{}).Count(&count)
+	if count != 4 {
+		t.Errorf("stored %d events, want 4", count)
+	}
+}
+
+func TestInsertSQLEventsReturnsOnlyStoredEvents(t *testing.T) {
+	s := openTestStore(t)
+	at := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	if _, err := insertSQLEvents(s.DB(), []*Event{storedEvent("e1", "impression", "1", "7", at)}); err != nil {
+		t.Fatalf("could not insert events: %v", err)
+	}
+	// A soft-deleted row escapes the pre-check, like one inserted concurrently, but still holds its event ID.
+	if err := s.DB().Where("event_id = ?", "e1").Delete(&Event{}).Error; err != nil {
+		t.Fatalf("could not delete event: %v", err)
+	}
+
+	events := []*Event{storedEvent("e1", "impression", "1", "7", at), storedEvent("e2", "impression", "1", "7", at)}
+	inserted, err := insertSQLEvents(s.DB(), events)
+	if err != nil {
+		t.Fatalf("could not insert events: %v", err)
+	}
+	if len(inserted) != 1 || inserted[0].EventID != "e2" {
+		t.Errorf("inserted %v, want only e2", inserted)
+	}
+}
+
+func TestIsTransientStoreError(t *testing.T) {
+	s := openTestStore(t)
+	constraint := s.DB().Exec("INSERT INTO watermarks (name) VALUES ('a'), ('a')").Error
+	if constraint == nil {
+		t.Fatal("duplicate watermarks were stored")
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"no error", nil, false},
+		{"constraint violation", constraint, false},
+		{"dropped connection", fmt.Errorf("insert: %w", driver.ErrBadConn), true},
+		{"refused connection", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true},
+		{"timeout", context.DeadlineExceeded, true},
+		{"postgres unique violation", &pgconn.PgError{Code: "23505"}, false},
+		{"postgres shutting down", &pgconn.PgError{Code: "57P01"}, true},
+		{"clickhouse type mismatch", &clickhousego.Exception{Code: 53}, false},
+		{"clickhouse too many parts", &clickhousego.Exception{Code: 252}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransientStoreError(tt.err); got != tt.want {
+				t.Errorf("isTransientStoreError(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+	}
+}